@@ -0,0 +1,366 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/offchainlabs/nitro/arbcompress"
+	"github.com/offchainlabs/nitro/arbos"
+)
+
+type EncodeStats struct {
+	// Sum of the segment lengths, before RLP encoding and compression
+	UncompressedSegmentBytes int
+	// Size of everything after the 40 byte L1 header
+	CompressedBytes int
+	SegmentCount    int
+}
+
+// Returns a deep copy, whose segments can be modified without affecting the original
+func (m *sequencerMessage) clone() *sequencerMessage {
+	clone := *m
+	clone.segments = make([][]byte, len(m.segments))
+	for i, segment := range m.segments {
+		clone.segments[i] = append([]byte{}, segment...)
+	}
+	return &clone
+}
+
+// Serializes the message as a brotli-compressed sequencer batch, the format parseSequencerMessage reads
+func (m *sequencerMessage) encode() ([]byte, error) {
+	data, _, err := m.encodeWithStats()
+	return data, err
+}
+
+func (m *sequencerMessage) encodeWithStats() ([]byte, EncodeStats, error) {
+	return m.encodeAs(BrotliMessageHeaderByte, brotli.DefaultCompression)
+}
+
+// Like encode, but writes the RLP segment stream without compression, for debugging compression issues.
+// The multiplexer only parses such batches if the config enables UncompressedBatches.
+func (m *sequencerMessage) encodeUncompressed() ([]byte, error) {
+	data, _, err := m.encodeAs(UncompressedMessageHeaderByte, 0)
+	return data, err
+}
+
+// Like encodeUncompressed, but brotli-compresses each L2 message segment on its own, as a BatchSegmentKindL2MessageBrotli
+// segment, when that makes it shorter. The multiplexer only parses such batches if the config enables SegmentCompressedBatches.
+func (m *sequencerMessage) encodeSegmentCompressed() ([]byte, error) {
+	data, _, err := m.encodeAs(SegmentCompressedMessageHeaderByte, 0)
+	return data, err
+}
+
+// Like encode, but compresses at the given brotli level, from brotli.BestSpeed to brotli.BestCompression
+func (m *sequencerMessage) encodeWithLevel(level int) ([]byte, error) {
+	if level < brotli.BestSpeed || level > brotli.BestCompression {
+		return nil, fmt.Errorf("brotli compression level %v out of range [%v, %v]", level, brotli.BestSpeed, brotli.BestCompression)
+	}
+	data, _, err := m.encodeAs(BrotliMessageHeaderByte, level)
+	return data, err
+}
+
+// Like encode, but streams the batch to w instead of buffering it in memory
+func (m *sequencerMessage) encodeTo(w io.Writer) error {
+	_, err := m.encodeAsTo(w, BrotliMessageHeaderByte, brotli.DefaultCompression)
+	return err
+}
+
+// The level is ignored for UncompressedMessageHeaderByte and SegmentCompressedMessageHeaderByte
+func (m *sequencerMessage) encodeAs(headerByte byte, level int) ([]byte, EncodeStats, error) {
+	var buf bytes.Buffer
+	stats, err := m.encodeAsTo(&buf, headerByte, level)
+	if err != nil {
+		return nil, stats, err
+	}
+	return buf.Bytes(), stats, nil
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += n
+	return n, err
+}
+
+func (m *sequencerMessage) encodeAsTo(w io.Writer, headerByte byte, level int) (EncodeStats, error) {
+	stats := EncodeStats{
+		SegmentCount: len(m.segments),
+	}
+	header := make([]byte, 40)
+	binary.BigEndian.PutUint64(header[:8], m.minTimestamp)
+	binary.BigEndian.PutUint64(header[8:16], m.maxTimestamp)
+	binary.BigEndian.PutUint64(header[16:24], m.minL1Block)
+	binary.BigEndian.PutUint64(header[24:32], m.maxL1Block)
+	binary.BigEndian.PutUint64(header[32:40], m.afterDelayedMessages)
+	if _, err := w.Write(header); err != nil {
+		return stats, err
+	}
+	payload := &countingWriter{writer: w}
+	if _, err := payload.Write([]byte{headerByte}); err != nil {
+		return stats, err
+	}
+	var writer io.Writer = payload
+	var brotliWriter *brotli.Writer
+	if headerByte != UncompressedMessageHeaderByte && headerByte != SegmentCompressedMessageHeaderByte {
+		brotliWriter = brotli.NewWriterLevel(payload, level)
+		writer = brotliWriter
+	}
+	for _, segment := range m.segments {
+		encoded := segment
+		if headerByte == SegmentCompressedMessageHeaderByte {
+			var err error
+			encoded, err = compressSegment(segment)
+			if err != nil {
+				return stats, err
+			}
+		}
+		if err := rlp.Encode(writer, encoded); err != nil {
+			return stats, err
+		}
+		stats.UncompressedSegmentBytes += len(segment)
+	}
+	if brotliWriter != nil {
+		if err := brotliWriter.Close(); err != nil {
+			return stats, err
+		}
+	}
+	stats.CompressedBytes = payload.count
+	return stats, nil
+}
+
+// Replaces an L2 message segment with a BatchSegmentKindL2MessageBrotli segment of the same message if that's shorter
+func compressSegment(segment []byte) ([]byte, error) {
+	if len(segment) == 0 || segment[0] != BatchSegmentKindL2Message {
+		return segment, nil
+	}
+	compressed, err := arbcompress.CompressWell(segment[1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed)+1 >= len(segment) {
+		return segment, nil
+	}
+	return append([]byte{BatchSegmentKindL2MessageBrotli}, compressed...), nil
+}
+
+// Parses a batch and encodes it again with encode, normalizing its RLP and compression.
+// Brotli output differs between levels and versions, so the result is only guaranteed to have the same header and segments,
+// not to be byte-equal to a batch produced the same way. Batches that don't parse cleanly, including DAS batches, are rejected.
+func Reencode(data []byte) ([]byte, error) {
+	config := DefaultInboxMultiplexerConfig
+	config.Strict = true
+	seqMsg, err := parseSequencerMessage(context.Background(), 0, data, nil, KeysetValidate, &config)
+	if err != nil {
+		return nil, err
+	}
+	return seqMsg.encode()
+}
+
+// Combines two consecutive batches into one with a's segments followed by b's, the union of their timestamp and
+// L1 block ranges, and b's afterDelayedMessages. The batches must parse cleanly, as with Reencode.
+// a is assumed to start at its afterDelayedMessages less its number of delayed message segments, as batches built by
+// BatchBuilder do, and b to start where a ends. Merges that would change any message are rejected, such as when a's
+// messages were clamped to its own ranges, or b's timestamps and block numbers would accumulate on top of a's differently.
+func MergeBatches(a, b []byte) ([]byte, error) {
+	config := DefaultInboxMultiplexerConfig
+	config.Strict = true
+	first, err := parseSequencerMessage(context.Background(), 0, a, nil, KeysetValidate, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse first batch: %w", err)
+	}
+	second, err := parseSequencerMessage(context.Background(), 0, b, nil, KeysetValidate, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse second batch: %w", err)
+	}
+	if second.afterDelayedMessages < first.afterDelayedMessages {
+		return nil, fmt.Errorf(
+			"second batch's afterDelayedMessages %v is below the first batch's %v",
+			second.afterDelayedMessages, first.afterDelayedMessages,
+		)
+	}
+	if second.minTimestamp < first.minTimestamp || second.maxTimestamp < first.maxTimestamp {
+		return nil, fmt.Errorf(
+			"second batch's timestamp range [%v, %v] starts or ends before the first batch's [%v, %v]",
+			second.minTimestamp, second.maxTimestamp, first.minTimestamp, first.maxTimestamp,
+		)
+	}
+	if second.minL1Block < first.minL1Block || second.maxL1Block < first.maxL1Block {
+		return nil, fmt.Errorf(
+			"second batch's L1 block range [%v, %v] starts or ends before the first batch's [%v, %v]",
+			second.minL1Block, second.maxL1Block, first.minL1Block, first.maxL1Block,
+		)
+	}
+	delayedSegments := uint64(0)
+	for _, segment := range first.segments {
+		if len(segment) > 0 && segment[0] == BatchSegmentKindDelayedMessages {
+			delayedSegments++
+		}
+	}
+	if delayedSegments > first.afterDelayedMessages {
+		return nil, fmt.Errorf("first batch has %v delayed message segments but afterDelayedMessages %v", delayedSegments, first.afterDelayedMessages)
+	}
+	merged := &sequencerMessage{
+		minTimestamp:         first.minTimestamp,
+		maxTimestamp:         second.maxTimestamp,
+		minL1Block:           first.minL1Block,
+		maxL1Block:           second.maxL1Block,
+		afterDelayedMessages: second.afterDelayedMessages,
+		segments:             append(append([][]byte{}, first.segments...), second.segments...),
+	}
+	startDelayed := first.afterDelayedMessages - delayedSegments
+	expected, err := decodeForMerge(first, startDelayed)
+	if err != nil {
+		return nil, err
+	}
+	secondMsgs, err := decodeForMerge(second, first.afterDelayedMessages)
+	if err != nil {
+		return nil, err
+	}
+	expected = append(expected, secondMsgs...)
+	got, err := decodeForMerge(merged, startDelayed)
+	if err != nil {
+		return nil, err
+	}
+	if len(got) != len(expected) {
+		return nil, fmt.Errorf("merged batch produces %v messages instead of %v", len(got), len(expected))
+	}
+	for i := range got {
+		if !got[i].Equals(&expected[i]) {
+			return nil, fmt.Errorf("merged batch changes message %v", i)
+		}
+	}
+	return merged.encode()
+}
+
+// Decodes a parsed batch with placeholder delayed messages, which hold their sequence number as their L2msg,
+// so the messages of different batches can be compared without a delayed inbox
+func decodeForMerge(seqMsg *sequencerMessage, startDelayed uint64) ([]MessageWithMetadata, error) {
+	data, err := seqMsg.encodeUncompressed()
+	if err != nil {
+		return nil, err
+	}
+	config := DefaultInboxMultiplexerConfig
+	config.UncompressedBatches = true
+	config.DelayedReader = delayedInboxReaderFunc(func(seqNum uint64) ([]byte, error) {
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, seqNum)
+		return data, nil
+	})
+	config.DelayedParser = func(rd io.Reader) (*arbos.L1IncomingMessage, error) {
+		seqNum, err := io.ReadAll(rd)
+		if err != nil {
+			return nil, err
+		}
+		return &arbos.L1IncomingMessage{
+			Header: &arbos.L1IncomingMessageHeader{Kind: arbos.L1MessageType_EthDeposit},
+			L2msg:  seqNum,
+		}, nil
+	}
+	return decodeBatchWithConfig(data, startDelayed, &config)
+}
+
+// Assembles a sequencer batch segment by segment
+type BatchBuilder struct {
+	segments [][]byte
+}
+
+func NewBatchBuilder() *BatchBuilder {
+	return &BatchBuilder{}
+}
+
+func (b *BatchBuilder) AddL2Message(l2msg []byte) {
+	segment := make([]byte, 1, len(l2msg)+1)
+	segment[0] = BatchSegmentKindL2Message
+	b.segments = append(b.segments, append(segment, l2msg...))
+}
+
+func (b *BatchBuilder) AddL2MessageBrotli(l2msg []byte) error {
+	compressed, err := arbcompress.CompressWell(l2msg)
+	if err != nil {
+		return err
+	}
+	segment := make([]byte, 1, len(compressed)+1)
+	segment[0] = BatchSegmentKindL2MessageBrotli
+	b.segments = append(b.segments, append(segment, compressed...))
+	return nil
+}
+
+// Only readable by multiplexers with ZstdSegments enabled
+func (b *BatchBuilder) AddL2MessageZstd(l2msg []byte) error {
+	compressed, err := compressZstd(l2msg)
+	if err != nil {
+		return err
+	}
+	segment := make([]byte, 1, len(compressed)+1)
+	segment[0] = BatchSegmentKindL2MessageZstd
+	b.segments = append(b.segments, append(segment, compressed...))
+	return nil
+}
+
+// Each delayed messages segment reads one delayed message
+func (b *BatchBuilder) AddDelayedMessages(count uint64) {
+	for i := uint64(0); i < count; i++ {
+		b.segments = append(b.segments, []byte{BatchSegmentKindDelayedMessages})
+	}
+}
+
+func (b *BatchBuilder) addAdvanceSegment(kind uint8, delta uint64) error {
+	encoded, err := rlp.EncodeToBytes(delta)
+	if err != nil {
+		return err
+	}
+	b.segments = append(b.segments, append([]byte{kind}, encoded...))
+	return nil
+}
+
+func (b *BatchBuilder) AdvanceTimestamp(delta uint64) error {
+	return b.addAdvanceSegment(BatchSegmentKindAdvanceTimestamp, delta)
+}
+
+func (b *BatchBuilder) AdvanceL1BlockNumber(delta uint64) error {
+	return b.addAdvanceSegment(BatchSegmentKindAdvanceL1BlockNumber, delta)
+}
+
+func (b *BatchBuilder) Build(minTimestamp, maxTimestamp, minL1Block, maxL1Block, afterDelayedMessages uint64) ([]byte, error) {
+	return b.message(minTimestamp, maxTimestamp, minL1Block, maxL1Block, afterDelayedMessages).encode()
+}
+
+// Like Build, but streams the batch to w, for batches too large to buffer in memory
+func (b *BatchBuilder) BuildTo(w io.Writer, minTimestamp, maxTimestamp, minL1Block, maxL1Block, afterDelayedMessages uint64) error {
+	return b.message(minTimestamp, maxTimestamp, minL1Block, maxL1Block, afterDelayedMessages).encodeTo(w)
+}
+
+// Like Build, but without compressing the segments
+func (b *BatchBuilder) BuildUncompressed(minTimestamp, maxTimestamp, minL1Block, maxL1Block, afterDelayedMessages uint64) ([]byte, error) {
+	return b.message(minTimestamp, maxTimestamp, minL1Block, maxL1Block, afterDelayedMessages).encodeUncompressed()
+}
+
+// Like BuildUncompressed, but compresses each L2 message on its own where that's shorter, see encodeSegmentCompressed
+func (b *BatchBuilder) BuildSegmentCompressed(minTimestamp, maxTimestamp, minL1Block, maxL1Block, afterDelayedMessages uint64) ([]byte, error) {
+	return b.message(minTimestamp, maxTimestamp, minL1Block, maxL1Block, afterDelayedMessages).encodeSegmentCompressed()
+}
+
+func (b *BatchBuilder) message(minTimestamp, maxTimestamp, minL1Block, maxL1Block, afterDelayedMessages uint64) *sequencerMessage {
+	return &sequencerMessage{
+		minTimestamp:         minTimestamp,
+		maxTimestamp:         maxTimestamp,
+		minL1Block:           minL1Block,
+		maxL1Block:           maxL1Block,
+		afterDelayedMessages: afterDelayedMessages,
+		segments:             b.segments,
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/offchainlabs/nitro/arbos"
+)
+
+func TestBatchBuilderRoundTrip(t *testing.T) {
+	builder := NewBatchBuilder()
+	Require(t, builder.AdvanceTimestamp(10))
+	Require(t, builder.AdvanceL1BlockNumber(3))
+	builder.AddL2Message([]byte("plain"))
+	builder.AddDelayedMessages(2)
+	Require(t, builder.AddL2MessageBrotli([]byte("compressed")))
+	batch, err := builder.Build(5, 200, 2, 40, 2)
+	Require(t, err)
+
+	parsed, err := parseSequencerMessage(context.Background(), 0, batch, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if parsed.minTimestamp != 5 || parsed.maxTimestamp != 200 || parsed.minL1Block != 2 || parsed.maxL1Block != 40 || parsed.afterDelayedMessages != 2 {
+		Fail(t, "header didn't round trip", parsed)
+	}
+	if len(parsed.segments) != len(builder.segments) {
+		Fail(t, "expected", len(builder.segments), "segments but got", len(parsed.segments))
+	}
+	for i, segment := range builder.segments {
+		if !bytes.Equal(parsed.segments[i], segment) {
+			Fail(t, "segment", i, "didn't round trip")
+		}
+	}
+
+	delayed := [][]byte{encodeTestDelayedMessage(t, 0), encodeTestDelayedMessage(t, 1)}
+	backend := NewMemoryInboxBackend([][]byte{batch}, delayed)
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	expected := []struct {
+		kind  uint8
+		l2msg []byte
+	}{
+		{arbos.L1MessageType_L2Message, []byte("plain")},
+		{arbos.L1MessageType_EthDeposit, []byte("deposit")},
+		{arbos.L1MessageType_EthDeposit, []byte("deposit")},
+		{arbos.L1MessageType_L2Message, []byte("compressed")},
+	}
+	for i, want := range expected {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if msg.Message.Header.Kind != want.kind || !bytes.Equal(msg.Message.L2msg, want.l2msg) {
+			Fail(t, "message", i, "was", msg.Message.Header.Kind, string(msg.Message.L2msg))
+		}
+		if want.kind == arbos.L1MessageType_L2Message && (msg.Message.Header.Timestamp != 10 || msg.Message.Header.BlockNumber != 3) {
+			Fail(t, "message", i, "had timestamp", msg.Message.Header.Timestamp, "and block", msg.Message.Header.BlockNumber)
+		}
+	}
+	if backend.GetSequencerInboxPosition() != 1 {
+		Fail(t, "multiplexer didn't finish the batch")
+	}
+}
+
+func TestEncodeWithStats(t *testing.T) {
+	segments := [][]byte{
+		append([]byte{BatchSegmentKindL2Message}, bytes.Repeat([]byte("abc"), 100)...),
+		{BatchSegmentKindDelayedMessages},
+		{},
+	}
+	msg := &sequencerMessage{segments: segments}
+	data, stats, err := msg.encodeWithStats()
+	Require(t, err)
+	expectedBytes := 0
+	for _, segment := range segments {
+		expectedBytes += len(segment)
+	}
+	if stats.UncompressedSegmentBytes != expectedBytes || stats.SegmentCount != len(segments) {
+		Fail(t, "unexpected stats", stats)
+	}
+	if stats.CompressedBytes != len(data)-40 {
+		Fail(t, "compressed size", stats.CompressedBytes, "doesn't match output length", len(data))
+	}
+	encoded, err := msg.encode()
+	Require(t, err)
+	if !bytes.Equal(encoded, data) {
+		Fail(t, "encode and encodeWithStats disagree")
+	}
+}
+
+func TestEncodeWithLevel(t *testing.T) {
+	builder := NewBatchBuilder()
+	for i := 0; i < 50; i++ {
+		builder.AddL2Message(bytes.Repeat([]byte{byte(i)}, 64))
+	}
+	msg := &sequencerMessage{segments: builder.segments}
+	for _, level := range []int{brotli.BestSpeed, brotli.BestCompression} {
+		data, err := msg.encodeWithLevel(level)
+		Require(t, err)
+		parsed, err := parseSequencerMessage(context.Background(), 0, data, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+		Require(t, err)
+		if len(parsed.segments) != len(msg.segments) {
+			Fail(t, "level", level, "produced", len(parsed.segments), "segments")
+		}
+		for i := range msg.segments {
+			if !bytes.Equal(parsed.segments[i], msg.segments[i]) {
+				Fail(t, "level", level, "segment", i, "mismatch")
+			}
+		}
+	}
+	for _, level := range []int{-1, brotli.BestCompression + 1} {
+		if _, err := msg.encodeWithLevel(level); err == nil {
+			Fail(t, "accepted out of range level", level)
+		}
+	}
+}
+
+func TestEncodeUncompressed(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte("uncompressed message"))
+	builder.AddDelayedMessages(1)
+	Require(t, builder.AdvanceTimestamp(5))
+	builder.AddL2Message(bytes.Repeat([]byte{1}, 100))
+	data, err := builder.BuildUncompressed(1, 10, 2, 20, 1)
+	Require(t, err)
+	if data[40] != UncompressedMessageHeaderByte {
+		Fail(t, "unexpected header byte", data[40])
+	}
+	// the default config leaves the format unknown, so the batch has no segments
+	parsed, err := parseSequencerMessage(context.Background(), 0, data, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if len(parsed.segments) != 0 {
+		Fail(t, "parsed", len(parsed.segments), "segments of an uncompressed batch under the default config")
+	}
+	config := DefaultInboxMultiplexerConfig
+	config.UncompressedBatches = true
+	parsed, err = parseSequencerMessage(context.Background(), 0, data, nil, KeysetValidate, &config)
+	Require(t, err)
+	if parsed.minTimestamp != 1 || parsed.maxTimestamp != 10 || parsed.minL1Block != 2 || parsed.maxL1Block != 20 || parsed.afterDelayedMessages != 1 {
+		Fail(t, "unexpected header", parsed)
+	}
+	if len(parsed.segments) != len(builder.segments) {
+		Fail(t, "parsed", len(parsed.segments), "segments instead of", len(builder.segments))
+	}
+	for i := range builder.segments {
+		if !bytes.Equal(parsed.segments[i], builder.segments[i]) {
+			Fail(t, "segment", i, "mismatch")
+		}
+	}
+
+	// the segment stream is still bounded by MaxDecompressedLen
+	config.MaxDecompressedLen = int64(len(data) - 41 - 10)
+	parsed, err = parseSequencerMessage(context.Background(), 0, data, nil, KeysetValidate, &config)
+	Require(t, err)
+	if len(parsed.segments) != len(builder.segments)-1 {
+		Fail(t, "parsed", len(parsed.segments), "segments past MaxDecompressedLen")
+	}
+}
+
+func TestSegmentCompressedBatch(t *testing.T) {
+	compressible := bytes.Repeat([]byte("compressible "), 100)
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte("short"))
+	builder.AddL2Message(compressible)
+	builder.AddL2Message([]byte("another"))
+	batch, err := builder.BuildSegmentCompressed(0, 0, 0, 0, 0)
+	Require(t, err)
+	if batch[40] != SegmentCompressedMessageHeaderByte {
+		Fail(t, "unexpected header byte", batch[40])
+	}
+	if len(batch) >= len(compressible) {
+		Fail(t, "the compressible message wasn't compressed")
+	}
+	// the default config leaves the format unknown, so the batch has no segments
+	parsed, err := parseSequencerMessage(context.Background(), 0, batch, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if len(parsed.segments) != 0 {
+		Fail(t, "parsed", len(parsed.segments), "segments of a segment compressed batch under the default config")
+	}
+	config := DefaultInboxMultiplexerConfig
+	config.SegmentCompressedBatches = true
+	parsed, err = parseSequencerMessage(context.Background(), 0, batch, nil, KeysetValidate, &config)
+	Require(t, err)
+	kinds := make([]uint8, 0, len(parsed.segments))
+	for _, segment := range parsed.segments {
+		kinds = append(kinds, segment[0])
+	}
+	expectedKinds := []uint8{BatchSegmentKindL2Message, BatchSegmentKindL2MessageBrotli, BatchSegmentKindL2Message}
+	if !reflect.DeepEqual(kinds, expectedKinds) {
+		Fail(t, "unexpected segment kinds", kinds)
+	}
+
+	msgs, err := decodeBatchWithConfig(batch, 0, &config)
+	Require(t, err)
+	expected := [][]byte{[]byte("short"), compressible, []byte("another")}
+	if len(msgs) != len(expected) {
+		Fail(t, "decoded", len(msgs), "messages instead of", len(expected))
+	}
+	for i, l2msg := range expected {
+		if msgs[i].Message.Header.Kind != arbos.L1MessageType_L2Message || !bytes.Equal(msgs[i].Message.L2msg, l2msg) {
+			Fail(t, "message", i, "was", msgs[i].Message.Header.Kind, string(msgs[i].Message.L2msg))
+		}
+	}
+}
+
+func TestEncodeTo(t *testing.T) {
+	builder := NewBatchBuilder()
+	for i := 0; i < 100; i++ {
+		builder.AddL2Message(bytes.Repeat([]byte{byte(i)}, 1000))
+	}
+	builder.AddDelayedMessages(1)
+	expected, err := builder.Build(1, 10, 2, 20, 1)
+	Require(t, err)
+	var buf bytes.Buffer
+	writer := &countingWriter{writer: &buf}
+	Require(t, builder.BuildTo(writer, 1, 10, 2, 20, 1))
+	if writer.count != len(expected) {
+		Fail(t, "streamed", writer.count, "bytes instead of", len(expected))
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		Fail(t, "streamed batch differs from Build")
+	}
+	parsed, err := parseSequencerMessage(context.Background(), 0, buf.Bytes(), nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if len(parsed.segments) != len(builder.segments) {
+		Fail(t, "parsed", len(parsed.segments), "segments instead of", len(builder.segments))
+	}
+}
+
+func TestSequencerMessageClone(t *testing.T) {
+	original := &sequencerMessage{
+		maxTimestamp:         10,
+		afterDelayedMessages: 1,
+		segments: [][]byte{
+			{BatchSegmentKindL2Message, 1, 2, 3},
+			{BatchSegmentKindDelayedMessages},
+		},
+	}
+	originalEncoded, err := original.encode()
+	Require(t, err)
+
+	clone := original.clone()
+	clone.segments[0][1] = 0xff
+	clone.segments = append(clone.segments, []byte{BatchSegmentKindL2Message, 4})
+	if original.segments[0][1] != 1 || len(original.segments) != 2 {
+		Fail(t, "modifying the clone changed the original")
+	}
+
+	encoded, err := original.encode()
+	Require(t, err)
+	if !bytes.Equal(encoded, originalEncoded) {
+		Fail(t, "original encodes differently after modifying its clone")
+	}
+	cloneEncoded, err := clone.encode()
+	Require(t, err)
+	if bytes.Equal(cloneEncoded, originalEncoded) {
+		Fail(t, "modified clone encodes the same as the original")
+	}
+	parsed, err := parseSequencerMessage(context.Background(), 0, cloneEncoded, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if len(parsed.segments) != 3 || parsed.segments[0][1] != 0xff || parsed.maxTimestamp != 10 {
+		Fail(t, "clone didn't round trip", parsed.segments)
+	}
+}
+
+func TestReencode(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte("first message"))
+	builder.AddDelayedMessages(2)
+	Require(t, builder.AdvanceTimestamp(3))
+	Require(t, builder.AddL2MessageBrotli(bytes.Repeat([]byte{1}, 100)))
+	builder.segments = append(builder.segments, []byte{})
+	original, err := builder.Build(1, 10, 2, 20, 2)
+	Require(t, err)
+
+	reencoded, err := Reencode(original)
+	Require(t, err)
+	if reencoded[40] != BrotliMessageHeaderByte {
+		Fail(t, "reencoded batch has header byte", reencoded[40])
+	}
+	expected, err := parseSequencerMessage(context.Background(), 0, original, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	parsed, err := parseSequencerMessage(context.Background(), 0, reencoded, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if !reflect.DeepEqual(parsed, expected) {
+		Fail(t, "reencoded batch parsed to", parsed, "instead of", expected)
+	}
+
+	if _, err := Reencode(append(original[:40:40], 0x11)); !errors.Is(err, ErrInvalidSequencerMessage) {
+		Fail(t, "reencoded a batch of unknown format, err", err)
+	}
+}
+
+func TestMergeBatches(t *testing.T) {
+	first := NewBatchBuilder()
+	Require(t, first.AdvanceTimestamp(15))
+	first.AddL2Message([]byte("first"))
+	a, err := first.Build(10, 20, 0, 100, 0)
+	Require(t, err)
+	second := NewBatchBuilder()
+	second.AddL2Message([]byte("second"))
+	second.AddL2Message([]byte("third"))
+	b, err := second.Build(15, 30, 0, 100, 0)
+	Require(t, err)
+
+	merged, err := MergeBatches(a, b)
+	Require(t, err)
+	decoded, err := Decode(merged)
+	Require(t, err)
+	if decoded.MinTimestamp != 10 || decoded.MaxTimestamp != 30 || len(decoded.Segments) != 4 {
+		Fail(t, "unexpected merged batch", decoded)
+	}
+	msgs, err := DecodeBatch(merged, 0, nil)
+	Require(t, err)
+	expected := []struct {
+		l2msg     string
+		timestamp uint64
+	}{{"first", 15}, {"second", 15}, {"third", 15}}
+	if len(msgs) != len(expected) {
+		Fail(t, "merged batch has", len(msgs), "messages")
+	}
+	for i, want := range expected {
+		if string(msgs[i].Message.L2msg) != want.l2msg || msgs[i].Message.Header.Timestamp != want.timestamp {
+			Fail(t, "message", i, "was", string(msgs[i].Message.L2msg), "at", msgs[i].Message.Header.Timestamp)
+		}
+	}
+
+	// b's messages are clamped up to its minimum, which they wouldn't be in the merged batch
+	clamped, err := second.Build(18, 30, 0, 100, 0)
+	Require(t, err)
+	if _, err := MergeBatches(a, clamped); err == nil {
+		Fail(t, "merged batches with inconsistent clamping")
+	}
+	// b's timestamps would accumulate on top of a's
+	Require(t, second.AdvanceTimestamp(5))
+	second.AddL2Message([]byte("fourth"))
+	advancing, err := second.Build(15, 30, 0, 100, 0)
+	Require(t, err)
+	if _, err := MergeBatches(a, advancing); err == nil {
+		Fail(t, "merged batches with inconsistent timestamps")
+	}
+}
+
+func TestMergeBatchesDelayedCounts(t *testing.T) {
+	first := NewBatchBuilder()
+	first.AddDelayedMessages(2)
+	a, err := first.Build(0, 0, 0, 0, 2)
+	Require(t, err)
+	second := NewBatchBuilder()
+	second.AddDelayedMessages(1)
+	b, err := second.Build(0, 0, 0, 0, 1)
+	Require(t, err)
+	if _, err := MergeBatches(a, b); err == nil {
+		Fail(t, "merged a batch with a lower afterDelayedMessages")
+	}
+
+	b, err = second.Build(0, 0, 0, 0, 3)
+	Require(t, err)
+	merged, err := MergeBatches(a, b)
+	Require(t, err)
+	indices, err := DelayedMessageIndices(merged, 0)
+	Require(t, err)
+	if !reflect.DeepEqual(indices, []uint64{0, 1, 2}) {
+		Fail(t, "merged batch reads delayed messages", indices)
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/offchainlabs/nitro/arbcompress"
+	"github.com/offchainlabs/nitro/arbos"
+)
+
+type delayedInboxReaderFunc func(seqNum uint64) ([]byte, error)
+
+func (f delayedInboxReaderFunc) ReadDelayedInbox(seqNum uint64) ([]byte, error) {
+	return f(seqNum)
+}
+
+// Decodes every message of a single batch, reading its delayed messages from readDelayed starting at startDelayed.
+// Malformed parts of the batch become invalid messages, exactly as they would when popped from a multiplexer.
+// A nil readDelayed is only usable with batches that don't read delayed messages.
+func DecodeBatch(data []byte, startDelayed uint64, readDelayed func(uint64) ([]byte, error)) ([]MessageWithMetadata, error) {
+	config := DefaultInboxMultiplexerConfig
+	if readDelayed != nil {
+		config.DelayedReader = delayedInboxReaderFunc(readDelayed)
+	}
+	return decodeBatchWithConfig(data, startDelayed, &config)
+}
+
+func decodeBatchWithConfig(data []byte, startDelayed uint64, config *InboxMultiplexerConfig) ([]MessageWithMetadata, error) {
+	backend := NewMemoryInboxBackend([][]byte{data}, nil)
+	multiplexer := NewInboxMultiplexerWithConfig(backend, startDelayed, nil, KeysetValidate, config)
+	var msgs []MessageWithMetadata
+	for {
+		msg, info, err := multiplexer.PopWithInfo(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, *msg)
+		if info.CrossedBatchBoundary {
+			return msgs, nil
+		}
+	}
+}
+
+// Counts the messages a multiplexer would produce from a batch, starting at startDelayed delayed messages read,
+// without decompressing L2 messages or reading delayed messages.
+// Delayed counts the delayed messages the batch consumes, and l2 every other message,
+// which includes any invalid messages produced from malformed segments.
+// Segments after the last one producing a message aren't reached, as with DefaultInboxMultiplexerConfig.
+func CountMessages(data []byte, startDelayed uint64) (l2 int, delayed int, err error) {
+	seqMsg, err := parseSequencerMessageForInspection(data)
+	if errors.Is(err, ErrSequencerMessageMissingL1Header) {
+		// the multiplexer turns the whole batch into one invalid message
+		return 1, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	lastContent := lastContentSegment(seqMsg.segments, DefaultInboxMultiplexerConfig.ZstdSegments)
+	l2, delayed = countMessagesFrom(seqMsg, 0, startDelayed, lastContent, 0)
+	return l2, delayed, nil
+}
+
+// Returns the sequence numbers of the delayed messages a batch reads, starting at startDelayed delayed messages read.
+// Delayed messages are only read while below the batch's afterDelayedMessages, and any its delayed segments don't read
+// are read after its last segment, so these are consecutive from startDelayed up to afterDelayedMessages-1.
+func DelayedMessageIndices(data []byte, startDelayed uint64) ([]uint64, error) {
+	_, delayed, err := CountMessages(data, startDelayed)
+	if err != nil {
+		return nil, err
+	}
+	indices := make([]uint64, 0, delayed)
+	for i := 0; i < delayed; i++ {
+		indices = append(indices, startDelayed+uint64(i))
+	}
+	return indices, nil
+}
+
+// Reports whether popping a batch, starting at startDelayed delayed messages read, may read the delayed inbox.
+// That's the case if it has a delayed messages segment or its afterDelayedMessages is past startDelayed,
+// which leaves virtual delayed messages to read after its last segment.
+func RequiresDelayedReads(data []byte, startDelayed uint64) (bool, error) {
+	seqMsg, err := parseSequencerMessageForInspection(data)
+	if errors.Is(err, ErrSequencerMessageMissingL1Header) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if seqMsg.afterDelayedMessages > startDelayed {
+		return true, nil
+	}
+	for _, segment := range seqMsg.segments {
+		if len(segment) > 0 && segment[0] == BatchSegmentKindDelayedMessages {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns the version of a batch's L1 header, which is 0 for batches without the HeaderExtensionFlag.
+// Extended headers store their version in the byte after the format byte.
+func HeaderVersion(data []byte) (uint8, error) {
+	if len(data) < 40 {
+		return 0, ErrSequencerMessageMissingL1Header
+	}
+	if len(data) == 40 || !IsHeaderExtensionByte(data[40]) {
+		return 0, nil
+	}
+	if len(data) == 41 {
+		return 0, errors.New("extended sequencer message header is missing its version")
+	}
+	return data[41], nil
+}
+
+// Returns the afterDelayedMessages from a batch's L1 header, without decompressing it
+func AfterDelayedMessages(data []byte) (uint64, error) {
+	if len(data) < 40 {
+		return 0, ErrSequencerMessageMissingL1Header
+	}
+	return binary.BigEndian.Uint64(data[32:40]), nil
+}
+
+// Returns how many delayed messages a batch reads, starting at startDelayed delayed messages read,
+// from its L1 header alone without decompressing it
+func HeaderDelayedCount(data []byte, startDelayed uint64) (uint64, error) {
+	afterDelayedMessages, err := AfterDelayedMessages(data)
+	if err != nil {
+		return 0, err
+	}
+	if afterDelayedMessages <= startDelayed {
+		return 0, nil
+	}
+	return afterDelayedMessages - startDelayed, nil
+}
+
+// Returns the timestamp and L1 block ranges from a batch's L1 header, without decompressing it
+func BatchSpan(data []byte) (minTs, maxTs, minBlock, maxBlock uint64, err error) {
+	if len(data) < 40 {
+		return 0, 0, 0, 0, ErrSequencerMessageMissingL1Header
+	}
+	minTs = binary.BigEndian.Uint64(data[:8])
+	maxTs = binary.BigEndian.Uint64(data[8:16])
+	minBlock = binary.BigEndian.Uint64(data[16:24])
+	maxBlock = binary.BigEndian.Uint64(data[24:32])
+	return minTs, maxTs, minBlock, maxBlock, nil
+}
+
+// Identifies a batch by the keccak256 hash of its raw bytes
+func BatchHash(data []byte) common.Hash {
+	return crypto.Keccak256Hash(data)
+}
+
+// Counts the messages a multiplexer produces from seqMsg, where the next message is the first at or after segmentNum,
+// walking the segments the way getNextMsg does, one message per iteration.
+// A nonzero maxVirtualDelayed stops it after that many virtual delayed messages, as MaxVirtualDelayedMessages does.
+func countMessagesFrom(seqMsg *sequencerMessage, segmentNum int, delayedMessagesRead uint64, lastContent int, maxVirtualDelayed uint64) (l2 int, delayed int) {
+	virtualDelayed := uint64(0)
+	for {
+		for segmentNum < len(seqMsg.segments) {
+			segment := seqMsg.segments[segmentNum]
+			if len(segment) != 0 && segment[0] != BatchSegmentKindAdvanceTimestamp && segment[0] != BatchSegmentKindAdvanceL1BlockNumber {
+				break
+			}
+			segmentNum++
+		}
+		// past the last segment there are only virtual delayed messages
+		isDelayed := segmentNum >= len(seqMsg.segments) || seqMsg.segments[segmentNum][0] == BatchSegmentKindDelayedMessages
+		if isDelayed && delayedMessagesRead < seqMsg.afterDelayedMessages {
+			delayedMessagesRead++
+			delayed++
+		} else {
+			l2++
+		}
+		if segmentNum >= len(seqMsg.segments) {
+			virtualDelayed++
+			if maxVirtualDelayed != 0 && virtualDelayed >= maxVirtualDelayed {
+				return l2, delayed
+			}
+		}
+		if delayedMessagesRead >= seqMsg.afterDelayedMessages && (lastContent < 0 || lastContent <= segmentNum) {
+			return l2, delayed
+		}
+		segmentNum++
+	}
+}
+
+// Parses a batch for offline inspection, without DAS support
+func parseSequencerMessageForInspection(data []byte) (*sequencerMessage, error) {
+	return parseSequencerMessage(context.Background(), 0, data, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+}
+
+// Reports whether a segment kind is understood by a multiplexer with DefaultInboxMultiplexerConfig
+func isKnownSegmentKind(kind uint8) bool {
+	switch kind {
+	case BatchSegmentKindL2Message, BatchSegmentKindL2MessageBrotli, BatchSegmentKindDelayedMessages,
+		BatchSegmentKindAdvanceTimestamp, BatchSegmentKindAdvanceL1BlockNumber:
+		return true
+	case BatchSegmentKindL2MessageZstd:
+		return DefaultInboxMultiplexerConfig.ZstdSegments
+	default:
+		return false
+	}
+}
+
+// Returns a batch's raw segments, each still starting with its kind byte, without constructing messages.
+// Brotli and zstd compressed L2 message segments are returned still compressed.
+func DecodeSegments(data []byte) ([][]byte, error) {
+	seqMsg, err := parseSequencerMessageForInspection(data)
+	if err != nil {
+		return nil, err
+	}
+	return seqMsg.segments, nil
+}
+
+type SegmentKindCounts struct {
+	// Number of segments of each kind, including unknown kinds
+	Kinds map[uint8]int
+	// Number of zero-length segments, which have no kind
+	Empty int
+	// Number of segments whose kind isn't a BatchSegmentKind
+	Unknown int
+}
+
+func CountSegmentKinds(data []byte) (*SegmentKindCounts, error) {
+	seqMsg, err := parseSequencerMessageForInspection(data)
+	if err != nil {
+		return nil, err
+	}
+	counts := &SegmentKindCounts{
+		Kinds: make(map[uint8]int),
+	}
+	for _, segment := range seqMsg.segments {
+		if len(segment) == 0 {
+			counts.Empty++
+			continue
+		}
+		counts.Kinds[segment[0]]++
+		if !isKnownSegmentKind(segment[0]) {
+			counts.Unknown++
+		}
+	}
+	return counts, nil
+}
+
+type DecodedSegment struct {
+	Kind uint8 `json:"kind"`
+	// Set for zero-length segments, which have no kind
+	Empty bool `json:"empty,omitempty"`
+	// Length of the segment after its kind byte, once decompressed
+	PayloadLength int `json:"payloadLength"`
+	// For brotli-compressed L2 messages, the compressed length of the payload
+	CompressedLength int `json:"compressedLength,omitempty"`
+	// Set if a brotli-compressed L2 message failed to decompress, leaving PayloadLength zero
+	DecompressionFailed bool `json:"decompressionFailed,omitempty"`
+}
+
+// A description of a batch's header and segments, for debugging tools
+type DecodedBatch struct {
+	MinTimestamp         uint64           `json:"minTimestamp"`
+	MaxTimestamp         uint64           `json:"maxTimestamp"`
+	MinL1Block           uint64           `json:"minL1Block"`
+	MaxL1Block           uint64           `json:"maxL1Block"`
+	AfterDelayedMessages uint64           `json:"afterDelayedMessages"`
+	Segments             []DecodedSegment `json:"segments"`
+}
+
+// Returns the seconds between the batch's minimum and maximum timestamps, or 0 if its range is inverted
+func (b *DecodedBatch) TimestampRange() uint64 {
+	if b.MaxTimestamp < b.MinTimestamp {
+		return 0
+	}
+	return b.MaxTimestamp - b.MinTimestamp
+}
+
+// Returns the L1 blocks between the batch's minimum and maximum L1 block numbers, or 0 if its range is inverted
+func (b *DecodedBatch) BlockRange() uint64 {
+	if b.MaxL1Block < b.MinL1Block {
+		return 0
+	}
+	return b.MaxL1Block - b.MinL1Block
+}
+
+// Returns a copy that doesn't share its segment descriptors with the original
+func (b *DecodedBatch) Clone() *DecodedBatch {
+	clone := *b
+	clone.Segments = append([]DecodedSegment{}, b.Segments...)
+	return &clone
+}
+
+func Decode(data []byte) (*DecodedBatch, error) {
+	seqMsg, err := parseSequencerMessageForInspection(data)
+	if err != nil {
+		return nil, err
+	}
+	decoded := &DecodedBatch{
+		MinTimestamp:         seqMsg.minTimestamp,
+		MaxTimestamp:         seqMsg.maxTimestamp,
+		MinL1Block:           seqMsg.minL1Block,
+		MaxL1Block:           seqMsg.maxL1Block,
+		AfterDelayedMessages: seqMsg.afterDelayedMessages,
+		Segments:             make([]DecodedSegment, 0, len(seqMsg.segments)),
+	}
+	for _, segment := range seqMsg.segments {
+		if len(segment) == 0 {
+			decoded.Segments = append(decoded.Segments, DecodedSegment{Empty: true})
+			continue
+		}
+		kind, payload := segment[0], segment[1:]
+		decodedSegment := DecodedSegment{
+			Kind:          kind,
+			PayloadLength: len(payload),
+		}
+		if kind == BatchSegmentKindL2MessageBrotli {
+			decodedSegment.CompressedLength = len(payload)
+			decompressed, err := arbcompress.Decompress(payload, arbos.MaxL2MessageSize)
+			if err != nil {
+				decodedSegment.PayloadLength = 0
+				decodedSegment.DecompressionFailed = true
+			} else {
+				decodedSegment.PayloadLength = len(decompressed)
+			}
+		}
+		decoded.Segments = append(decoded.Segments, decodedSegment)
+	}
+	return decoded, nil
+}
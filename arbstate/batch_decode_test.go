@@ -0,0 +1,448 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/metrics"
+
+	"github.com/offchainlabs/nitro/zeroheavy"
+)
+
+func TestCountSegmentKinds(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{1})
+	builder.AddL2Message([]byte{2})
+	Require(t, builder.AddL2MessageBrotli([]byte{3}))
+	builder.AddDelayedMessages(3)
+	Require(t, builder.AdvanceTimestamp(1))
+	Require(t, builder.AdvanceL1BlockNumber(1))
+	builder.segments = append(builder.segments, []byte{}, []byte{0x7f, 1})
+	batch, err := builder.Build(0, 0, 0, 0, 3)
+	Require(t, err)
+
+	counts, err := CountSegmentKinds(batch)
+	Require(t, err)
+	expected := map[uint8]int{
+		BatchSegmentKindL2Message:            2,
+		BatchSegmentKindL2MessageBrotli:      1,
+		BatchSegmentKindDelayedMessages:      3,
+		BatchSegmentKindAdvanceTimestamp:     1,
+		BatchSegmentKindAdvanceL1BlockNumber: 1,
+		0x7f:                                 1,
+	}
+	if len(counts.Kinds) != len(expected) {
+		Fail(t, "unexpected kinds", counts.Kinds)
+	}
+	for kind, count := range expected {
+		if counts.Kinds[kind] != count {
+			Fail(t, "kind", kind, "counted", counts.Kinds[kind], "times, expected", count)
+		}
+	}
+	if counts.Empty != 1 || counts.Unknown != 1 {
+		Fail(t, "counted", counts.Empty, "empty and", counts.Unknown, "unknown segments")
+	}
+
+	if _, err := CountSegmentKinds(batch[:20]); err == nil {
+		Fail(t, "counted segments of a batch without a header")
+	}
+}
+
+func TestDecodeSegments(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte("plain"))
+	Require(t, builder.AddL2MessageBrotli([]byte("compressed")))
+	builder.AddDelayedMessages(1)
+	Require(t, builder.AdvanceL1BlockNumber(2))
+	batch, err := builder.Build(0, 10, 0, 10, 1)
+	Require(t, err)
+	segments, err := DecodeSegments(batch)
+	Require(t, err)
+	expectedKinds := []uint8{
+		BatchSegmentKindL2Message,
+		BatchSegmentKindL2MessageBrotli,
+		BatchSegmentKindDelayedMessages,
+		BatchSegmentKindAdvanceL1BlockNumber,
+	}
+	if len(segments) != len(expectedKinds) {
+		Fail(t, "decoded", len(segments), "segments instead of", len(expectedKinds))
+	}
+	for i, kind := range expectedKinds {
+		if segments[i][0] != kind || !bytes.Equal(segments[i], builder.segments[i]) {
+			Fail(t, "segment", i, "was", segments[i])
+		}
+	}
+
+	if _, err := DecodeSegments(batch[:39]); !errors.Is(err, ErrSequencerMessageMissingL1Header) {
+		Fail(t, "expected a missing header error but got", err)
+	}
+}
+
+func TestDecodeBatch(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{1})
+	Require(t, builder.AdvanceTimestamp(5))
+	builder.AddDelayedMessages(1)
+	builder.segments = append(builder.segments, []byte{BatchSegmentKindL2MessageBrotli, 0xff})
+	builder.AddL2Message([]byte{2})
+	batch, err := builder.Build(0, 3, 0, 0, 4)
+	Require(t, err)
+	var delayed [][]byte
+	for i := uint64(0); i < 4; i++ {
+		delayed = append(delayed, encodeTestDelayedMessage(t, i))
+	}
+	readDelayed := func(seqNum uint64) ([]byte, error) {
+		if seqNum >= uint64(len(delayed)) {
+			return nil, errors.New("delayed message not found")
+		}
+		return delayed[seqNum], nil
+	}
+
+	decoded, err := DecodeBatch(batch, 1, readDelayed)
+	Require(t, err)
+
+	backend := NewMemoryInboxBackend([][]byte{batch}, delayed)
+	multiplexer := NewInboxMultiplexer(backend, 1, nil, KeysetValidate)
+	var popped []*MessageWithMetadata
+	for backend.GetSequencerInboxPosition() == 0 {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		popped = append(popped, msg)
+	}
+	if len(decoded) != len(popped) {
+		Fail(t, "decoded", len(decoded), "messages but popped", len(popped))
+	}
+	for i, msg := range popped {
+		got, want := decoded[i].Message, msg.Message
+		if decoded[i].DelayedMessagesRead != msg.DelayedMessagesRead ||
+			got.Header.Kind != want.Header.Kind ||
+			got.Header.Timestamp != want.Header.Timestamp ||
+			!bytes.Equal(got.L2msg, want.L2msg) {
+			Fail(t, "decoded message", i, "differs from the popped one")
+		}
+	}
+	if decoded[len(decoded)-1].DelayedMessagesRead != 4 {
+		Fail(t, "batch didn't read up to its afterDelayedMessages")
+	}
+
+	if _, err := DecodeBatch(batch, 1, nil); err == nil {
+		Fail(t, "expected an error decoding delayed messages without a reader")
+	}
+}
+
+func TestDecodeJSONRoundTrip(t *testing.T) {
+	l2Message := bytes.Repeat([]byte{7}, 1000)
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{1, 2, 3})
+	Require(t, builder.AddL2MessageBrotli(l2Message))
+	builder.AddDelayedMessages(1)
+	Require(t, builder.AdvanceTimestamp(3))
+	builder.segments = append(builder.segments, []byte{}, []byte{BatchSegmentKindL2MessageBrotli, 0xff})
+	batch, err := builder.Build(1, 2, 3, 4, 5)
+	Require(t, err)
+
+	decoded, err := Decode(batch)
+	Require(t, err)
+	compressedLength := len(builder.segments[1]) - 1
+	expected := &DecodedBatch{
+		MinTimestamp:         1,
+		MaxTimestamp:         2,
+		MinL1Block:           3,
+		MaxL1Block:           4,
+		AfterDelayedMessages: 5,
+		Segments: []DecodedSegment{
+			{Kind: BatchSegmentKindL2Message, PayloadLength: 3},
+			{Kind: BatchSegmentKindL2MessageBrotli, PayloadLength: len(l2Message), CompressedLength: compressedLength},
+			{Kind: BatchSegmentKindDelayedMessages},
+			{Kind: BatchSegmentKindAdvanceTimestamp, PayloadLength: 1},
+			{Empty: true},
+			{Kind: BatchSegmentKindL2MessageBrotli, CompressedLength: 1, DecompressionFailed: true},
+		},
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		Fail(t, "decoded", decoded, "expected", expected)
+	}
+
+	encoded, err := json.Marshal(decoded)
+	Require(t, err)
+	var roundTripped DecodedBatch
+	Require(t, json.Unmarshal(encoded, &roundTripped))
+	if !reflect.DeepEqual(&roundTripped, expected) {
+		Fail(t, "JSON round trip produced", roundTripped)
+	}
+}
+
+func TestDecodedBatchClone(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{1})
+	batch, err := builder.Build(0, 0, 0, 0, 0)
+	Require(t, err)
+	decoded, err := Decode(batch)
+	Require(t, err)
+	clone := decoded.Clone()
+	clone.Segments[0].PayloadLength = 100
+	if decoded.Segments[0].PayloadLength != 1 {
+		Fail(t, "modifying the clone changed the original")
+	}
+}
+
+func TestCountMessages(t *testing.T) {
+	readDelayed := func(seqNum uint64) ([]byte, error) {
+		return encodeTestDelayedMessage(t, seqNum), nil
+	}
+	testCases := []struct {
+		name         string
+		batch        []byte
+		startDelayed uint64
+	}{
+		{"mixed", encodeTestBatch(t, 0, 0, 0, 0, 3,
+			[]byte{BatchSegmentKindL2Message, 1},
+			[]byte{BatchSegmentKindDelayedMessages},
+			[]byte{},
+			[]byte{BatchSegmentKindAdvanceTimestamp, 1},
+			[]byte{BatchSegmentKindL2MessageBrotli, 0xff},
+			[]byte{0x7f},
+		), 1},
+		{"delayed overrun", encodeTestBatch(t, 0, 0, 0, 0, 1,
+			[]byte{BatchSegmentKindDelayedMessages},
+			[]byte{BatchSegmentKindDelayedMessages},
+			[]byte{BatchSegmentKindL2Message, 1},
+		), 0},
+		{"only virtual delayed", encodeTestBatch(t, 0, 0, 0, 0, 4), 2},
+		{"no messages", encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindAdvanceL1BlockNumber, 1}), 0},
+		{"missing header", make([]byte, 20), 0},
+		{"trailing unknown kind", encodeTestBatch(t, 0, 0, 0, 0, 1,
+			[]byte{BatchSegmentKindL2Message, 1},
+			[]byte{BatchSegmentKindDelayedMessages},
+			[]byte{0x7f},
+		), 0},
+	}
+	for _, tc := range testCases {
+		l2, delayed, err := CountMessages(tc.batch, tc.startDelayed)
+		Require(t, err)
+		msgs, err := DecodeBatch(tc.batch, tc.startDelayed, readDelayed)
+		Require(t, err)
+		expectedL2, expectedDelayed := 0, 0
+		delayedMessagesRead := tc.startDelayed
+		for _, msg := range msgs {
+			if msg.DelayedMessagesRead > delayedMessagesRead {
+				expectedDelayed++
+			} else {
+				expectedL2++
+			}
+			delayedMessagesRead = msg.DelayedMessagesRead
+		}
+		if l2 != expectedL2 || delayed != expectedDelayed {
+			Fail(t, tc.name, "counted", l2, "L2 and", delayed, "delayed messages but decoded", expectedL2, "and", expectedDelayed)
+		}
+	}
+}
+
+func TestRequiresDelayedReads(t *testing.T) {
+	testCases := []struct {
+		name         string
+		batch        []byte
+		startDelayed uint64
+		expected     bool
+	}{
+		{"self-contained", encodeTestBatch(t, 0, 0, 0, 0, 2,
+			[]byte{BatchSegmentKindL2Message, 1},
+			[]byte{BatchSegmentKindAdvanceTimestamp, 1},
+		), 2, false},
+		{"delayed segment", encodeTestBatch(t, 0, 0, 0, 0, 2,
+			[]byte{BatchSegmentKindL2Message, 1},
+			[]byte{BatchSegmentKindDelayedMessages},
+		), 2, true},
+		{"virtual delayed", encodeTestBatch(t, 0, 0, 0, 0, 3, []byte{BatchSegmentKindL2Message, 1}), 2, true},
+		{"missing header", make([]byte, 20), 0, false},
+	}
+	for _, tc := range testCases {
+		requires, err := RequiresDelayedReads(tc.batch, tc.startDelayed)
+		Require(t, err)
+		if requires != tc.expected {
+			Fail(t, tc.name, "expected", tc.expected, "but got", requires)
+		}
+		if !requires {
+			// decoding without a delayed reader must succeed
+			_, err := DecodeBatch(tc.batch, tc.startDelayed, nil)
+			Require(t, err, tc.name)
+		}
+	}
+}
+
+func TestDelayedMessageIndices(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 7,
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindL2Message, 1},
+		[]byte{BatchSegmentKindDelayedMessages},
+	)
+	testCases := []struct {
+		startDelayed uint64
+		expected     []uint64
+	}{
+		{5, []uint64{5, 6}},
+		// the remaining delayed messages are read after the last segment
+		{3, []uint64{3, 4, 5, 6}},
+		// both delayed segments are past afterDelayedMessages
+		{7, []uint64{}},
+	}
+	for _, tc := range testCases {
+		indices, err := DelayedMessageIndices(batch, tc.startDelayed)
+		Require(t, err)
+		if !reflect.DeepEqual(indices, tc.expected) {
+			Fail(t, "starting at", tc.startDelayed, "got indices", indices, "instead of", tc.expected)
+		}
+	}
+}
+
+func TestHeaderVersion(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{1})
+	batch, err := builder.Build(0, 0, 0, 0, 0)
+	Require(t, err)
+	for _, data := range [][]byte{batch, batch[:40]} {
+		version, err := HeaderVersion(data)
+		Require(t, err)
+		if version != 0 {
+			Fail(t, "current batch reported header version", version)
+		}
+	}
+	if _, err := HeaderVersion(batch[:39]); !errors.Is(err, ErrSequencerMessageMissingL1Header) {
+		Fail(t, "expected a missing header error, got", err)
+	}
+
+	// an extended header followed by what would otherwise parse as a brotli batch
+	extended := append(append(append([]byte{}, batch[:40]...), BrotliMessageHeaderByte|HeaderExtensionFlag, 1), batch[41:]...)
+	version, err := HeaderVersion(extended)
+	Require(t, err)
+	if version != 1 {
+		Fail(t, "extended header reported version", version)
+	}
+	if _, err := HeaderVersion(extended[:41]); err == nil {
+		Fail(t, "extended header without a version byte wasn't rejected")
+	}
+	parsed, err := parseSequencerMessage(context.Background(), 0, extended, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if len(parsed.segments) != 0 {
+		Fail(t, "unsupported header version was parsed into", len(parsed.segments), "segments")
+	}
+	config := DefaultInboxMultiplexerConfig
+	config.Strict = true
+	if _, err := parseSequencerMessage(context.Background(), 0, extended, nil, KeysetValidate, &config); !errors.Is(err, ErrInvalidSequencerMessage) {
+		Fail(t, "unsupported header version wasn't rejected in strict mode, err", err)
+	}
+	if RegisterDecompressor(HeaderExtensionFlag|0x01, xorDecompressor{}) == nil {
+		Fail(t, "registered a tag conflicting with the header extension flag")
+	}
+}
+
+func TestHeaderExtensionFlagWithExistingFlags(t *testing.T) {
+	original := batchUnsupportedVersionCounter
+	batchUnsupportedVersionCounter = metrics.NewCounterForced()
+	defer func() { batchUnsupportedVersionCounter = original }()
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{1})
+	batch, err := builder.Build(0, 0, 0, 0, 0)
+	Require(t, err)
+
+	// the zeroheavy flag still applies, so this decodes to the brotli batch
+	encoded, err := io.ReadAll(zeroheavy.NewZeroheavyEncoder(bytes.NewReader(batch[40:])))
+	Require(t, err)
+	zeroheavyBatch := append(append(append([]byte{}, batch[:40]...), ZeroheavyMessageHeaderFlag|HeaderExtensionFlag), encoded...)
+	parsed, err := parseSequencerMessage(context.Background(), 0, zeroheavyBatch, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if len(parsed.segments) != 1 {
+		Fail(t, "zeroheavy batch with the extension flag parsed into", len(parsed.segments), "segments")
+	}
+
+	// the DAS flag still applies, so this is rejected for the missing DAS reader rather than its header version
+	dasBatch := append(append([]byte{}, batch[:40]...), DASMessageHeaderFlag|HeaderExtensionFlag, 1)
+	_, err = parseSequencerMessage(context.Background(), 0, dasBatch, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	config := DefaultInboxMultiplexerConfig
+	config.Strict = true
+	if _, err := parseSequencerMessage(context.Background(), 0, dasBatch, nil, KeysetValidate, &config); !errors.Is(err, ErrInvalidSequencerMessage) {
+		Fail(t, "DAS batch without a DAS reader wasn't rejected in strict mode, err", err)
+	}
+
+	for _, data := range [][]byte{zeroheavyBatch, dasBatch} {
+		version, err := HeaderVersion(data)
+		Require(t, err)
+		if version != 0 {
+			Fail(t, "header byte", data[40], "reported header version", version)
+		}
+	}
+	if batchUnsupportedVersionCounter.Count() != 0 {
+		Fail(t, "counted", batchUnsupportedVersionCounter.Count(), "unsupported header versions")
+	}
+}
+
+func TestHeaderDelayedCount(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 7,
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindL2Message, 1},
+	)
+	for _, startDelayed := range []uint64{0, 3, 6, 7, 9} {
+		count, err := HeaderDelayedCount(batch, startDelayed)
+		Require(t, err)
+		indices, err := DelayedMessageIndices(batch, startDelayed)
+		Require(t, err)
+		if count != uint64(len(indices)) {
+			Fail(t, "starting at", startDelayed, "the header gives", count, "delayed messages but the batch reads", len(indices))
+		}
+	}
+	if _, err := HeaderDelayedCount(batch[:39], 0); !errors.Is(err, ErrSequencerMessageMissingL1Header) {
+		Fail(t, "expected a missing header error, got", err)
+	}
+}
+
+func TestBatchSpan(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{1})
+	batch, err := builder.Build(100, 160, 20, 25, 0)
+	Require(t, err)
+	minTs, maxTs, minBlock, maxBlock, err := BatchSpan(batch)
+	Require(t, err)
+	if minTs != 100 || maxTs != 160 || minBlock != 20 || maxBlock != 25 {
+		Fail(t, "unexpected span", minTs, maxTs, minBlock, maxBlock)
+	}
+	decoded, err := Decode(batch)
+	Require(t, err)
+	if decoded.TimestampRange() != 60 || decoded.BlockRange() != 5 {
+		Fail(t, "unexpected ranges", decoded.TimestampRange(), decoded.BlockRange())
+	}
+
+	inverted, err := builder.Build(160, 100, 25, 20, 0)
+	Require(t, err)
+	decoded, err = Decode(inverted)
+	Require(t, err)
+	if decoded.TimestampRange() != 0 || decoded.BlockRange() != 0 {
+		Fail(t, "inverted ranges were", decoded.TimestampRange(), decoded.BlockRange())
+	}
+	if _, _, _, _, err := BatchSpan(batch[:39]); !errors.Is(err, ErrSequencerMessageMissingL1Header) {
+		Fail(t, "expected a missing header error but got", err)
+	}
+}
+
+func TestAfterDelayedMessages(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddDelayedMessages(2)
+	batch, err := builder.Build(0, 0, 0, 0, 7)
+	Require(t, err)
+	afterDelayedMessages, err := AfterDelayedMessages(batch)
+	Require(t, err)
+	if afterDelayedMessages != 7 {
+		Fail(t, "unexpected afterDelayedMessages", afterDelayedMessages)
+	}
+	if _, err := AfterDelayedMessages(batch[:39]); !errors.Is(err, ErrSequencerMessageMissingL1Header) {
+		Fail(t, "expected a missing header error but got", err)
+	}
+}
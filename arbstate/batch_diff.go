@@ -0,0 +1,161 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"bytes"
+
+	"github.com/offchainlabs/nitro/arbcompress"
+	"github.com/offchainlabs/nitro/arbos"
+)
+
+// A header field whose value differs between the two batches
+type BatchFieldDiff struct {
+	Field string `json:"field"`
+	A     uint64 `json:"a"`
+	B     uint64 `json:"b"`
+}
+
+// A segment as compared by DiffBatches
+type DiffedSegment struct {
+	Kind uint8 `json:"kind"`
+	// Set for zero-length segments, which have no kind
+	Empty bool `json:"empty,omitempty"`
+	// The payload after the kind byte, decompressed for compressed L2 messages that decompress
+	Payload []byte `json:"payload"`
+	// Set if a compressed L2 message failed to decompress, leaving Payload compressed
+	DecompressionFailed bool `json:"decompressionFailed,omitempty"`
+}
+
+// A segment only in the first batch, only in the second, or changed between them.
+// The index and segment of the batch missing it are -1 and nil.
+type SegmentDiff struct {
+	IndexA int            `json:"indexA"`
+	IndexB int            `json:"indexB"`
+	A      *DiffedSegment `json:"a,omitempty"`
+	B      *DiffedSegment `json:"b,omitempty"`
+	// For changed segments of the same kind, the offset of the first payload byte that differs
+	FirstDifference int `json:"firstDifference"`
+}
+
+func (d *SegmentDiff) Added() bool {
+	return d.A == nil
+}
+
+func (d *SegmentDiff) Removed() bool {
+	return d.B == nil
+}
+
+type BatchDiff struct {
+	Header   []BatchFieldDiff `json:"header"`
+	Segments []SegmentDiff    `json:"segments"`
+}
+
+// Reports whether the batches have the same header and segments
+func (d *BatchDiff) Empty() bool {
+	return len(d.Header) == 0 && len(d.Segments) == 0
+}
+
+// Compares the headers and segments of two batches, to find why nodes disagree on a batch.
+// Compressed L2 messages are compared decompressed, so batches compressing the same messages differently don't differ.
+// The segments the batches start and end with in common are skipped, and those between are compared pairwise,
+// with the longer batch's excess reported as added or removed. So a segment inserted or removed in the middle is found,
+// but several edits at different places are reported as changes to every segment between them.
+func DiffBatches(a, b []byte) (*BatchDiff, error) {
+	seqMsgA, err := parseSequencerMessageForInspection(a)
+	if err != nil {
+		return nil, err
+	}
+	seqMsgB, err := parseSequencerMessageForInspection(b)
+	if err != nil {
+		return nil, err
+	}
+	diff := &BatchDiff{}
+	fields := []struct {
+		name string
+		a, b uint64
+	}{
+		{"minTimestamp", seqMsgA.minTimestamp, seqMsgB.minTimestamp},
+		{"maxTimestamp", seqMsgA.maxTimestamp, seqMsgB.maxTimestamp},
+		{"minL1Block", seqMsgA.minL1Block, seqMsgB.minL1Block},
+		{"maxL1Block", seqMsgA.maxL1Block, seqMsgB.maxL1Block},
+		{"afterDelayedMessages", seqMsgA.afterDelayedMessages, seqMsgB.afterDelayedMessages},
+	}
+	for _, field := range fields {
+		if field.a != field.b {
+			diff.Header = append(diff.Header, BatchFieldDiff{Field: field.name, A: field.a, B: field.b})
+		}
+	}
+
+	segmentsA := diffedSegments(seqMsgA.segments)
+	segmentsB := diffedSegments(seqMsgB.segments)
+	start := 0
+	for start < len(segmentsA) && start < len(segmentsB) && segmentsA[start].equals(segmentsB[start]) {
+		start++
+	}
+	endA, endB := len(segmentsA), len(segmentsB)
+	for endA > start && endB > start && segmentsA[endA-1].equals(segmentsB[endB-1]) {
+		endA--
+		endB--
+	}
+	for i := 0; start+i < endA || start+i < endB; i++ {
+		segmentDiff := SegmentDiff{IndexA: -1, IndexB: -1}
+		if start+i < endA {
+			segmentDiff.IndexA = start + i
+			segmentDiff.A = segmentsA[start+i]
+		}
+		if start+i < endB {
+			segmentDiff.IndexB = start + i
+			segmentDiff.B = segmentsB[start+i]
+		}
+		if segmentDiff.A != nil && segmentDiff.B != nil && segmentDiff.A.Kind == segmentDiff.B.Kind {
+			segmentDiff.FirstDifference = firstDifference(segmentDiff.A.Payload, segmentDiff.B.Payload)
+		}
+		diff.Segments = append(diff.Segments, segmentDiff)
+	}
+	return diff, nil
+}
+
+func diffedSegments(segments [][]byte) []*DiffedSegment {
+	diffed := make([]*DiffedSegment, 0, len(segments))
+	for _, segment := range segments {
+		if len(segment) == 0 {
+			diffed = append(diffed, &DiffedSegment{Empty: true})
+			continue
+		}
+		kind, payload := segment[0], segment[1:]
+		diffedSegment := &DiffedSegment{Kind: kind, Payload: payload}
+		var decompressed []byte
+		var err error
+		switch kind {
+		case BatchSegmentKindL2MessageBrotli:
+			decompressed, err = arbcompress.Decompress(payload, arbos.MaxL2MessageSize)
+		case BatchSegmentKindL2MessageZstd:
+			decompressed, err = decompressZstd(payload, arbos.MaxL2MessageSize)
+		default:
+			decompressed = payload
+		}
+		if err != nil {
+			diffedSegment.DecompressionFailed = true
+		} else {
+			diffedSegment.Payload = decompressed
+		}
+		diffed = append(diffed, diffedSegment)
+	}
+	return diffed
+}
+
+func (s *DiffedSegment) equals(other *DiffedSegment) bool {
+	return s.Kind == other.Kind && s.Empty == other.Empty && s.DecompressionFailed == other.DecompressionFailed &&
+		bytes.Equal(s.Payload, other.Payload)
+}
+
+// Returns the offset of the first byte at which a and b differ, which is the shorter's length if one is a prefix of the other
+func firstDifference(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,64 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffBatches(t *testing.T) {
+	build := func(maxTimestamp uint64, brotliMessage []byte, extra bool) []byte {
+		builder := NewBatchBuilder()
+		builder.AddL2Message([]byte{1})
+		Require(t, builder.AddL2MessageBrotli(brotliMessage))
+		if extra {
+			builder.AddL2Message([]byte{2})
+		}
+		builder.AddDelayedMessages(1)
+		batch, err := builder.Build(0, maxTimestamp, 0, 10, 1)
+		Require(t, err)
+		return batch
+	}
+	original := build(10, []byte("compressed message"), false)
+
+	diff, err := DiffBatches(original, build(10, []byte("compressed message"), false))
+	Require(t, err)
+	if !diff.Empty() {
+		Fail(t, "identical batches differ", diff)
+	}
+
+	diff, err = DiffBatches(original, build(20, []byte("compressed massage"), false))
+	Require(t, err)
+	if !reflect.DeepEqual(diff.Header, []BatchFieldDiff{{Field: "maxTimestamp", A: 10, B: 20}}) {
+		Fail(t, "unexpected header diff", diff.Header)
+	}
+	if len(diff.Segments) != 1 {
+		Fail(t, "expected one changed segment, got", diff.Segments)
+	}
+	changed := diff.Segments[0]
+	if changed.IndexA != 1 || changed.IndexB != 1 || changed.Added() || changed.Removed() {
+		Fail(t, "diff didn't pinpoint the changed segment", changed)
+	}
+	if changed.A.Kind != BatchSegmentKindL2MessageBrotli || string(changed.A.Payload) != "compressed message" ||
+		string(changed.B.Payload) != "compressed massage" || changed.FirstDifference != 12 {
+		Fail(t, "changed segment wasn't compared decompressed", changed)
+	}
+
+	diff, err = DiffBatches(original, build(10, []byte("compressed message"), true))
+	Require(t, err)
+	if len(diff.Header) != 0 || len(diff.Segments) != 1 {
+		Fail(t, "expected one added segment, got", diff)
+	}
+	added := diff.Segments[0]
+	if !added.Added() || added.IndexA != -1 || added.IndexB != 2 || added.B.Kind != BatchSegmentKindL2Message {
+		Fail(t, "diff didn't pinpoint the added segment", added)
+	}
+
+	diff, err = DiffBatches(build(10, []byte("compressed message"), true), original)
+	Require(t, err)
+	if len(diff.Segments) != 1 || !diff.Segments[0].Removed() || diff.Segments[0].IndexA != 2 {
+		Fail(t, "diff didn't pinpoint the removed segment", diff.Segments)
+	}
+}
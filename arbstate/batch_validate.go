@@ -0,0 +1,103 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/offchainlabs/nitro/arbcompress"
+)
+
+// Problems ValidateBatch found in a batch, which a multiplexer would turn into invalid messages or ignore
+type BatchValidationReport struct {
+	// Number of segments the batch decodes to
+	Segments int
+	// Indices of segments whose kind a multiplexer with the default config doesn't recognize
+	UnknownKindSegments []int
+	// Indices of zero-length segments
+	EmptySegments []int
+	// Indices of brotli L2 messages that fail to decompress and advance segments that fail to parse.
+	// Advance segments with trailing bytes are included, though the multiplexer still applies them by default.
+	MalformedSegments []int
+	// Indices of brotli L2 messages whose decompressed payload is itself brotli, wasting space and CPU.
+	// This is detected by decompressing the payload again, so is only advisory, and doesn't make the report unclean.
+	DoubleCompressedSegments []int
+	// Set if the minimum of the range is above its maximum
+	InvertedTimestampRange bool
+	InvertedL1BlockRange   bool
+	// Number of delayed messages segments past afterDelayedMessages, which produce invalid messages
+	// however many delayed messages were read before the batch
+	ExcessDelayedSegments int
+	// Size of the decompressed segment stream, and the limit past which a multiplexer ignores the rest of it
+	DecompressedSize   int64
+	MaxDecompressedLen int64
+}
+
+// Reports whether the batch decodes to exactly the messages its segments describe
+func (r *BatchValidationReport) Clean() bool {
+	return len(r.UnknownKindSegments) == 0 && len(r.EmptySegments) == 0 && len(r.MalformedSegments) == 0 &&
+		!r.InvertedTimestampRange && !r.InvertedL1BlockRange && r.ExcessDelayedSegments == 0 &&
+		r.DecompressedSize < r.MaxDecompressedLen
+}
+
+// Checks a batch before posting it, using the parser the multiplexer uses with the default config.
+// Batches the parser rejects in Strict mode, such as ones of unknown format or with a segment that isn't valid RLP,
+// return an ErrInvalidSequencerMessage error. DAS batches can't be validated, so validate the data before storing it.
+func ValidateBatch(data []byte) (*BatchValidationReport, error) {
+	config := DefaultInboxMultiplexerConfig
+	config.Strict = true
+	seqMsg, err := parseSequencerMessage(context.Background(), 0, data, nil, KeysetValidate, &config)
+	if err != nil {
+		return nil, err
+	}
+	report := &BatchValidationReport{
+		Segments:               len(seqMsg.segments),
+		InvertedTimestampRange: seqMsg.minTimestamp > seqMsg.maxTimestamp,
+		InvertedL1BlockRange:   seqMsg.minL1Block > seqMsg.maxL1Block,
+		MaxDecompressedLen:     config.MaxDecompressedLen,
+	}
+	var delayedSegments uint64
+	for i, segment := range seqMsg.segments {
+		encoded, err := rlp.EncodeToBytes(segment)
+		if err != nil {
+			return nil, err
+		}
+		report.DecompressedSize += int64(len(encoded))
+		if len(segment) == 0 {
+			report.EmptySegments = append(report.EmptySegments, i)
+			continue
+		}
+		kind, payload := segment[0], segment[1:]
+		switch kind {
+		case BatchSegmentKindL2Message:
+		case BatchSegmentKindL2MessageBrotli:
+			decompressed, err := arbcompress.Decompress(payload, int(config.MaxL2MessageSize))
+			if err != nil {
+				report.MalformedSegments = append(report.MalformedSegments, i)
+				break
+			}
+			// some tiny inputs are valid empty brotli streams, so only count payloads decompressing to something
+			if nested, err := arbcompress.Decompress(decompressed, int(config.MaxL2MessageSize)); err == nil && len(nested) > 0 {
+				report.DoubleCompressedSegments = append(report.DoubleCompressedSegments, i)
+			}
+		case BatchSegmentKindDelayedMessages:
+			delayedSegments++
+		case BatchSegmentKindAdvanceTimestamp, BatchSegmentKindAdvanceL1BlockNumber:
+			var advancing uint64
+			if err := rlp.DecodeBytes(payload, &advancing); err != nil {
+				report.MalformedSegments = append(report.MalformedSegments, i)
+			}
+		default:
+			if !isKnownSegmentKind(kind) {
+				report.UnknownKindSegments = append(report.UnknownKindSegments, i)
+			}
+		}
+	}
+	if delayedSegments > seqMsg.afterDelayedMessages {
+		report.ExcessDelayedSegments = int(delayedSegments - seqMsg.afterDelayedMessages)
+	}
+	return report, nil
+}
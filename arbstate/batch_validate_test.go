@@ -0,0 +1,88 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/offchainlabs/nitro/arbcompress"
+)
+
+func TestValidateBatch(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{1})
+	Require(t, builder.AddL2MessageBrotli([]byte("compressed")))
+	Require(t, builder.AdvanceTimestamp(1))
+	builder.AddDelayedMessages(2)
+	clean, err := builder.Build(0, 10, 0, 10, 2)
+	Require(t, err)
+	report, err := ValidateBatch(clean)
+	Require(t, err)
+	if !report.Clean() || report.Segments != 5 || report.DecompressedSize == 0 {
+		Fail(t, "unexpected report for a clean batch", report)
+	}
+
+	inner, err := arbcompress.CompressWell([]byte("compressed twice"))
+	Require(t, err)
+	outer, err := arbcompress.CompressWell(inner)
+	Require(t, err)
+	doubleCompressed, err := ValidateBatch(encodeTestBatch(t, 0, 0, 0, 0, 0,
+		[]byte{BatchSegmentKindL2Message, 1},
+		append([]byte{BatchSegmentKindL2MessageBrotli}, outer...),
+	))
+	Require(t, err)
+	if !reflect.DeepEqual(doubleCompressed.DoubleCompressedSegments, []int{1}) || !doubleCompressed.Clean() {
+		Fail(t, "unexpected report for a double compressed segment", doubleCompressed)
+	}
+	if len(report.DoubleCompressedSegments) != 0 {
+		Fail(t, "flagged singly compressed segments", report.DoubleCompressedSegments)
+	}
+
+	testCases := []struct {
+		name     string
+		batch    []byte
+		expected func(report *BatchValidationReport) bool
+	}{
+		{"unknown kind", encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 1}, []byte{0x7f}),
+			func(report *BatchValidationReport) bool {
+				return reflect.DeepEqual(report.UnknownKindSegments, []int{1})
+			}},
+		{"zstd segment", encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2MessageZstd, 1}),
+			func(report *BatchValidationReport) bool {
+				// zstd segments are disabled by default, so CountSegmentKinds must also count them as unknown
+				counts, err := CountSegmentKinds(encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2MessageZstd, 1}))
+				Require(t, err)
+				return reflect.DeepEqual(report.UnknownKindSegments, []int{0}) && counts.Unknown == 1
+			}},
+		{"empty segment", encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{}, []byte{BatchSegmentKindL2Message, 1}),
+			func(report *BatchValidationReport) bool { return reflect.DeepEqual(report.EmptySegments, []int{0}) }},
+		{"corrupt brotli", encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2MessageBrotli, 0xde, 0xad}),
+			func(report *BatchValidationReport) bool { return reflect.DeepEqual(report.MalformedSegments, []int{0}) }},
+		{"trailing advance bytes", encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindAdvanceTimestamp, 1, 0}),
+			func(report *BatchValidationReport) bool { return reflect.DeepEqual(report.MalformedSegments, []int{0}) }},
+		{"inverted timestamps", encodeTestBatch(t, 5, 4, 0, 0, 0, []byte{BatchSegmentKindL2Message, 1}),
+			func(report *BatchValidationReport) bool {
+				return report.InvertedTimestampRange && !report.InvertedL1BlockRange
+			}},
+		{"inverted blocks", encodeTestBatch(t, 0, 0, 5, 4, 0, []byte{BatchSegmentKindL2Message, 1}),
+			func(report *BatchValidationReport) bool {
+				return report.InvertedL1BlockRange && !report.InvertedTimestampRange
+			}},
+		{"excess delayed", encodeTestBatch(t, 0, 0, 0, 0, 1, []byte{BatchSegmentKindDelayedMessages}, []byte{BatchSegmentKindDelayedMessages}),
+			func(report *BatchValidationReport) bool { return report.ExcessDelayedSegments == 1 }},
+	}
+	for _, tc := range testCases {
+		report, err := ValidateBatch(tc.batch)
+		Require(t, err, tc.name)
+		if report.Clean() || !tc.expected(report) {
+			Fail(t, tc.name, "unexpected report", report)
+		}
+	}
+
+	if _, err := ValidateBatch(append(clean[:40:40], 0x11)); !errors.Is(err, ErrInvalidSequencerMessage) {
+		Fail(t, "batch of unknown format wasn't rejected, err", err)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/offchainlabs/nitro/util/arbmath"
+)
+
+const multiplexerCursorVersion uint8 = 0
+
+type marshalledCursor struct {
+	Version uint8
+	// Whether a sequencer message was cached, in which case the segment fields are meaningful
+	Cached                bool
+	PositionWithinMessage uint64
+	SequencerMessageNum   uint64
+	SegmentNum            uint64
+	SubMessageNumber      uint64
+	SegmentTimestamp      uint64
+	SegmentBlockNumber    uint64
+	DelayedMessagesRead   uint64
+}
+
+// Serializes the multiplexer's position, including the backend's position within the current sequencer message,
+// so NewInboxMultiplexerFromCursor can resume at the same message.
+func (r *inboxMultiplexer) MarshalCursor() ([]byte, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return rlp.EncodeToBytes(marshalledCursor{
+		Version:               multiplexerCursorVersion,
+		Cached:                r.cachedSequencerMessage != nil,
+		PositionWithinMessage: r.backend.GetPositionWithinMessage(),
+		SequencerMessageNum:   r.cachedSequencerMessageNum,
+		SegmentNum:            r.cachedSegmentNum,
+		SubMessageNumber:      r.cachedSubMessageNumber,
+		SegmentTimestamp:      r.cachedSegmentTimestamp,
+		SegmentBlockNumber:    r.cachedSegmentBlockNumber,
+		DelayedMessagesRead:   r.delayedMessagesRead,
+	})
+}
+
+// Restores a multiplexer from MarshalCursor's output.
+// The backend must already be at the sequencer message the cursor was taken in, which is read again and cached.
+func NewInboxMultiplexerFromCursor(
+	ctx context.Context,
+	backend InboxBackend,
+	cursor []byte,
+	dasReader DataAvailabilityReader,
+	keysetValidationMode KeysetValidationMode,
+	config *InboxMultiplexerConfig,
+) (InboxMultiplexer, error) {
+	var decoded marshalledCursor
+	if err := rlp.DecodeBytes(cursor, &decoded); err != nil {
+		return nil, fmt.Errorf("failed to decode multiplexer cursor: %w", err)
+	}
+	if decoded.Version != multiplexerCursorVersion {
+		return nil, fmt.Errorf("unsupported multiplexer cursor version %v", decoded.Version)
+	}
+	r := NewInboxMultiplexerWithConfig(backend, decoded.DelayedMessagesRead, dasReader, keysetValidationMode, config).(*inboxMultiplexer)
+	backend.SetPositionWithinMessage(decoded.PositionWithinMessage)
+	if !decoded.Cached {
+		return r, nil
+	}
+	if backend.GetSequencerInboxPosition() != decoded.SequencerMessageNum {
+		return nil, fmt.Errorf(
+			"multiplexer cursor is in sequencer message %v but the backend is at %v",
+			decoded.SequencerMessageNum, backend.GetSequencerInboxPosition(),
+		)
+	}
+	skipped, err := r.cacheSequencerMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if skipped != nil {
+		return nil, fmt.Errorf("multiplexer cursor is in sequencer message %v, which has no L1 header", decoded.SequencerMessageNum)
+	}
+	if decoded.SegmentNum > uint64(len(r.cachedSequencerMessage.segments)) {
+		return nil, fmt.Errorf(
+			"multiplexer cursor is at segment %v but sequencer message %v has %v segments",
+			decoded.SegmentNum, decoded.SequencerMessageNum, len(r.cachedSequencerMessage.segments),
+		)
+	}
+	r.cachedSegmentNum = decoded.SegmentNum
+	r.cachedSubMessageNumber = decoded.SubMessageNumber
+	r.cachedSegmentTimestamp = decoded.SegmentTimestamp
+	r.cachedSegmentBlockNumber = decoded.SegmentBlockNumber
+	// assumes every delayed messages segment before the cursor read a delayed message, as they do in well-formed batches
+	delayedBefore := delayedMessagesReadBefore(r.cachedSequencerMessage, decoded.PositionWithinMessage, 0)
+	r.cachedStartDelayedRead = decoded.DelayedMessagesRead - arbmath.MinUint(delayedBefore, decoded.DelayedMessagesRead)
+	return r, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{1})
+	Require(t, builder.AdvanceTimestamp(5))
+	builder.AddDelayedMessages(1)
+	Require(t, builder.AdvanceL1BlockNumber(3))
+	builder.AddL2Message([]byte{2})
+	first, err := builder.Build(0, 100, 0, 100, 2)
+	Require(t, err)
+	builder = NewBatchBuilder()
+	builder.AddL2Message([]byte{3})
+	second, err := builder.Build(0, 100, 0, 100, 2)
+	Require(t, err)
+	batches := [][]byte{first, second}
+	delayed := [][]byte{encodeTestDelayedMessage(t, 0), encodeTestDelayedMessage(t, 1)}
+	const totalMessages = 5
+
+	popRest := func(multiplexer InboxMultiplexer, count int) []*MessageWithMetadata {
+		var msgs []*MessageWithMetadata
+		for i := 0; i < count; i++ {
+			msg, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+			msgs = append(msgs, msg)
+		}
+		return msgs
+	}
+
+	for popped := 0; popped <= totalMessages; popped++ {
+		backend := NewMemoryInboxBackend(batches, delayed)
+		multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+		popRest(multiplexer, popped)
+		cursor, err := multiplexer.MarshalCursor()
+		Require(t, err)
+		batchPosition := backend.GetSequencerInboxPosition()
+		expected := popRest(multiplexer, totalMessages-popped)
+
+		// a restarted node's backend resumes at the same batch, but knows nothing of the position within it
+		restoredBackend := NewMemoryInboxBackend(batches, delayed)
+		restoredBackend.batchPosition = batchPosition
+		restored, err := NewInboxMultiplexerFromCursor(context.Background(), restoredBackend, cursor, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+		Require(t, err)
+		msgs := popRest(restored, totalMessages-popped)
+		for i := range expected {
+			got, want := msgs[i], expected[i]
+			if got.DelayedMessagesRead != want.DelayedMessagesRead ||
+				got.Message.Header.Kind != want.Message.Header.Kind ||
+				got.Message.Header.Timestamp != want.Message.Header.Timestamp ||
+				got.Message.Header.BlockNumber != want.Message.Header.BlockNumber ||
+				!bytes.Equal(got.Message.L2msg, want.Message.L2msg) {
+				Fail(t, "after", popped, "pops, restored message", i, "differs")
+			}
+		}
+	}
+
+	backend := NewMemoryInboxBackend(batches, delayed)
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	popRest(multiplexer, 1)
+	cursor, err := multiplexer.MarshalCursor()
+	Require(t, err)
+	wrongBackend := NewMemoryInboxBackend(batches, delayed)
+	wrongBackend.AdvanceSequencerInbox()
+	if _, err := NewInboxMultiplexerFromCursor(context.Background(), wrongBackend, cursor, nil, KeysetValidate, &DefaultInboxMultiplexerConfig); err == nil {
+		Fail(t, "restored a cursor onto a backend at a different sequencer message")
+	}
+	if _, err := NewInboxMultiplexerFromCursor(context.Background(), backend, []byte{0xff}, nil, KeysetValidate, &DefaultInboxMultiplexerConfig); err == nil {
+		Fail(t, "restored a corrupt cursor")
+	}
+}
@@ -41,9 +41,27 @@ const L1AuthenticatedMessageHeaderFlag byte = 0x40
 // Indicates that this message is zeroheavy-encoded.
 const ZeroheavyMessageHeaderFlag byte = 0x20
 
+// Reserved to extend the L1 header: a message with this flag set has a header version byte after its format byte.
+// No such version is supported yet, so these messages are rejected rather than parsed under the current format.
+// The flag is only recognized alone, since messages combining it with the existing flags are parsed by those flags.
+const HeaderExtensionFlag byte = 0x10
+
 // Indicates that the message is brotli-compressed.
 const BrotliMessageHeaderByte byte = 0
 
+// Indicates that the message's segments are RLP-encoded without compression.
+// Only parsed if the config enables UncompressedBatches.
+const UncompressedMessageHeaderByte byte = 2
+
+// Indicates that the message is brotli-compressed, with its uncompressed size as a uvarint before the brotli stream.
+// Only parsed if the config enables SizePrefixedBrotliBatches.
+const SizePrefixedBrotliMessageHeaderByte byte = 3
+
+// Indicates that the message's segments are RLP-encoded without compression, with each L2 message segment compressed
+// on its own when its kind byte says so, so a batch can mix compressed and uncompressed L2 messages.
+// Only parsed if the config enables SegmentCompressedBatches.
+const SegmentCompressedMessageHeaderByte byte = 4
+
 func IsDASMessageHeaderByte(header byte) bool {
 	return (DASMessageHeaderFlag & header) > 0
 }
@@ -52,6 +70,11 @@ func IsTreeDASMessageHeaderByte(header byte) bool {
 	return (TreeDASMessageHeaderFlag & header) > 0
 }
 
+func IsHeaderExtensionByte(header byte) bool {
+	existingFlags := DASMessageHeaderFlag | TreeDASMessageHeaderFlag | L1AuthenticatedMessageHeaderFlag | ZeroheavyMessageHeaderFlag
+	return (HeaderExtensionFlag&header) > 0 && (existingFlags&header) == 0
+}
+
 func IsZeroheavyEncodedHeaderByte(header byte) bool {
 	return (ZeroheavyMessageHeaderFlag & header) > 0
 }
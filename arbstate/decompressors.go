@@ -0,0 +1,168 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/offchainlabs/nitro/arbcompress"
+)
+
+// Decompresses the segment stream of a sequencer message.
+// Only the first maxLen bytes of the returned reader are parsed. A reader yielding more is detected as a truncated batch,
+// so decompressors that can should return the excess rather than stopping at maxLen themselves.
+type Decompressor interface {
+	Decompress(rd io.Reader, maxLen int64) (io.Reader, error)
+}
+
+// Reads the whole compressed payload before decompressing it, since arbcompress has no streaming decoder
+type brotliDecompressor struct{}
+
+func (d brotliDecompressor) Decompress(rd io.Reader, maxLen int64) (io.Reader, error) {
+	compressed, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := arbcompress.Decompress(compressed, int(maxLen))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(decompressed), nil
+}
+
+// Reads a uvarint giving the size of the segment stream, then the brotli-compressed stream,
+// which is rejected unless it decompresses to exactly that size, or if that size is zero. Like brotliDecompressor, the stream is read whole.
+type sizePrefixedBrotliDecompressor struct{}
+
+func (d sizePrefixedBrotliDecompressor) Decompress(rd io.Reader, maxLen int64) (io.Reader, error) {
+	byteReader, ok := rd.(io.ByteReader)
+	if !ok {
+		bufReader := bufio.NewReader(rd)
+		byteReader, rd = bufReader, bufReader
+	}
+	size, err := binary.ReadUvarint(byteReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read uncompressed size: %w", err)
+	}
+	if size == 0 {
+		// arbcompress can't decompress into an empty buffer, and a batch without segments has no use
+		return nil, errors.New("uncompressed size is zero")
+	}
+	if size > uint64(maxLen) {
+		return nil, fmt.Errorf("uncompressed size %v exceeds limit %v", size, maxLen)
+	}
+	compressed, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := arbcompress.Decompress(compressed, int(size))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(decompressed)) != size {
+		return nil, fmt.Errorf("decompressed to %v bytes instead of the %v prefixed", len(decompressed), size)
+	}
+	return bytes.NewReader(decompressed), nil
+}
+
+// Reads the segment stream as is, for messages posted without compression
+type uncompressedDecompressor struct{}
+
+func (d uncompressedDecompressor) Decompress(rd io.Reader, maxLen int64) (io.Reader, error) {
+	return rd, nil
+}
+
+// Splits the payload of a sequencer message, following its header byte, into segments.
+// The segments returned must not total more than maxLen bytes.
+type SequencerMessageFormatHandler interface {
+	ParseSegments(rd io.Reader, maxLen int64) ([][]byte, error)
+}
+
+// guards both decompressors and formatHandlers, which share the header byte space
+var decompressorsMutex sync.RWMutex
+var decompressors = map[byte]Decompressor{
+	BrotliMessageHeaderByte: brotliDecompressor{},
+}
+var formatHandlers = map[byte]SequencerMessageFormatHandler{}
+
+func checkTagAvailable(tag byte) error {
+	if IsDASMessageHeaderByte(tag) || IsZeroheavyEncodedHeaderByte(tag) || IsHeaderExtensionByte(tag) {
+		return fmt.Errorf("tag %#x conflicts with a header flag", tag)
+	}
+	if tag == UncompressedMessageHeaderByte || tag == SizePrefixedBrotliMessageHeaderByte || tag == SegmentCompressedMessageHeaderByte {
+		return fmt.Errorf("tag %#x is reserved for a built-in format", tag)
+	}
+	_, isDecompressor := decompressors[tag]
+	_, isFormat := formatHandlers[tag]
+	if isDecompressor || isFormat {
+		return fmt.Errorf("tag %#x already registered", tag)
+	}
+	return nil
+}
+
+// Registers a codec for sequencer messages whose header byte equals tag.
+// Tags can't be re-registered, and can't use the DAS, zeroheavy or header extension flag bits since those are handled first.
+// The built-in UncompressedMessageHeaderByte, SizePrefixedBrotliMessageHeaderByte and SegmentCompressedMessageHeaderByte are reserved too, even while the config leaves them disabled.
+func RegisterDecompressor(tag byte, decompressor Decompressor) error {
+	decompressorsMutex.Lock()
+	defer decompressorsMutex.Unlock()
+	if err := checkTagAvailable(tag); err != nil {
+		return err
+	}
+	decompressors[tag] = decompressor
+	return nil
+}
+
+// Registers a handler for sequencer messages whose header byte equals tag, for framings other than a compressed segment stream.
+// Handlers share the tag space of decompressors, with the same restrictions.
+func RegisterSequencerMessageFormatHandler(tag byte, handler SequencerMessageFormatHandler) error {
+	decompressorsMutex.Lock()
+	defer decompressorsMutex.Unlock()
+	if err := checkTagAvailable(tag); err != nil {
+		return err
+	}
+	formatHandlers[tag] = handler
+	return nil
+}
+
+// Returns the decompressor for a header byte, including the built-in formats only parsed when the config enables them
+func configuredDecompressor(tag byte, config *InboxMultiplexerConfig) Decompressor {
+	switch tag {
+	case UncompressedMessageHeaderByte:
+		if config.UncompressedBatches {
+			return uncompressedDecompressor{}
+		}
+		return nil
+	case SegmentCompressedMessageHeaderByte:
+		// the segments are decompressed individually as they're read
+		if config.SegmentCompressedBatches {
+			return uncompressedDecompressor{}
+		}
+		return nil
+	case SizePrefixedBrotliMessageHeaderByte:
+		if config.SizePrefixedBrotliBatches {
+			return sizePrefixedBrotliDecompressor{}
+		}
+		return nil
+	}
+	return lookupDecompressor(tag)
+}
+
+func lookupDecompressor(tag byte) Decompressor {
+	decompressorsMutex.RLock()
+	defer decompressorsMutex.RUnlock()
+	return decompressors[tag]
+}
+
+func lookupFormatHandler(tag byte) SequencerMessageFormatHandler {
+	decompressorsMutex.RLock()
+	defer decompressorsMutex.RUnlock()
+	return formatHandlers[tag]
+}
@@ -4,17 +4,22 @@
 package arbstate
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"math/big"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/rlp"
 
 	"github.com/offchainlabs/nitro/arbcompress"
@@ -22,11 +27,55 @@ import (
 	"github.com/offchainlabs/nitro/arbos/l1pricing"
 	"github.com/offchainlabs/nitro/arbutil"
 	"github.com/offchainlabs/nitro/das/dastree"
+	"github.com/offchainlabs/nitro/util/arbmath"
+	"github.com/offchainlabs/nitro/util/containers"
 	"github.com/offchainlabs/nitro/zeroheavy"
 )
 
 var uniquifyingPrefix = []byte("Arbitrum Nitro Feed:")
 
+var (
+	batchUnsupportedVersionCounter     = metrics.NewRegisteredCounter("arb/inbox/batch/unsupportedversion", nil)
+	batchUnknownFormatCounter          = metrics.NewRegisteredCounter("arb/inbox/batch/unknownformat", nil)
+	batchDecompressionFailedCounter    = metrics.NewRegisteredCounter("arb/inbox/batch/decompressionfailed", nil)
+	batchFormatHandlerFailedCounter    = metrics.NewRegisteredCounter("arb/inbox/batch/formathandlerfailed", nil)
+	segmentParseErrorCounter           = metrics.NewRegisteredCounter("arb/inbox/segment/parseerror", nil)
+	segmentBrotliDroppedCounter        = metrics.NewRegisteredCounter("arb/inbox/segment/brotli/dropped", nil)
+	segmentZstdDroppedCounter          = metrics.NewRegisteredCounter("arb/inbox/segment/zstd/dropped", nil)
+	segmentBrotliDecompressedHistogram = metrics.NewRegisteredHistogram("arb/inbox/segment/brotli/decompressed", nil, metrics.NewExpDecaySample(1028, 0.015))
+	batchDelayedRegressionCounter      = metrics.NewRegisteredCounter("arb/inbox/batch/delayedregression", nil)
+	batchInvertedRangeCounter          = metrics.NewRegisteredCounter("arb/inbox/batch/invertedrange", nil)
+	batchDuplicateCounter              = metrics.NewRegisteredCounter("arb/inbox/batch/duplicate", nil)
+	batchTruncatedCounter              = metrics.NewRegisteredCounter("arb/inbox/batch/truncated", nil)
+	batchParseCacheHitCounter          = metrics.NewRegisteredCounter("arb/inbox/batch/parsecache/hit", nil)
+)
+
+// Wrapped by the errors the multiplexer returns in strict mode instead of producing invalid messages
+var ErrInvalidSequencerMessage = errors.New("invalid sequencer message")
+
+// Wrapped by the Strict mode error for a batch whose segment stream is cut off by MaxDecompressedLen.
+// It wraps ErrInvalidSequencerMessage itself.
+var ErrSegmentStreamTruncated = errors.Wrap(ErrInvalidSequencerMessage, "segment stream exceeds MaxDecompressedLen")
+
+// Returned by Pop if a message was popped without advancing the backend's position, which would make it popped again.
+// The multiplexer's state no longer matches the backend afterwards, so it should be discarded.
+var ErrNoProgress = errors.New("inbox multiplexer made no progress")
+
+// Delayed readers should wrap this when asked for a delayed message they don't have yet,
+// such as when a batch reads delayed messages the reader hasn't caught up to.
+var ErrDelayedMessageNotFound = errors.New("delayed message not found")
+
+// Backends should return this from PeekSequencerInbox, possibly wrapped, once they have no more batches.
+// Pop and the other methods reading batches pass it through unchanged, so consumers can stop at the end of the inbox.
+var ErrNoMoreBatches = errors.New("no more sequencer batches")
+
+// Wrapped by the error for a delayed read cut off by DelayedReadTimeout, after which Pop can be retried at the same message
+var ErrDelayedReadTimeout = errors.New("delayed message read timed out")
+
+type DelayedInboxReader interface {
+	ReadDelayedInbox(seqNum uint64) ([]byte, error)
+}
+
 type InboxBackend interface {
 	PeekSequencerInbox() ([]byte, error)
 
@@ -36,14 +85,83 @@ type InboxBackend interface {
 	GetPositionWithinMessage() uint64
 	SetPositionWithinMessage(pos uint64)
 
-	ReadDelayedInbox(seqNum uint64) ([]byte, error)
+	DelayedInboxReader
+}
+
+// Optionally implemented by a DelayedInboxReader whose reads may block.
+// If present, the multiplexer uses this variant so Pop's context can cancel the read.
+type DelayedInboxReaderWithContext interface {
+	ReadDelayedInboxWithContext(ctx context.Context, seqNum uint64) ([]byte, error)
+}
+
+// Optionally implemented by a DelayedInboxReader that can read consecutive delayed messages in one round trip.
+// The multiplexer then prefetches the delayed messages a batch reads, instead of reading them one at a time.
+// Fewer than count messages may be returned, but at least one.
+type DelayedInboxRangeReader interface {
+	ReadDelayedInboxRange(start uint64, count uint64) ([][]byte, error)
 }
 
+// Optionally implemented by an InboxBackend that can return consecutive batches in one round trip,
+// starting with the one at its sequencer inbox position. The multiplexer then prefetches batches,
+// and peeks the following ones from those instead of the backend, still advancing the backend past each.
+// Fewer than n batches may be returned, but at least one, or ErrNoMoreBatches.
+// Prefetched batches are only discarded by Reset, so call it if the backend's batches may change, such as in a reorg.
+type InboxBackendBatchPeeker interface {
+	PeekSequencerInboxBatch(n int) ([][]byte, error)
+}
+
+// Optionally implemented by an InboxBackendBatchPeeker whose peeks may block.
+// If present, the multiplexer prefetches batches with this variant so Pop's context can cancel the peek.
+type InboxBackendBatchPeekerWithContext interface {
+	PeekSequencerInboxBatchWithContext(ctx context.Context, n int) ([][]byte, error)
+}
+
+// Optionally implemented by an InboxBackend whose reads may block.
+// If present, the multiplexer uses these variants so Pop's context can cancel the read.
+type InboxBackendWithContext interface {
+	PeekSequencerInboxWithContext(ctx context.Context) ([]byte, error)
+	DelayedInboxReaderWithContext
+}
+
+// Messages returned by a multiplexer are never modified or reused by it afterwards, so they can be retained indefinitely.
+// Their L2msg may still share memory with the multiplexer's cached batch, or with a message returned for the same segment
+// by Peek, so callers must not modify it unless the multiplexer's config sets CopyPayload.
 type MessageWithMetadata struct {
 	Message             *arbos.L1IncomingMessage `json:"message"`
 	DelayedMessagesRead uint64                   `json:"delayedMessagesRead"`
 }
 
+// Compares the messages field by field, including what the header's RequestId and L1BaseFee point to.
+// A nil message, or a nil Message or Header within one, is only equal to nil.
+func (m *MessageWithMetadata) Equals(other *MessageWithMetadata) bool {
+	if m == nil || other == nil {
+		return m == nil && other == nil
+	}
+	if m.DelayedMessagesRead != other.DelayedMessagesRead {
+		return false
+	}
+	if m.Message == nil || other.Message == nil {
+		return m.Message == nil && other.Message == nil
+	}
+	return headersEqual(m.Message.Header, other.Message.Header) && bytes.Equal(m.Message.L2msg, other.Message.L2msg)
+}
+
+func headersEqual(a *arbos.L1IncomingMessageHeader, b *arbos.L1IncomingMessageHeader) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if a.Kind != b.Kind || a.Poster != b.Poster || a.BlockNumber != b.BlockNumber || a.Timestamp != b.Timestamp {
+		return false
+	}
+	if (a.RequestId == nil) != (b.RequestId == nil) || (a.RequestId != nil && *a.RequestId != *b.RequestId) {
+		return false
+	}
+	if (a.L1BaseFee == nil) != (b.L1BaseFee == nil) || (a.L1BaseFee != nil && a.L1BaseFee.Cmp(b.L1BaseFee) != 0) {
+		return false
+	}
+	return true
+}
+
 var EmptyTestMessageWithMetadata = MessageWithMetadata{
 	Message: &arbos.EmptyTestIncomingMessage,
 }
@@ -70,6 +188,51 @@ func (m *MessageWithMetadata) Hash(sequenceNumber arbutil.MessageIndex, chainId
 type InboxMultiplexer interface {
 	Pop(context.Context) (*MessageWithMetadata, error)
 	DelayedMessagesRead() uint64
+	CursorState() MultiplexerCursorState
+	MessagesInCurrentBatch(ctx context.Context) (func() (*MessageWithMetadata, bool, error), error)
+	PopWithSegment(ctx context.Context) (*MessageWithMetadata, uint64, error)
+	Peek(ctx context.Context) (*MessageWithMetadata, error)
+	PopWithInfo(ctx context.Context) (*MessageWithMetadata, PopInfo, error)
+	PopBatchOfDelayed(ctx context.Context, max int) ([]*MessageWithMetadata, error)
+	MarshalCursor() ([]byte, error)
+	AdvanceToBatch(ctx context.Context, sequencerMessageNum uint64) error
+	SeekSubMessage(ctx context.Context, pos uint64) error
+	RemainingInBatch() (int, bool)
+	Reset(delayedMessagesRead uint64)
+	Stats() MultiplexerStats
+	ResetStats()
+}
+
+// A snapshot of where the multiplexer is within the sequencer inbox, for debugging
+type MultiplexerCursorState struct {
+	SequencerMessageNum uint64
+	SegmentNum          uint64
+	SubMessageNumber    uint64
+	SegmentTimestamp    uint64
+	SegmentBlockNumber  uint64
+	DelayedMessagesRead uint64
+}
+
+// Totals over the messages popped since the multiplexer was created or ResetStats was called
+type MultiplexerStats struct {
+	// Messages not read from the delayed inbox, other than invalid messages
+	L2Messages      uint64
+	DelayedMessages uint64
+	// Messages produced in place of malformed segments or batches
+	InvalidMessages uint64
+	// Sum of the L2msg lengths of the L2Messages
+	L2PayloadBytes uint64
+	// Number of messages that were the last of their sequencer message
+	BatchesCrossed uint64
+	// Bytes of compressed segment streams read after decompression, counted as each batch is read
+	BatchDecompressedBytes uint64
+	// Bytes of brotli and zstd compressed L2 messages after decompression
+	SegmentDecompressedBytes uint64
+}
+
+// Returns the bytes decompressed for both segment streams and L2 messages
+func (s MultiplexerStats) DecompressedBytes() uint64 {
+	return s.BatchDecompressedBytes + s.SegmentDecompressedBytes
 }
 
 type sequencerMessage struct {
@@ -79,87 +242,350 @@ type sequencerMessage struct {
 	maxL1Block           uint64
 	afterDelayedMessages uint64
 	segments             [][]byte
+	// bytes of the segment stream read after decompressing it, or 0 if it wasn't compressed
+	decompressedLen uint64
 }
 
 const maxDecompressedLen int = 1024 * 1024 * 16 // 16 MiB
-const maxZeroheavyDecompressedLen = 101*maxDecompressedLen/100 + 64
 const MaxSegmentsPerSequencerMessage = 100 * 1024
 const MinLifetimeSecondsForDataAvailabilityCert = 7 * 24 * 60 * 60 // one week
 
-func parseSequencerMessage(ctx context.Context, batchNum uint64, data []byte, dasReader DataAvailabilityReader, keysetValidationMode KeysetValidationMode) (*sequencerMessage, error) {
-	if len(data) < 40 {
-		return nil, errors.New("sequencer message missing L1 header")
+// Returned by parseSequencerMessage when the batch is too short to hold the 40 byte L1 header.
+// The multiplexer treats such a batch as invalid rather than as a backend failure.
+var ErrSequencerMessageMissingL1Header = errors.New("sequencer message missing L1 header")
+
+const (
+	BackendOpPeek        = "peek"
+	BackendOpReadDelayed = "readDelayed"
+)
+
+// Wraps an error returned by the inbox backend or delayed reader, identifying the read that failed
+type BackendError struct {
+	// BackendOpPeek or BackendOpReadDelayed
+	Op string
+	// The sequencer inbox position being peeked, or the sequence number of the delayed message being read
+	Position uint64
+	Err      error
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("inbox backend %v at %v failed: %v", e.Op, e.Position, e.Err)
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// Calls fn with each batch the backend holds, starting by advancing it to startPos, until peeking fails with
+// ErrNoMoreBatches. The backend is left past the last batch fn was called with, or at the batch
+// fn or the backend failed at, whose error is returned. It can't be moved backwards, so startPos can't be behind it.
+func IterateBatches(backend InboxBackend, startPos uint64, fn func(pos uint64, raw []byte) error) error {
+	if position := backend.GetSequencerInboxPosition(); position > startPos {
+		return fmt.Errorf("can't iterate from sequencer message %v as the backend is at %v", startPos, position)
+	}
+	for backend.GetSequencerInboxPosition() < startPos {
+		backend.SetPositionWithinMessage(0)
+		backend.AdvanceSequencerInbox()
+	}
+	for {
+		pos := backend.GetSequencerInboxPosition()
+		raw, err := backend.PeekSequencerInbox()
+		if errors.Is(err, ErrNoMoreBatches) {
+			return nil
+		}
+		if err != nil {
+			return &BackendError{Op: BackendOpPeek, Position: pos, Err: err}
+		}
+		if err := fn(pos, raw); err != nil {
+			return err
+		}
+		backend.SetPositionWithinMessage(0)
+		backend.AdvanceSequencerInbox()
+	}
+}
+
+// Reports whether the batch is just the 40 byte L1 header, without a payload.
+// Such a batch is valid and only reads delayed messages, up to its afterDelayedMessages.
+func IsEmptyBatch(data []byte) bool {
+	return len(data) == 40
+}
+
+func maxZeroheavyDecompressedLen(maxDecompressedSize int64) int64 {
+	return 101*maxDecompressedSize/100 + 64
+}
+
+// The config's limits must be set, as they are after NewInboxMultiplexerWithConfig replaces zero values with their defaults
+func parseSequencerMessage(ctx context.Context, batchNum uint64, data []byte, dasReader DataAvailabilityReader, keysetValidationMode KeysetValidationMode, config *InboxMultiplexerConfig) (*sequencerMessage, error) {
+	return parseSequencerMessageReader(ctx, batchNum, bytes.NewReader(data), dasReader, keysetValidationMode, config)
+}
+
+// Like parseSequencerMessage, but reads the batch from rd.
+// Only the segment streams of decompressors returning a reader over rd, such as the uncompressed format's, are parsed
+// incrementally. Brotli-compressed payloads, DAS certificates and zeroheavy-decoded payloads are still read fully into
+// memory, since arbcompress only decompresses whole buffers, so this doesn't bound the memory of the common formats.
+func parseSequencerMessageReader(ctx context.Context, batchNum uint64, rd io.Reader, dasReader DataAvailabilityReader, keysetValidationMode KeysetValidationMode, config *InboxMultiplexerConfig) (*sequencerMessage, error) {
+	parsedMsg, err := readSequencerMessage(ctx, batchNum, rd, dasReader, keysetValidationMode, config)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug(
+		"parsed sequencer message",
+		"batchNum", batchNum,
+		"segments", len(parsedMsg.segments),
+		"minTimestamp", parsedMsg.minTimestamp,
+		"maxTimestamp", parsedMsg.maxTimestamp,
+		"minL1Block", parsedMsg.minL1Block,
+		"maxL1Block", parsedMsg.maxL1Block,
+		"afterDelayedMessages", parsedMsg.afterDelayedMessages,
+	)
+	return parsedMsg, nil
+}
+
+func readSequencerMessage(ctx context.Context, batchNum uint64, rd io.Reader, dasReader DataAvailabilityReader, keysetValidationMode KeysetValidationMode, config *InboxMultiplexerConfig) (*sequencerMessage, error) {
+	header := make([]byte, 40)
+	if _, err := io.ReadFull(rd, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrSequencerMessageMissingL1Header
+		}
+		return nil, err
 	}
 	parsedMsg := &sequencerMessage{
-		minTimestamp:         binary.BigEndian.Uint64(data[:8]),
-		maxTimestamp:         binary.BigEndian.Uint64(data[8:16]),
-		minL1Block:           binary.BigEndian.Uint64(data[16:24]),
-		maxL1Block:           binary.BigEndian.Uint64(data[24:32]),
-		afterDelayedMessages: binary.BigEndian.Uint64(data[32:40]),
+		minTimestamp:         binary.BigEndian.Uint64(header[:8]),
+		maxTimestamp:         binary.BigEndian.Uint64(header[8:16]),
+		minL1Block:           binary.BigEndian.Uint64(header[16:24]),
+		maxL1Block:           binary.BigEndian.Uint64(header[24:32]),
+		afterDelayedMessages: binary.BigEndian.Uint64(header[32:40]),
 		segments:             [][]byte{},
 	}
-	payload := data[40:]
+	if parsedMsg.minTimestamp > parsedMsg.maxTimestamp || parsedMsg.minL1Block > parsedMsg.maxL1Block {
+		log.Warn(
+			"sequencer message has an inverted range, using its minimum",
+			"batchNum", batchNum,
+			"minTimestamp", parsedMsg.minTimestamp,
+			"maxTimestamp", parsedMsg.maxTimestamp,
+			"minL1Block", parsedMsg.minL1Block,
+			"maxL1Block", parsedMsg.maxL1Block,
+		)
+		batchInvertedRangeCounter.Inc(1)
+	}
+	payload := bufio.NewReader(rd)
+	headerByte, err := payload.ReadByte()
+	if errors.Is(err, io.EOF) {
+		// see IsEmptyBatch
+		log.Debug("sequencer message has no payload", "batchNum", batchNum)
+		return parsedMsg, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if IsHeaderExtensionByte(headerByte) {
+		version, err := payload.ReadByte()
+		if err != nil {
+			// a missing version is logged as 0
+			version = 0
+		}
+		log.Warn("sequencer message has an unsupported header version", "batchNum", batchNum, "firstByte", headerByte, "version", version)
+		batchUnsupportedVersionCounter.Inc(1)
+		if config.Strict {
+			return nil, errors.Wrapf(ErrInvalidSequencerMessage, "batch %v has unsupported header version %v", batchNum, version)
+		}
+		return parsedMsg, nil
+	}
+	// replaces the payload with data recovered from it, returning false if there's nothing left
+	replacePayload := func(data []byte) bool {
+		if len(data) == 0 {
+			log.Warn("empty sequencer message")
+			return false
+		}
+		headerByte = data[0]
+		payload = bufio.NewReader(bytes.NewReader(data[1:]))
+		return true
+	}
 
-	if len(payload) > 0 && IsDASMessageHeaderByte(payload[0]) {
+	if IsDASMessageHeaderByte(headerByte) {
 		if dasReader == nil {
 			log.Error("No DAS Reader configured, but sequencer message found with DAS header")
+			if config.Strict {
+				return nil, errors.Wrapf(ErrInvalidSequencerMessage, "batch %v has a DAS header but no DAS reader is configured", batchNum)
+			}
 		} else {
-			var err error
-			payload, err = RecoverPayloadFromDasBatch(ctx, batchNum, data, dasReader, nil, keysetValidationMode)
+			certificate, err := io.ReadAll(payload)
+			if err != nil {
+				return nil, err
+			}
+			data := append(append(header, headerByte), certificate...)
+			recovered, err := RecoverPayloadFromDasBatch(ctx, batchNum, data, dasReader, nil, keysetValidationMode)
 			if err != nil {
 				return nil, err
 			}
-			if payload == nil {
+			if recovered == nil || !replacePayload(recovered) {
 				return parsedMsg, nil
 			}
 		}
 	}
 
-	if len(payload) > 0 && IsZeroheavyEncodedHeaderByte(payload[0]) {
-		pl, err := io.ReadAll(io.LimitReader(zeroheavy.NewZeroheavyDecoder(bytes.NewReader(payload[1:])), int64(maxZeroheavyDecompressedLen)))
+	if IsZeroheavyEncodedHeaderByte(headerByte) {
+		pl, err := io.ReadAll(io.LimitReader(zeroheavy.NewZeroheavyDecoder(payload), maxZeroheavyDecompressedLen(config.MaxDecompressedLen)))
 		if err != nil {
 			log.Warn("error reading from zeroheavy decoder", err.Error())
+			if config.Strict {
+				return nil, errors.Wrapf(ErrInvalidSequencerMessage, "batch %v failed zeroheavy decoding: %v", batchNum, err)
+			}
+			return parsedMsg, nil
+		}
+		if !replacePayload(pl) {
 			return parsedMsg, nil
 		}
-		payload = pl
 	}
 
-	if len(payload) > 0 && IsBrotliMessageHeaderByte(payload[0]) {
-		decompressed, err := arbcompress.Decompress(payload[1:], maxDecompressedLen)
+	// summed over the segments kept, which are dropped from the first one exceeding MaxTotalSegmentBytes
+	var totalSegmentBytes int64
+	decompressor := configuredDecompressor(headerByte, config)
+	if decompressor != nil {
+		reader, err := decompressor.Decompress(payload, config.MaxDecompressedLen)
 		if err == nil {
-			reader := bytes.NewReader(decompressed)
-			stream := rlp.NewStream(reader, uint64(maxDecompressedLen))
-			for {
-				var segment []byte
-				err := stream.Decode(&segment)
+			capped := &cappedReader{reader: reader, remaining: config.MaxDecompressedLen}
+			stream := rlp.NewStream(capped, uint64(config.MaxDecompressedLen))
+			truncated := false
+			for element := 0; ; element++ {
+				// Reading each element raw first keeps the stream in sync past an element that's framed correctly
+				// but isn't a valid segment, such as a list, so SkipMalformedSegments can continue after it.
+				// An element whose length runs past the end of the stream can't be skipped,
+				// since there's no other framing to find the next segment by.
+				raw, err := stream.Raw()
+				if errors.Is(err, io.EOF) {
+					truncated = capped.overLimit()
+					break
+				}
+				// an element cut off by the limit is reported as truncation below
+				if err != nil && capped.overLimit() {
+					truncated = true
+					break
+				}
 				if err != nil {
-					if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
-						log.Warn("error parsing sequencer message segment", "err", err.Error())
+					log.Warn("unable to read sequencer message segment, ignoring the rest of the batch", "batchNum", batchNum, "element", element, "err", err.Error())
+					if !errors.Is(err, io.ErrUnexpectedEOF) {
+						segmentParseErrorCounter.Inc(1)
+						if config.Strict {
+							return nil, errors.Wrapf(ErrInvalidSequencerMessage, "batch %v segment %v failed to parse: %v", batchNum, element, err)
+						}
 					}
 					break
 				}
-				if len(parsedMsg.segments) >= MaxSegmentsPerSequencerMessage {
-					log.Warn("too many segments in sequence batch")
+				var segment []byte
+				if err := rlp.DecodeBytes(raw, &segment); err != nil {
+					log.Warn(
+						"sequencer message segment failed to parse",
+						"batchNum", batchNum,
+						"element", element,
+						"skipping", config.SkipMalformedSegments,
+						"err", err.Error(),
+					)
+					segmentParseErrorCounter.Inc(1)
+					if config.Strict {
+						return nil, errors.Wrapf(ErrInvalidSequencerMessage, "batch %v segment %v failed to parse: %v", batchNum, element, err)
+					}
+					if config.SkipMalformedSegments {
+						continue
+					}
+					break
+				}
+				if len(parsedMsg.segments) >= config.MaxSegments {
+					log.Warn("too many segments in sequence batch", "limit", config.MaxSegments)
+					break
+				}
+				totalSegmentBytes += int64(len(segment))
+				if totalSegmentBytes > config.MaxTotalSegmentBytes {
+					log.Warn("too many segment bytes in sequence batch", "limit", config.MaxTotalSegmentBytes, "segments", len(parsedMsg.segments))
 					break
 				}
 				parsedMsg.segments = append(parsedMsg.segments, segment)
 			}
+			if headerByte != UncompressedMessageHeaderByte && headerByte != SegmentCompressedMessageHeaderByte {
+				parsedMsg.decompressedLen = uint64(config.MaxDecompressedLen - capped.remaining)
+			}
+			if truncated {
+				log.Warn(
+					"sequencer message segment stream exceeds MaxDecompressedLen, ignoring the rest of the batch",
+					"batchNum", batchNum,
+					"limit", config.MaxDecompressedLen,
+					"segments", len(parsedMsg.segments),
+				)
+				batchTruncatedCounter.Inc(1)
+				if config.Strict {
+					return nil, errors.Wrapf(ErrSegmentStreamTruncated, "batch %v", batchNum)
+				}
+			}
 		} else {
 			log.Warn("sequencer msg decompression failed", "err", err)
+			batchDecompressionFailedCounter.Inc(1)
+			if config.Strict {
+				return nil, errors.Wrapf(ErrInvalidSequencerMessage, "batch %v failed decompression: %v", batchNum, err)
+			}
 		}
-	} else {
-		length := len(payload)
-		if length == 0 {
-			log.Warn("empty sequencer message")
+	} else if handler := lookupFormatHandler(headerByte); handler != nil {
+		segments, err := handler.ParseSegments(payload, config.MaxDecompressedLen)
+		if err != nil {
+			log.Warn("sequencer message format handler failed", "firstByte", headerByte, "err", err)
+			batchFormatHandlerFailedCounter.Inc(1)
+			if config.Strict {
+				return nil, errors.Wrapf(ErrInvalidSequencerMessage, "batch %v format %#x failed to parse: %v", batchNum, headerByte, err)
+			}
 		} else {
-			log.Warn("unknown sequencer message format", "length", length, "firstByte", payload[0])
+			if len(segments) > config.MaxSegments {
+				log.Warn("too many segments in sequence batch", "limit", config.MaxSegments)
+				segments = segments[:config.MaxSegments]
+			}
+			for i, segment := range segments {
+				totalSegmentBytes += int64(len(segment))
+				if totalSegmentBytes > config.MaxTotalSegmentBytes {
+					log.Warn("too many segment bytes in sequence batch", "limit", config.MaxTotalSegmentBytes, "segments", i)
+					segments = segments[:i]
+					break
+				}
+			}
+			parsedMsg.segments = segments
+		}
+	} else {
+		log.Warn("unknown sequencer message format", "firstByte", headerByte)
+		batchUnknownFormatCounter.Inc(1)
+		if config.Strict {
+			return nil, errors.Wrapf(ErrInvalidSequencerMessage, "batch %v has unknown format %#x", batchNum, headerByte)
 		}
-
 	}
 
 	return parsedMsg, nil
 }
 
+// Reads at most remaining bytes, and notes whether the underlying reader had more
+type cappedReader struct {
+	reader    io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (r *cappedReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		if !r.exceeded {
+			var next [1]byte
+			n, _ := io.ReadFull(r.reader, next[:])
+			r.exceeded = n > 0
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// Reports whether the underlying reader has more than the limit, reading up to the limit to find out
+func (r *cappedReader) overLimit() bool {
+	_, _ = io.Copy(io.Discard, r)
+	return r.exceeded
+}
+
 func RecoverPayloadFromDasBatch(
 	ctx context.Context,
 	batchNum uint64,
@@ -267,26 +693,239 @@ const KeysetValidate KeysetValidationMode = 0
 const KeysetPanicIfInvalid KeysetValidationMode = 1
 const KeysetDontValidate KeysetValidationMode = 2
 
+// Only one goroutine may drive the multiplexer at a time, by calling Pop, Peek or similar,
+// but the getters DelayedMessagesRead, CursorState and Stats may be called concurrently with it.
+// They wait for an in-progress Pop to finish.
 type inboxMultiplexer struct {
+	mutex                     sync.RWMutex
 	backend                   InboxBackend
+	delayedReader             DelayedInboxReader
+	delayedMessageCache       *containers.LruCache[uint64, *arbos.L1IncomingMessage]
+	recentBatches             *containers.LruCache[common.Hash, uint64]
+	parsedBatches             *containers.LruCache[uint64, parsedBatch]
+	prefetchedDelayed         [][]byte // delayed messages read ahead for the cached batch
+	prefetchedDelayedStart    uint64   // sequence number of prefetchedDelayed[0]
+	prefetchedBatches         [][]byte // batches peeked ahead from an InboxBackendBatchPeeker and not yet handed out
+	prefetchedBatchesStart    uint64   // sequencer inbox position of prefetchedBatches[0]
 	delayedMessagesRead       uint64
 	dasReader                 DataAvailabilityReader
 	cachedSequencerMessage    *sequencerMessage
 	cachedSequencerMessageNum uint64
+	cachedLastContentSegment  int // index of the last segment producing messages, or -1 if none
 	cachedSegmentNum          uint64
 	cachedSegmentTimestamp    uint64
 	cachedSegmentBlockNumber  uint64
 	cachedSubMessageNumber    uint64
+	cachedStartDelayedRead    uint64 // delayed messages read before the cached batch's first message
 	keysetValidationMode      KeysetValidationMode
+	config                    InboxMultiplexerConfig
+	stats                     MultiplexerStats
+	lastSegmentDecompressed   uint64 // decompressed size of the L2 message getNextMsg last returned, for the stats
+	// set while PopBatchOfDelayed looks ahead, so observers only see the segment if its message is kept
+	deferObservers    bool
+	deferredObservers []func()
+	// reused by getNextMsg, which only runs with the write lock held, and never referenced by messages it returns
+	advanceReader bytes.Reader
+	advanceStream rlp.Stream
+	delayedData   bytes.Reader
+}
+
+// How the delayed messages read is reported once a batch reads all the delayed messages it can,
+// which matters when more had already been read than the batch's afterDelayedMessages
+type DelayedOverrunStrategy uint8
+
+const (
+	// Report the batch's afterDelayedMessages, even if that's below the delayed messages already read.
+	// This is what the chain's state transition expects.
+	DelayedOverrunRewind DelayedOverrunStrategy = iota
+	// Never decrease the delayed messages read, keeping it if the batch's afterDelayedMessages is lower.
+	// This produces different messages than DelayedOverrunRewind.
+	DelayedOverrunClamp
+)
+
+// Times operations of the multiplexer, with the spans named by the Span constants.
+// StartSpan is called as an operation starts, and the function it returns as it ends.
+type Tracer interface {
+	StartSpan(name string) func()
+}
+
+const (
+	SpanPeekSequencerInbox      = "arbstate.PeekSequencerInbox"
+	SpanReadDelayedInbox        = "arbstate.ReadDelayedInbox"
+	SpanReadDelayedInboxRange   = "arbstate.ReadDelayedInboxRange"
+	SpanPeekSequencerInboxBatch = "arbstate.PeekSequencerInboxBatch"
+	SpanDecompressBrotli        = "arbstate.DecompressBrotli"
+	SpanDecompressZstd          = "arbstate.DecompressZstd"
+)
+
+// Describes a compressed L2 message segment that was dropped, producing an invalid message instead
+type DroppedSegment struct {
+	SequencerMessageNum uint64
+	SegmentNum          uint64
+	Kind                uint8
+	// Length of the segment after its kind byte
+	CompressedLen int
+	Reason        string
+}
+
+// Any field that changes the messages produced, such as a format, limit or segment option, must keep its
+// DefaultInboxMultiplexerConfig value to build chain state, unless the chain has adopted the change.
+// Observers, caches and tracing don't change the messages.
+type InboxMultiplexerConfig struct {
+	// Limit on the decompressed size of a batch's segment stream
+	MaxDecompressedLen int64
+	// Limit on the decompressed size of a single brotli-compressed L2 message, past which it's dropped.
+	// arbos.MaxL2MessageSize if zero.
+	MaxL2MessageSize int64
+	// Recognize BatchSegmentKindL2MessageZstd segments, which are otherwise an unknown kind producing invalid messages
+	ZstdSegments bool
+	// Parse batches with the UncompressedMessageHeaderByte header as an uncompressed segment stream.
+	// Otherwise that header byte is an unknown format, leaving such batches without segments.
+	UncompressedBatches bool
+	// Parse batches with the SizePrefixedBrotliMessageHeaderByte header, rejecting those not decompressing to their prefixed size
+	SizePrefixedBrotliBatches bool
+	// Parse batches with the SegmentCompressedMessageHeaderByte header as an uncompressed stream of individually compressed segments
+	SegmentCompressedBatches bool
+	// Limit on the decompressed size of a single zstd-compressed L2 message
+	MaxZstdL2MessageSize int64
+	// Segments of a batch past this many are ignored
+	MaxSegments int
+	// Skip an element of the segment stream that's framed correctly but isn't a valid segment, such as a list,
+	// and keep parsing the segments after it. Otherwise such an element ends the batch's segments.
+	SkipMalformedSegments bool
+	// Limit on the summed length of a batch's segments, past which the remaining segments are ignored.
+	// This bounds memory regardless of how well the segment stream compresses.
+	MaxTotalSegmentBytes int64
+	// Give L2 messages a request id derived from their position, see sequencerRequestId, instead of a nil one
+	SequencerRequestIds bool
+	// Ignore advance segments with bytes after their RLP-encoded advance, instead of applying the advance as usual
+	RejectAdvanceTrailingBytes bool
+	// Saturate timestamp and L1 block number advances at the maximum uint64 instead of letting them wrap around,
+	// so an overflowing advance clamps to the batch's maximum
+	SaturatingAdvances bool
+	// Return an ErrInvalidSequencerMessage error, without advancing, wherever a malformed batch would otherwise
+	// produce invalid messages or be skipped, such as an unknown format, a bad segment or an undecodable delayed message.
+	// Batches whose afterDelayedMessages is below the delayed messages already read are rejected too.
+	// Virtual delayed messages past the end of a batch are still produced.
+	Strict bool
+	// If set, a delayed read failing with ErrDelayedMessageNotFound leaves the multiplexer at the message,
+	// so Pop can be retried once the delayed message is available. Otherwise the multiplexer advances past it.
+	RetryMissingDelayed bool
+	// If nonzero, bounds each delayed read through a DelayedInboxReaderWithContext, failing Pop with ErrDelayedReadTimeout
+	// and leaving the multiplexer at the message if it takes longer. Other delayed readers can't be interrupted.
+	DelayedReadTimeout time.Duration
+	// If set, delayed messages are read from here instead of from the backend
+	DelayedReader DelayedInboxReader
+	// Number of parsed delayed messages to keep, so reading one again skips the backend.
+	// Cached messages are shared between reads, so they must not be modified. Zero disables the cache.
+	DelayedMessageCacheSize int
+	// Upper bound on the messages returned by a PopBatchOfDelayed call, limiting how long it runs. Zero means no bound.
+	MaxDelayedPerPop int
+	// If set, called with each segment that produces a message, as it's reached, with the payload after its kind byte.
+	// Brotli L2 messages are passed decompressed, and skipped if they fail to decompress.
+	// Advance segments and virtual delayed messages past the end of the batch aren't observed,
+	// and a segment is observed again each time it's peeked.
+	// PopBatchOfDelayed only observes the segments of the messages it returns.
+	SegmentObserver func(index int, kind uint8, payload []byte)
+	// If set, called with each compressed L2 message segment that fails to decompress, before the message is dropped.
+	// Like SegmentObserver, a segment is reported again each time it's peeked, but not for PopBatchOfDelayed's look-ahead.
+	DroppedSegmentObserver func(dropped DroppedSegment)
+	// If set, called each time the multiplexer moves on to the next sequencer message, including skipping ones in AdvanceToBatch,
+	// with the previous and new sequencer message numbers and the delayed messages read after the previous one.
+	// It's called with the multiplexer locked, so it mustn't call the multiplexer.
+	BatchAdvanceObserver func(oldNum uint64, newNum uint64, delayedAfter uint64)
+	// Applies to the invalid message produced by a delayed messages segment past afterDelayedMessages,
+	// and to the delayed messages read after finishing a batch
+	DelayedOverrun DelayedOverrunStrategy
+	// If nonzero, the most virtual delayed messages a batch produces after its last segment, after which it ends
+	// without reading the rest of the delayed messages up to its afterDelayedMessages, leaving them to the following batches.
+	// This defends against batches with an absurdly large afterDelayedMessages. Zero is unbounded.
+	MaxVirtualDelayedMessages uint64
+	// If set, called with the kind and payload of segments whose kind isn't a BatchSegmentKind, as an upgrade path for new kinds.
+	// If it reports the segment handled, its message is produced instead of an invalid message, with DelayedMessagesRead
+	// set by the multiplexer. Segments after a batch's last message segment of a known kind are never reached, so aren't passed to it.
+	UnknownSegmentHandler func(kind uint8, payload []byte) (*MessageWithMetadata, bool)
+	// Poster of the L2 messages in batches
+	SequencerAddress common.Address
+	// If set, gives the L1 base fee of L2 messages in batches, keyed by the batch's minL1Block, instead of zero.
+	// A nil result is treated as zero.
+	BaseFeeProvider func(l1Block uint64) *big.Int
+	// Number of recent batches whose BatchHash is kept, to log batches with the same contents as an earlier one.
+	// Zero disables the check.
+	RecentBatchHashes int
+	// Number of parsed batches to keep, keyed by sequencer message number, so reading one again skips decompressing and parsing it,
+	// such as when reprocessing a batch after Reset, which keeps the cache. Restoring from a cursor parses its batch into the cache.
+	// A cached batch is only used if the backend still returns the same bytes for it. Zero disables the cache.
+	ParsedBatchCacheSize int
+	// Treat batches found to duplicate a recent one as if they had no segments, keeping the delayed messages they read
+	DropDuplicateBatches bool
+	// Copy the payload of each L2 message, so callers can modify it without affecting the multiplexer or other messages
+	CopyPayload bool
+	// Report the timestamp and L1 block number of each message before clamping them to the batch's range in PopInfo,
+	// to find batches relying on the clamping. The message headers are clamped either way.
+	ReportUnclamped bool
+	// If set, times backend reads and L2 message decompression, with the Span names
+	Tracer Tracer
+	// Parses the delayed messages read, for chains with a customized L1 message format
+	DelayedParser func(rd io.Reader) (*arbos.L1IncomingMessage, error)
+	// If set, applied to each delayed message read before DelayedParser, for a compressed delayed message format.
+	// Delayed messages decompressing past MaxDecompressedLen fail to parse.
+	DelayedDecompressor Decompressor
+}
+
+var DefaultInboxMultiplexerConfig = InboxMultiplexerConfig{
+	MaxDecompressedLen:   int64(maxDecompressedLen),
+	MaxL2MessageSize:     arbos.MaxL2MessageSize,
+	MaxZstdL2MessageSize: arbos.MaxL2MessageSize,
+	MaxSegments:          MaxSegmentsPerSequencerMessage,
+	MaxTotalSegmentBytes: int64(maxDecompressedLen),
+	SequencerAddress:     l1pricing.BatchPosterAddress,
+	DelayedParser:        arbos.ParseIncomingL1Message,
 }
 
 func NewInboxMultiplexer(backend InboxBackend, delayedMessagesRead uint64, dasReader DataAvailabilityReader, keysetValidationMode KeysetValidationMode) InboxMultiplexer {
-	return &inboxMultiplexer{
-		backend:              backend,
-		delayedMessagesRead:  delayedMessagesRead,
-		dasReader:            dasReader,
-		keysetValidationMode: keysetValidationMode,
+	return NewInboxMultiplexerWithConfig(backend, delayedMessagesRead, dasReader, keysetValidationMode, &DefaultInboxMultiplexerConfig)
+}
+
+// Zero valued limits, addresses and parsers in the config are replaced with their defaults
+func NewInboxMultiplexerWithConfig(backend InboxBackend, delayedMessagesRead uint64, dasReader DataAvailabilityReader, keysetValidationMode KeysetValidationMode, config *InboxMultiplexerConfig) InboxMultiplexer {
+	r := &inboxMultiplexer{
+		backend:                  backend,
+		delayedReader:            config.DelayedReader,
+		delayedMessageCache:      containers.NewLruCache[uint64, *arbos.L1IncomingMessage](config.DelayedMessageCacheSize),
+		recentBatches:            containers.NewLruCache[common.Hash, uint64](config.RecentBatchHashes),
+		parsedBatches:            containers.NewLruCache[uint64, parsedBatch](config.ParsedBatchCacheSize),
+		delayedMessagesRead:      delayedMessagesRead,
+		dasReader:                dasReader,
+		cachedLastContentSegment: -1,
+		keysetValidationMode:     keysetValidationMode,
+		config:                   *config,
+	}
+	if r.config.MaxDecompressedLen <= 0 {
+		r.config.MaxDecompressedLen = DefaultInboxMultiplexerConfig.MaxDecompressedLen
+	}
+	if r.config.MaxL2MessageSize <= 0 {
+		r.config.MaxL2MessageSize = DefaultInboxMultiplexerConfig.MaxL2MessageSize
+	}
+	if r.config.MaxZstdL2MessageSize <= 0 {
+		r.config.MaxZstdL2MessageSize = DefaultInboxMultiplexerConfig.MaxZstdL2MessageSize
+	}
+	if r.config.MaxSegments <= 0 {
+		r.config.MaxSegments = DefaultInboxMultiplexerConfig.MaxSegments
 	}
+	if r.config.MaxTotalSegmentBytes <= 0 {
+		r.config.MaxTotalSegmentBytes = DefaultInboxMultiplexerConfig.MaxTotalSegmentBytes
+	}
+	if r.config.SequencerAddress == (common.Address{}) {
+		r.config.SequencerAddress = DefaultInboxMultiplexerConfig.SequencerAddress
+	}
+	if r.config.DelayedParser == nil {
+		r.config.DelayedParser = DefaultInboxMultiplexerConfig.DelayedParser
+	}
+	if r.delayedReader == nil {
+		r.delayedReader = backend
+	}
+	return r
 }
 
 var InvalidL1Message = &arbos.L1IncomingMessage{
@@ -299,27 +938,452 @@ var InvalidL1Message = &arbos.L1IncomingMessage{
 const BatchSegmentKindL2Message uint8 = 0
 const BatchSegmentKindL2MessageBrotli uint8 = 1
 const BatchSegmentKindDelayedMessages uint8 = 2
+
+// Advance segments hold an RLP-encoded uint64 added to the timestamp or L1 block number of the following messages.
+// An advance of zero is a no-op, but still occupies a segment index.
 const BatchSegmentKindAdvanceTimestamp uint8 = 3
 const BatchSegmentKindAdvanceL1BlockNumber uint8 = 4
 
-// This does *not* return parse errors, those are transformed into invalid messages
-func (r *inboxMultiplexer) Pop(ctx context.Context) (*MessageWithMetadata, error) {
-	if r.cachedSequencerMessage == nil {
-		bytes, realErr := r.backend.PeekSequencerInbox()
-		if realErr != nil {
-			return nil, realErr
-		}
-		r.cachedSequencerMessageNum = r.backend.GetSequencerInboxPosition()
-		var err error
-		r.cachedSequencerMessage, err = parseSequencerMessage(ctx, r.cachedSequencerMessageNum, bytes, r.dasReader, r.keysetValidationMode)
-		if err != nil {
-			return nil, err
+// The canonical RLP encoding of a zero advance. Advance segments of just this are skipped without parsing them,
+// while non-canonical encodings of zero are still parsed like any other advance.
+const zeroAdvanceEncoding byte = 0x80
+
+// Only recognized if the config enables ZstdSegments, and otherwise treated like any unknown kind
+const BatchSegmentKindL2MessageZstd uint8 = 5
+
+// Reports whether segments of the kind produce a message when reached
+func isMessageSegmentKind(kind uint8, zstdSegments bool) bool {
+	switch kind {
+	case BatchSegmentKindL2Message, BatchSegmentKindL2MessageBrotli, BatchSegmentKindDelayedMessages:
+		return true
+	case BatchSegmentKindL2MessageZstd:
+		return zstdSegments
+	default:
+		return false
+	}
+}
+
+// Distinguishes sequencer request ids from delayed message request ids, which are sequence numbers below 2^64
+const sequencerRequestIdMarker byte = 0x01
+
+// Derives the request id of the L2 message in segment segmentNum of sequencer message seqMsgNum.
+// The 32 byte layout is:
+//
+//	[0]     sequencerRequestIdMarker
+//	[1:8]   zero
+//	[8:16]  seqMsgNum, big endian
+//	[16:24] segmentNum, big endian
+//	[24:32] zero
+func sequencerRequestId(seqMsgNum uint64, segmentNum uint64) common.Hash {
+	var requestId common.Hash
+	requestId[0] = sequencerRequestIdMarker
+	binary.BigEndian.PutUint64(requestId[8:16], seqMsgNum)
+	binary.BigEndian.PutUint64(requestId[16:24], segmentNum)
+	return requestId
+}
+
+func (r *inboxMultiplexer) peekSequencerInbox(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var data []byte
+	var err error
+	position := r.backend.GetSequencerInboxPosition()
+	if position >= r.prefetchedBatchesStart && position-r.prefetchedBatchesStart < uint64(len(r.prefetchedBatches)) {
+		// each prefetched batch is only handed out once, so going back to it, such as after the backend reorgs,
+		// peeks the backend again and replaces the prefetched batches with what it has now
+		offset := position - r.prefetchedBatchesStart
+		data := r.prefetchedBatches[offset]
+		r.prefetchedBatches = r.prefetchedBatches[offset+1:]
+		r.prefetchedBatchesStart = position + 1
+		return data, nil
+	}
+	if peeker, ok := r.backend.(InboxBackendBatchPeeker); ok {
+		return r.prefetchBatches(ctx, peeker, position)
+	}
+	endSpan := r.startSpan(SpanPeekSequencerInbox)
+	if backend, ok := r.backend.(InboxBackendWithContext); ok {
+		data, err = backend.PeekSequencerInboxWithContext(ctx)
+	} else {
+		data, err = r.backend.PeekSequencerInbox()
+	}
+	endSpan()
+	if errors.Is(err, ErrNoMoreBatches) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &BackendError{Op: BackendOpPeek, Position: r.backend.GetSequencerInboxPosition(), Err: err}
+	}
+	return data, ctx.Err()
+}
+
+// Bounds the memory used by prefetching batches, which may each be large
+const maxBatchPrefetch = 16
+
+// Peeks the batch at position along with the batches after it, which are kept to be peeked later, replacing any kept before
+func (r *inboxMultiplexer) prefetchBatches(ctx context.Context, peeker InboxBackendBatchPeeker, position uint64) ([]byte, error) {
+	var batches [][]byte
+	var err error
+	endSpan := r.startSpan(SpanPeekSequencerInboxBatch)
+	if contextPeeker, ok := peeker.(InboxBackendBatchPeekerWithContext); ok {
+		batches, err = contextPeeker.PeekSequencerInboxBatchWithContext(ctx, maxBatchPrefetch)
+	} else {
+		batches, err = peeker.PeekSequencerInboxBatch(maxBatchPrefetch)
+	}
+	endSpan()
+	if errors.Is(err, ErrNoMoreBatches) {
+		return nil, err
+	}
+	if err == nil && len(batches) == 0 {
+		err = fmt.Errorf("sequencer inbox batch peek at %v returned no batches", position)
+	}
+	if err != nil {
+		return nil, &BackendError{Op: BackendOpPeek, Position: position, Err: err}
+	}
+	r.prefetchedBatches = batches[1:]
+	r.prefetchedBatchesStart = position + 1
+	return batches[0], ctx.Err()
+}
+
+func (r *inboxMultiplexer) readDelayedInbox(ctx context.Context, seqNum uint64) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var data []byte
+	var err error
+	if rangeReader, ok := r.delayedReader.(DelayedInboxRangeReader); ok && r.cachedSequencerMessage != nil {
+		data, err = r.readPrefetchedDelayed(rangeReader, seqNum)
+	} else if reader, ok := r.delayedReader.(DelayedInboxReaderWithContext); ok {
+		data, err = r.readDelayedInboxWithTimeout(ctx, reader, seqNum)
+	} else {
+		endSpan := r.startSpan(SpanReadDelayedInbox)
+		data, err = r.delayedReader.ReadDelayedInbox(seqNum)
+		endSpan()
+	}
+	if err != nil {
+		return nil, &BackendError{Op: BackendOpReadDelayed, Position: seqNum, Err: err}
+	}
+	return data, ctx.Err()
+}
+
+func (r *inboxMultiplexer) readDelayedInboxWithTimeout(ctx context.Context, reader DelayedInboxReaderWithContext, seqNum uint64) ([]byte, error) {
+	readCtx := ctx
+	if r.config.DelayedReadTimeout > 0 {
+		var cancel context.CancelFunc
+		readCtx, cancel = context.WithTimeout(ctx, r.config.DelayedReadTimeout)
+		defer cancel()
+	}
+	endSpan := r.startSpan(SpanReadDelayedInbox)
+	data, err := reader.ReadDelayedInboxWithContext(readCtx, seqNum)
+	endSpan()
+	if err != nil && ctx.Err() == nil && readCtx.Err() != nil {
+		return nil, errors.Wrapf(ErrDelayedReadTimeout, "after %v: %v", r.config.DelayedReadTimeout, err)
+	}
+	return data, err
+}
+
+// Parses a delayed message read, decompressing it first if the config has a DelayedDecompressor
+func (r *inboxMultiplexer) parseDelayed(data []byte) (*arbos.L1IncomingMessage, error) {
+	r.delayedData.Reset(data)
+	if r.config.DelayedDecompressor == nil {
+		return r.config.DelayedParser(&r.delayedData)
+	}
+	reader, err := r.config.DelayedDecompressor.Decompress(&r.delayedData, r.config.MaxDecompressedLen)
+	if err != nil {
+		return nil, err
+	}
+	capped := &cappedReader{reader: reader, remaining: r.config.MaxDecompressedLen}
+	msg, err := r.config.DelayedParser(capped)
+	if err != nil {
+		return nil, err
+	}
+	if capped.overLimit() {
+		return nil, errors.New("decompressed delayed message exceeds MaxDecompressedLen")
+	}
+	return msg, nil
+}
+
+// Bounds the memory used by prefetching for batches reading many delayed messages
+const maxDelayedPrefetch uint64 = 1024
+
+// Returns delayed message seqNum, from those prefetched for the cached batch if possible.
+// Otherwise prefetches the delayed messages from seqNum up to the batch's afterDelayedMessages.
+func (r *inboxMultiplexer) readPrefetchedDelayed(rangeReader DelayedInboxRangeReader, seqNum uint64) ([]byte, error) {
+	if seqNum >= r.prefetchedDelayedStart && seqNum-r.prefetchedDelayedStart < uint64(len(r.prefetchedDelayed)) {
+		return r.prefetchedDelayed[seqNum-r.prefetchedDelayedStart], nil
+	}
+	count := uint64(1)
+	if r.cachedSequencerMessage.afterDelayedMessages > seqNum {
+		count = arbmath.MinUint(r.cachedSequencerMessage.afterDelayedMessages-seqNum, maxDelayedPrefetch)
+	}
+	endSpan := r.startSpan(SpanReadDelayedInboxRange)
+	messages, err := rangeReader.ReadDelayedInboxRange(seqNum, count)
+	endSpan()
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("delayed inbox range read at %v returned no messages", seqNum)
+	}
+	r.prefetchedDelayed = messages
+	r.prefetchedDelayedStart = seqNum
+	return messages[0], nil
+}
+
+type parsedBatch struct {
+	hash   common.Hash
+	seqMsg *sequencerMessage
+}
+
+// Parses sequencer message seqMsgNum, or returns a copy of it from the parsed batch cache if it has the same bytes
+func (r *inboxMultiplexer) parseSequencerMessage(ctx context.Context, seqMsgNum uint64, data []byte) (*sequencerMessage, error) {
+	if r.config.ParsedBatchCacheSize <= 0 {
+		return parseSequencerMessage(ctx, seqMsgNum, data, r.dasReader, r.keysetValidationMode, &r.config)
+	}
+	hash := BatchHash(data)
+	if cached, ok := r.parsedBatches.Get(seqMsgNum); ok && cached.hash == hash {
+		batchParseCacheHitCounter.Inc(1)
+		// copied, since the caller may drop its segments, and not counted as decompressed again in the stats
+		seqMsg := *cached.seqMsg
+		seqMsg.decompressedLen = 0
+		return &seqMsg, nil
+	}
+	seqMsg, err := parseSequencerMessage(ctx, seqMsgNum, data, r.dasReader, r.keysetValidationMode, &r.config)
+	if err != nil {
+		return nil, err
+	}
+	cached := *seqMsg
+	r.parsedBatches.Add(seqMsgNum, parsedBatch{hash: hash, seqMsg: &cached})
+	return seqMsg, nil
+}
+
+// Reads and parses the sequencer message at the backend's position, unless one is already cached.
+// A batch without an L1 header isn't cached, instead the invalid message standing in for it is returned,
+// and the caller consuming it must advance past the batch.
+func (r *inboxMultiplexer) cacheSequencerMessage(ctx context.Context) (*MessageWithMetadata, error) {
+	if r.cachedSequencerMessage != nil {
+		return nil, nil
+	}
+	bytes, realErr := r.peekSequencerInbox(ctx)
+	if realErr != nil {
+		return nil, realErr
+	}
+	seqMsgNum := r.backend.GetSequencerInboxPosition()
+	seqMsg, err := r.parseSequencerMessage(ctx, seqMsgNum, bytes)
+	if errors.Is(err, ErrSequencerMessageMissingL1Header) {
+		// without a header there's nothing to multiplex, so the whole batch becomes one invalid message
+		log.Warn("dropping sequencer message without L1 header", "sequencerMessageNum", seqMsgNum, "length", len(bytes))
+		if r.config.Strict {
+			return nil, errors.Wrapf(ErrInvalidSequencerMessage, "sequencer message %v is only %v bytes", seqMsgNum, len(bytes))
 		}
+		return &MessageWithMetadata{
+			Message:             InvalidL1Message,
+			DelayedMessagesRead: r.delayedMessagesRead,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.isDuplicateBatch(bytes, seqMsgNum) && r.config.DropDuplicateBatches {
+		// keep the header, so the delayed messages read still match the batch
+		seqMsg.segments = nil
+	}
+	r.cachedSequencerMessage = seqMsg
+	r.cachedSequencerMessageNum = seqMsgNum
+	r.cachedStartDelayedRead = r.delayedMessagesRead
+	r.cachedLastContentSegment = lastContentSegment(seqMsg.segments, r.config.ZstdSegments)
+	if err := r.checkDelayedRegression(seqMsgNum, seqMsg.afterDelayedMessages); err != nil {
+		r.cachedSequencerMessage = nil
+		r.cachedLastContentSegment = -1
+		return nil, err
+	}
+	// only counted once the batch is accepted, so retrying a rejected batch doesn't count it again
+	r.stats.BatchDecompressedBytes += seqMsg.decompressedLen
+	return nil, nil
+}
+
+// Warns of a sequencer message whose afterDelayedMessages is below the delayed messages read, which Strict rejects
+func (r *inboxMultiplexer) checkDelayedRegression(seqMsgNum uint64, afterDelayedMessages uint64) error {
+	if afterDelayedMessages >= r.delayedMessagesRead {
+		return nil
+	}
+	log.Warn(
+		"sequencer message afterDelayedMessages went backwards",
+		"sequencerMessageNum", seqMsgNum,
+		"afterDelayedMessages", afterDelayedMessages,
+		"delayedMessagesRead", r.delayedMessagesRead,
+	)
+	batchDelayedRegressionCounter.Inc(1)
+	if r.config.Strict {
+		return errors.Wrapf(
+			ErrInvalidSequencerMessage,
+			"sequencer message %v has afterDelayedMessages %v below delayed messages read %v",
+			seqMsgNum, afterDelayedMessages, r.delayedMessagesRead,
+		)
+	}
+	return nil
+}
+
+// This does *not* return parse errors, those are transformed into invalid messages, unless the config is Strict
+func (r *inboxMultiplexer) Pop(ctx context.Context) (*MessageWithMetadata, error) {
+	msg, _, err := r.pop(ctx)
+	return msg, err
+}
+
+// Like Pop, but also returns the segment number that produced the message.
+// Virtual delayed messages after the end of the batch report the segment count as their segment number.
+func (r *inboxMultiplexer) PopWithSegment(ctx context.Context) (*MessageWithMetadata, uint64, error) {
+	msg, info, err := r.pop(ctx)
+	return msg, info.segmentNum, err
+}
+
+// Describes where a popped message came from
+type PopInfo struct {
+	// Set if the message was the last of its sequencer message, so the multiplexer moved on to the next one
+	CrossedBatchBoundary bool
+	// The sequencer message that produced the message
+	SequencerMessageNum uint64
+	// With ReportUnclamped, the timestamp and L1 block number accumulated from the batch's advance segments
+	// before they're clamped to the batch's range for the message header
+	UnclampedTimestamp   uint64
+	UnclampedBlockNumber uint64
+	// For L2 messages, including those from the delayed inbox, the first byte of the L2msg,
+	// which is its arbos L2MessageKind. HasL2MessageKind is unset for other messages and for empty L2 messages.
+	L2MessageKind    uint8
+	HasL2MessageKind bool
+}
+
+// Like Pop, but also reports which sequencer message the message came from and whether it was the last of it
+func (r *inboxMultiplexer) PopWithInfo(ctx context.Context) (*MessageWithMetadata, PopInfo, error) {
+	msg, info, err := r.pop(ctx)
+	popInfo := PopInfo{
+		CrossedBatchBoundary: info.batchDone,
+		SequencerMessageNum:  info.seqMsgNum,
+		UnclampedTimestamp:   info.unclampedTimestamp,
+		UnclampedBlockNumber: info.unclampedBlockNumber,
+	}
+	if msg != nil && msg.Message.Header.Kind == arbos.L1MessageType_L2Message && len(msg.Message.L2msg) > 0 {
+		popInfo.L2MessageKind = msg.Message.L2msg[0]
+		popInfo.HasL2MessageKind = true
+	}
+	return msg, popInfo, err
+}
+
+type popInfo struct {
+	segmentNum uint64
+	seqMsgNum  uint64
+	// set if the message was the last of its sequencer message
+	batchDone bool
+	// only set with ReportUnclamped
+	unclampedTimestamp   uint64
+	unclampedBlockNumber uint64
+}
+
+func (r *inboxMultiplexer) pop(ctx context.Context) (*MessageWithMetadata, popInfo, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	batchPosition := r.backend.GetSequencerInboxPosition()
+	positionWithinMessage := r.backend.GetPositionWithinMessage()
+	delayedMessagesRead := r.delayedMessagesRead
+	r.lastSegmentDecompressed = 0
+	msg, info, err := r.popLocked(ctx)
+	if err == nil && r.backend.GetSequencerInboxPosition() == batchPosition && r.backend.GetPositionWithinMessage() == positionWithinMessage {
+		log.Error(
+			"inbox backend position didn't advance",
+			"sequencerMessageNum", batchPosition,
+			"positionWithinMessage", positionWithinMessage,
+		)
+		return nil, popInfo{}, ErrNoProgress
+	}
+	if msg != nil {
+		r.recordStats(msg, info, delayedMessagesRead)
+	}
+	return msg, info, err
+}
+
+// Counts a popped message in the stats, given the delayed messages read before it.
+// Every path popping messages goes through this, so the stats don't depend on which was used.
+func (r *inboxMultiplexer) recordStats(msg *MessageWithMetadata, info popInfo, delayedMessagesRead uint64) {
+	if msg.Message.Header.Kind == arbos.L1MessageType_Invalid {
+		r.stats.InvalidMessages++
+	} else if msg.DelayedMessagesRead > delayedMessagesRead {
+		r.stats.DelayedMessages++
+	} else {
+		r.stats.L2Messages++
+		r.stats.L2PayloadBytes += uint64(len(msg.Message.L2msg))
+	}
+	if info.batchDone {
+		r.stats.BatchesCrossed++
 	}
-	msg, err := r.getNextMsg()
+	r.stats.SegmentDecompressedBytes += r.lastSegmentDecompressed
+}
+
+func (r *inboxMultiplexer) popLocked(ctx context.Context) (*MessageWithMetadata, popInfo, error) {
+	skipped, err := r.cacheSequencerMessage(ctx)
+	if err != nil {
+		return nil, popInfo{}, err
+	}
+	if skipped != nil {
+		seqMsgNum := r.backend.GetSequencerInboxPosition()
+		r.advanceSequencerMsg()
+		return skipped, popInfo{seqMsgNum: seqMsgNum, batchDone: true}, nil
+	}
+	seqMsgNum := r.cachedSequencerMessageNum
+	cursor := r.saveSegmentCursor()
+	msg, segmentNum, err := r.getNextMsg(ctx)
+	if err != nil && ctx.Err() != nil {
+		// don't advance on cancellation, so that a retry resumes at the same message
+		return nil, popInfo{}, ctx.Err()
+	}
+	if errors.Is(err, ErrInvalidSequencerMessage) {
+		// strict mode stays at the invalid message
+		r.restoreSegmentCursor(cursor)
+		return nil, popInfo{}, err
+	}
+	if r.config.RetryMissingDelayed && errors.Is(err, ErrDelayedMessageNotFound) {
+		r.restoreSegmentCursor(cursor)
+		return nil, popInfo{}, err
+	}
+	if errors.Is(err, ErrDelayedReadTimeout) {
+		r.restoreSegmentCursor(cursor)
+		return nil, popInfo{}, err
+	}
+	// getNextMsg leaves the accumulated values unclamped in the cursor
+	unclampedTimestamp, unclampedBlockNumber := r.cachedSegmentTimestamp, r.cachedSegmentBlockNumber
+	msg, info, err := r.advancePastMsg(msg, segmentNum, seqMsgNum, err)
+	if r.config.ReportUnclamped {
+		info.unclampedTimestamp = unclampedTimestamp
+		info.unclampedBlockNumber = unclampedBlockNumber
+	}
+	return msg, info, err
+}
+
+// Applies an advance segment, wrapping around on overflow unless the config sets SaturatingAdvances
+func (r *inboxMultiplexer) addAdvance(value uint64, advancing uint64) uint64 {
+	if r.config.SaturatingAdvances {
+		return arbmath.SaturatingUAdd(value, advancing)
+	}
+	return value + advancing
+}
+
+// Advances past the message getNextMsg just returned
+func (r *inboxMultiplexer) advancePastMsg(msg *MessageWithMetadata, segmentNum uint64, seqMsgNum uint64, err error) (*MessageWithMetadata, popInfo, error) {
 	// advance even if there was an error
-	if r.IsCachedSegementLast() {
+	batchDone := r.IsCachedSegementLast()
+	if batchDone {
+		r.advanceSequencerMsg()
+	} else if r.virtualDelayedLimitReached() {
+		log.Warn(
+			"sequencer message reached the virtual delayed message limit",
+			"sequencerMessageNum", seqMsgNum,
+			"delayedMessagesRead", r.delayedMessagesRead,
+			"afterDelayedMessages", r.cachedSequencerMessage.afterDelayedMessages,
+		)
+		// leave the delayed messages the batch didn't read to the following batches
+		delayedMessagesRead := r.delayedMessagesRead
 		r.advanceSequencerMsg()
+		r.delayedMessagesRead = delayedMessagesRead
+		batchDone = true
 	} else {
 		r.advanceSubMsg()
 	}
@@ -330,53 +1394,329 @@ func (r *inboxMultiplexer) Pop(ctx context.Context) (*MessageWithMetadata, error
 			DelayedMessagesRead: r.delayedMessagesRead,
 		}
 	}
-	return msg, err
+	return msg, popInfo{segmentNum: segmentNum, seqMsgNum: seqMsgNum, batchDone: batchDone}, err
+}
+
+// The state getNextMsg advances, which is restored to undo it
+type segmentCursor struct {
+	segmentNum          uint64
+	timestamp           uint64
+	blockNumber         uint64
+	submessageNumber    uint64
+	delayedMessagesRead uint64
+}
+
+func (r *inboxMultiplexer) saveSegmentCursor() segmentCursor {
+	return segmentCursor{
+		segmentNum:          r.cachedSegmentNum,
+		timestamp:           r.cachedSegmentTimestamp,
+		blockNumber:         r.cachedSegmentBlockNumber,
+		submessageNumber:    r.cachedSubMessageNumber,
+		delayedMessagesRead: r.delayedMessagesRead,
+	}
+}
+
+func (r *inboxMultiplexer) restoreSegmentCursor(cursor segmentCursor) {
+	r.cachedSegmentNum = cursor.segmentNum
+	r.cachedSegmentTimestamp = cursor.timestamp
+	r.cachedSegmentBlockNumber = cursor.blockNumber
+	r.cachedSubMessageNumber = cursor.submessageNumber
+	r.delayedMessagesRead = cursor.delayedMessagesRead
+}
+
+// Pops up to max consecutive delayed messages, or fewer if the config's MaxDelayedPerPop is lower.
+// Stops before the first message that doesn't read a delayed message, including virtual delayed messages
+// past afterDelayedMessages, and after the last message of the current sequencer message.
+func (r *inboxMultiplexer) PopBatchOfDelayed(ctx context.Context, max int) ([]*MessageWithMetadata, error) {
+	if r.config.MaxDelayedPerPop > 0 && max > r.config.MaxDelayedPerPop {
+		max = r.config.MaxDelayedPerPop
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var msgs []*MessageWithMetadata
+	for len(msgs) < max {
+		skipped, err := r.cacheSequencerMessage(ctx)
+		if err != nil {
+			return msgs, err
+		}
+		if skipped != nil {
+			break
+		}
+		cursor := r.saveSegmentCursor()
+		seqMsgNum := r.cachedSequencerMessageNum
+		r.deferObservers = true
+		msg, segmentNum, err := r.getNextMsg(ctx)
+		r.deferObservers = false
+		observers := r.deferredObservers
+		r.deferredObservers = nil
+		if err != nil || r.delayedMessagesRead == cursor.delayedMessagesRead {
+			r.restoreSegmentCursor(cursor)
+			if err != nil && ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return msgs, err
+		}
+		for _, observer := range observers {
+			observer()
+		}
+		msg, info, err := r.advancePastMsg(msg, segmentNum, seqMsgNum, nil)
+		if err != nil {
+			return msgs, err
+		}
+		r.recordStats(msg, info, cursor.delayedMessagesRead)
+		msgs = append(msgs, msg)
+		if info.batchDone {
+			break
+		}
+	}
+	return msgs, nil
+}
+
+// Returns the message the next Pop would, without advancing.
+// Delayed messages are still read from the backend, but delayedMessagesRead is left unchanged.
+func (r *inboxMultiplexer) Peek(ctx context.Context) (*MessageWithMetadata, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	skipped, err := r.cacheSequencerMessage(ctx)
+	if err != nil || skipped != nil {
+		return skipped, err
+	}
+	cursor := r.saveSegmentCursor()
+	msg, _, err := r.getNextMsg(ctx)
+	if msg == nil && err == nil {
+		msg = &MessageWithMetadata{
+			Message:             InvalidL1Message,
+			DelayedMessagesRead: r.delayedMessagesRead,
+		}
+	}
+	r.restoreSegmentCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Returns an iterator over the remaining messages of the current sequencer message, reading it from the backend if needed.
+// The iterator reports false once the batch is exhausted, and never reads the following batch,
+// so Pop may be used afterwards to continue with it.
+func (r *inboxMultiplexer) MessagesInCurrentBatch(ctx context.Context) (func() (*MessageWithMetadata, bool, error), error) {
+	r.mutex.Lock()
+	_, err := r.cacheSequencerMessage(ctx)
+	r.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	done := false
+	return func() (*MessageWithMetadata, bool, error) {
+		if done {
+			return nil, false, nil
+		}
+		// a batch without an L1 header is popped as its single invalid message, ending the batch
+		msg, info, err := r.pop(ctx)
+		done = info.batchDone
+		if err != nil {
+			return nil, false, err
+		}
+		return msg, true, nil
+	}, nil
 }
 
 func (r *inboxMultiplexer) advanceSequencerMsg() {
 	if r.cachedSequencerMessage != nil {
-		r.delayedMessagesRead = r.cachedSequencerMessage.afterDelayedMessages
+		r.delayedMessagesRead = r.delayedMessagesReadAfter(r.cachedSequencerMessage)
 	}
+	oldNum := r.backend.GetSequencerInboxPosition()
 	r.backend.SetPositionWithinMessage(0)
 	r.backend.AdvanceSequencerInbox()
+	if r.config.BatchAdvanceObserver != nil {
+		r.config.BatchAdvanceObserver(oldNum, r.backend.GetSequencerInboxPosition(), r.delayedMessagesRead)
+	}
 	r.cachedSequencerMessage = nil
+	r.cachedLastContentSegment = -1
+	r.prefetchedDelayed = nil
+	r.cachedSegmentNum = 0
+	r.cachedSegmentTimestamp = 0
+	r.cachedSegmentBlockNumber = 0
+	r.cachedSubMessageNumber = 0
+}
+
+// Skips to the start of sequencer message sequencerMessageNum, discarding the rest of the current one.
+// Only the headers of skipped sequencer messages are read, to track their afterDelayedMessages,
+// unless the config sets MaxVirtualDelayedMessages, where the delayed messages a batch reads depend on its segments.
+// Like Pop, a Strict config stops at a skipped batch whose afterDelayedMessages is below the delayed messages read.
+func (r *inboxMultiplexer) AdvanceToBatch(ctx context.Context, sequencerMessageNum uint64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if position := r.backend.GetSequencerInboxPosition(); position > sequencerMessageNum {
+		return fmt.Errorf("can't advance to sequencer message %v from %v", sequencerMessageNum, position)
+	}
+	for r.backend.GetSequencerInboxPosition() < sequencerMessageNum {
+		if r.config.MaxVirtualDelayedMessages != 0 {
+			skipped, err := r.cacheSequencerMessage(ctx)
+			if err != nil {
+				return err
+			}
+			if skipped == nil {
+				// count the rest of the batch's delayed messages as Pop would read them, up to the limit
+				seqMsg := r.cachedSequencerMessage
+				_, delayed := r.countRemainingInBatch()
+				delayedMessagesRead := r.delayedMessagesRead + uint64(delayed)
+				r.advanceSequencerMsg()
+				if delayedMessagesRead < seqMsg.afterDelayedMessages {
+					// the limit ended the batch, leaving its other delayed messages to the following batches
+					r.delayedMessagesRead = delayedMessagesRead
+				}
+				continue
+			}
+		} else if r.cachedSequencerMessage == nil {
+			data, err := r.peekSequencerInbox(ctx)
+			if err != nil {
+				return err
+			}
+			// sequencer messages without a header don't change the delayed messages read
+			if len(data) >= 40 {
+				afterDelayedMessages := binary.BigEndian.Uint64(data[32:40])
+				if err := r.checkDelayedRegression(r.backend.GetSequencerInboxPosition(), afterDelayedMessages); err != nil {
+					return err
+				}
+				r.delayedMessagesRead = r.delayedMessagesReadAfter(&sequencerMessage{afterDelayedMessages: afterDelayedMessages})
+			}
+		}
+		r.advanceSequencerMsg()
+	}
+	return nil
+}
+
+// Moves to message pos of the current sequencer message, reading it from the backend if needed, so the next Pop returns it.
+// pos must be a message Pop reaches, at most the number of messages produced up to the batch's last message segment,
+// where the virtual delayed messages start.
+func (r *inboxMultiplexer) SeekSubMessage(ctx context.Context, pos uint64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	skipped, err := r.cacheSequencerMessage(ctx)
+	if err != nil {
+		return err
+	}
+	if skipped != nil {
+		return fmt.Errorf("can't seek within sequencer message %v, which has no L1 header", r.backend.GetSequencerInboxPosition())
+	}
+	seqMsg := r.cachedSequencerMessage
+	// segments after the last message segment are only reached while delayed messages remain, which the total accounts for
+	segmentMessages := uint64(0)
+	for segmentNum := 0; segmentNum <= r.cachedLastContentSegment; segmentNum++ {
+		segment := seqMsg.segments[segmentNum]
+		if len(segment) != 0 && segment[0] != BatchSegmentKindAdvanceTimestamp && segment[0] != BatchSegmentKindAdvanceL1BlockNumber {
+			segmentMessages++
+		}
+	}
+	l2, delayed := countMessagesFrom(seqMsg, 0, r.cachedStartDelayedRead, r.cachedLastContentSegment, r.config.MaxVirtualDelayedMessages)
+	if pos > segmentMessages || pos >= uint64(l2+delayed) {
+		return fmt.Errorf(
+			"can't seek to message %v of sequencer message %v, whose segments have %v of its %v messages",
+			pos, r.cachedSequencerMessageNum, segmentMessages, l2+delayed,
+		)
+	}
+	r.backend.SetPositionWithinMessage(pos)
+	r.rewindCachedSegments(pos)
+	return nil
+}
+
+// The delayed messages read once seqMsg is done, according to the config's DelayedOverrun strategy
+func (r *inboxMultiplexer) delayedMessagesReadAfter(seqMsg *sequencerMessage) uint64 {
+	if r.config.DelayedOverrun == DelayedOverrunClamp && seqMsg.afterDelayedMessages < r.delayedMessagesRead {
+		return r.delayedMessagesRead
+	}
+	return seqMsg.afterDelayedMessages
+}
+
+// Resets the cached segment accumulators to the start of the batch, so getNextMsg scans it again up to targetSubMessage,
+// and returns the delayed messages read to what they were before that message
+func (r *inboxMultiplexer) rewindCachedSegments(targetSubMessage uint64) {
+	r.delayedMessagesRead = delayedMessagesReadBefore(r.cachedSequencerMessage, targetSubMessage, r.cachedStartDelayedRead)
 	r.cachedSegmentNum = 0
 	r.cachedSegmentTimestamp = 0
 	r.cachedSegmentBlockNumber = 0
 	r.cachedSubMessageNumber = 0
 }
 
+// Returns the delayed messages read once the first targetSubMessage messages of seqMsg are popped,
+// starting at startDelayed, walking the segments the way getNextMsg does
+func delayedMessagesReadBefore(seqMsg *sequencerMessage, targetSubMessage uint64, startDelayed uint64) uint64 {
+	delayedMessagesRead := startDelayed
+	submessageNumber := uint64(0)
+	for segmentNum := 0; submessageNumber < targetSubMessage; segmentNum++ {
+		// past the last segment there are only virtual delayed messages
+		isDelayed := segmentNum >= len(seqMsg.segments)
+		if !isDelayed {
+			segment := seqMsg.segments[segmentNum]
+			if len(segment) == 0 || segment[0] == BatchSegmentKindAdvanceTimestamp || segment[0] == BatchSegmentKindAdvanceL1BlockNumber {
+				continue
+			}
+			isDelayed = segment[0] == BatchSegmentKindDelayedMessages
+		}
+		if isDelayed && delayedMessagesRead < seqMsg.afterDelayedMessages {
+			delayedMessagesRead++
+		}
+		submessageNumber++
+	}
+	return delayedMessagesRead
+}
+
 func (r *inboxMultiplexer) advanceSubMsg() {
 	prevPos := r.backend.GetPositionWithinMessage()
 	r.backend.SetPositionWithinMessage(prevPos + 1)
 }
 
+// Once a batch's segments run out, each further message is a delayed message read as if by this segment,
+// until the batch's afterDelayedMessages is reached
+func virtualTrailingDelayedSegment() []byte {
+	return []byte{BatchSegmentKindDelayedMessages}
+}
+
+// Reports whether the message getNextMsg just returned was the last virtual delayed message MaxVirtualDelayedMessages allows
+func (r *inboxMultiplexer) virtualDelayedLimitReached() bool {
+	if r.config.MaxVirtualDelayedMessages == 0 || r.cachedSegmentNum < uint64(len(r.cachedSequencerMessage.segments)) {
+		return false
+	}
+	// getNextMsg stops counting submessages at the end of the segments, so the rest of the position counts virtual messages
+	virtualRead := r.backend.GetPositionWithinMessage() - r.cachedSubMessageNumber + 1
+	return virtualRead >= r.config.MaxVirtualDelayedMessages
+}
+
 func (r *inboxMultiplexer) IsCachedSegementLast() bool {
 	seqMsg := r.cachedSequencerMessage
 	// we issue delayed messages until reaching afterDelayedMessages
 	if r.delayedMessagesRead < seqMsg.afterDelayedMessages {
 		return false
 	}
-	for segmentNum := int(r.cachedSegmentNum) + 1; segmentNum < len(seqMsg.segments); segmentNum++ {
-		segment := seqMsg.segments[segmentNum]
-		if len(segment) == 0 {
-			continue
-		}
-		kind := segment[0]
-		if kind == BatchSegmentKindL2Message || kind == BatchSegmentKindL2MessageBrotli {
-			return false
-		}
-		if kind == BatchSegmentKindDelayedMessages {
-			return false
+	return r.cachedLastContentSegment < 0 || uint64(r.cachedLastContentSegment) <= r.cachedSegmentNum
+}
+
+// Returns the index of the last segment that produces messages, or -1 if no segment does
+func lastContentSegment(segments [][]byte, zstdSegments bool) int {
+	for segmentNum := len(segments) - 1; segmentNum >= 0; segmentNum-- {
+		segment := segments[segmentNum]
+		if len(segment) != 0 && isMessageSegmentKind(segment[0], zstdSegments) {
+			return segmentNum
 		}
 	}
-	return true
+	return -1
 }
 
 // Returns a message, the segment number that had this message, and real/backend errors
-// parsing errors will be reported to log, return nil msg and nil error
-func (r *inboxMultiplexer) getNextMsg() (*MessageWithMetadata, error) {
+// parsing errors will be reported to log, return nil msg and nil error, or a strictError in strict mode
+func (r *inboxMultiplexer) getNextMsg(ctx context.Context) (*MessageWithMetadata, uint64, error) {
+	r.lastSegmentDecompressed = 0
 	targetSubMessage := r.backend.GetPositionWithinMessage()
+	if targetSubMessage < r.cachedSubMessageNumber {
+		log.Warn(
+			"inbox backend position rewound within sequencer message",
+			"sequencerMessageNum", r.cachedSequencerMessageNum,
+			"position", targetSubMessage,
+			"cachedSubMessageNumber", r.cachedSubMessageNumber,
+		)
+		r.rewindCachedSegments(targetSubMessage)
+	}
 	seqMsg := r.cachedSequencerMessage
 	segmentNum := r.cachedSegmentNum
 	timestamp := r.cachedSegmentTimestamp
@@ -394,17 +1734,30 @@ func (r *inboxMultiplexer) getNextMsg() (*MessageWithMetadata, error) {
 		}
 		segmentKind := segment[0]
 		if segmentKind == BatchSegmentKindAdvanceTimestamp || segmentKind == BatchSegmentKindAdvanceL1BlockNumber {
-			rd := bytes.NewReader(segment[1:])
-			advancing, err := rlp.NewStream(rd, 16).Uint64()
+			if len(segment) == 2 && segment[1] == zeroAdvanceEncoding {
+				segmentNum++
+				continue
+			}
+			rd := &r.advanceReader
+			rd.Reset(segment[1:])
+			r.advanceStream.Reset(rd, 16)
+			advancing, err := r.advanceStream.Uint64()
 			if err != nil {
 				log.Warn("error parsing sequencer advancing segment", "err", err)
+				segmentParseErrorCounter.Inc(1)
+				segmentNum++
+				continue
+			}
+			if rd.Len() != 0 && r.config.RejectAdvanceTrailingBytes {
+				log.Warn("sequencer advancing segment has trailing bytes", "segmentNum", segmentNum, "trailing", rd.Len())
+				segmentParseErrorCounter.Inc(1)
 				segmentNum++
 				continue
 			}
 			if segmentKind == BatchSegmentKindAdvanceTimestamp {
-				timestamp += advancing
+				timestamp = r.addAdvance(timestamp, advancing)
 			} else if segmentKind == BatchSegmentKindAdvanceL1BlockNumber {
-				blockNumber += advancing
+				blockNumber = r.addAdvance(blockNumber, advancing)
 			}
 			segmentNum++
 		} else if submessageNumber < targetSubMessage {
@@ -418,56 +1771,95 @@ func (r *inboxMultiplexer) getNextMsg() (*MessageWithMetadata, error) {
 	r.cachedSegmentTimestamp = timestamp
 	r.cachedSegmentBlockNumber = blockNumber
 	r.cachedSubMessageNumber = submessageNumber
-	if timestamp < seqMsg.minTimestamp {
-		timestamp = seqMsg.minTimestamp
-	} else if timestamp > seqMsg.maxTimestamp {
-		timestamp = seqMsg.maxTimestamp
-	}
-	if blockNumber < seqMsg.minL1Block {
-		blockNumber = seqMsg.minL1Block
-	} else if blockNumber > seqMsg.maxL1Block {
-		blockNumber = seqMsg.maxL1Block
-	}
+	timestamp = clampToRange(timestamp, seqMsg.minTimestamp, seqMsg.maxTimestamp)
+	blockNumber = clampToRange(blockNumber, seqMsg.minL1Block, seqMsg.maxL1Block)
 	if segmentNum >= uint64(len(seqMsg.segments)) {
-		// after end of batch there might be "virtual" delayedMsgSegments
 		log.Warn("reading virtual delayed message segment", "delayedMessagesRead", r.delayedMessagesRead, "afterDelayedMessages", seqMsg.afterDelayedMessages)
-		segment = []byte{BatchSegmentKindDelayedMessages}
+		segment = virtualTrailingDelayedSegment()
 	} else {
 		segment = seqMsg.segments[int(segmentNum)]
 	}
+	// the loop above skips empty segments, so this is only reached if that invariant is broken
 	if len(segment) == 0 {
 		log.Error("empty sequencer message segment", "sequence", r.cachedSegmentNum, "segmentNum", segmentNum)
-		return nil, nil
+		return nil, segmentNum, r.strictError("segment %v is empty", segmentNum)
 	}
 	kind := segment[0]
 	segment = segment[1:]
 	var msg *MessageWithMetadata
-	if kind == BatchSegmentKindL2Message || kind == BatchSegmentKindL2MessageBrotli {
+	isZstd := kind == BatchSegmentKindL2MessageZstd && r.config.ZstdSegments
+	if kind == BatchSegmentKindL2Message || kind == BatchSegmentKindL2MessageBrotli || isZstd {
 
+		if isZstd {
+			endSpan := r.startSpan(SpanDecompressZstd)
+			decompressed, err := decompressZstd(segment, r.config.MaxZstdL2MessageSize)
+			endSpan()
+			if err != nil {
+				log.Info(
+					"dropping zstd compressed message",
+					"err", err,
+					"delayedMsg", r.delayedMessagesRead,
+					"seqNum", r.cachedSequencerMessageNum,
+					"segmentNum", segmentNum,
+					"compressedLen", len(segment),
+				)
+				segmentZstdDroppedCounter.Inc(1)
+				r.reportDroppedSegment(segmentNum, kind, len(segment), err)
+				return nil, segmentNum, r.strictError("segment %v failed zstd decompression: %v", segmentNum, err)
+			}
+			r.lastSegmentDecompressed = uint64(len(decompressed))
+			segment = decompressed
+		}
 		if kind == BatchSegmentKindL2MessageBrotli {
-			decompressed, err := arbcompress.Decompress(segment, arbos.MaxL2MessageSize)
+			// An L2MessageBrotli segment is the kind byte followed directly by the brotli stream, with no inner flag byte.
+			// Anything prepended to the stream makes it fail to decompress, which drops the message below.
+			// Decompress errors, rather than truncating, if the message is over the limit, so oversized messages are dropped too.
+			endSpan := r.startSpan(SpanDecompressBrotli)
+			decompressed, err := arbcompress.Decompress(segment, int(r.config.MaxL2MessageSize))
+			endSpan()
 			if err != nil {
-				log.Info("dropping compressed message", "err", err, "delayedMsg", r.delayedMessagesRead)
-				return nil, nil
+				log.Info(
+					"dropping compressed message",
+					"err", err,
+					"delayedMsg", r.delayedMessagesRead,
+					"seqNum", r.cachedSequencerMessageNum,
+					"segmentNum", segmentNum,
+					"compressedLen", len(segment),
+				)
+				segmentBrotliDroppedCounter.Inc(1)
+				r.reportDroppedSegment(segmentNum, kind, len(segment), err)
+				return nil, segmentNum, r.strictError("segment %v failed brotli decompression: %v", segmentNum, err)
 			}
+			segmentBrotliDecompressedHistogram.Update(int64(len(decompressed)))
+			r.lastSegmentDecompressed = uint64(len(decompressed))
 			segment = decompressed
 		}
+		r.observeSegment(segmentNum, kind, segment)
+		if r.config.CopyPayload {
+			segment = append([]byte{}, segment...)
+		}
 
+		var requestId *common.Hash
+		if r.config.SequencerRequestIds {
+			id := sequencerRequestId(r.cachedSequencerMessageNum, segmentNum)
+			requestId = &id
+		}
 		msg = &MessageWithMetadata{
 			Message: &arbos.L1IncomingMessage{
 				Header: &arbos.L1IncomingMessageHeader{
 					Kind:        arbos.L1MessageType_L2Message,
-					Poster:      l1pricing.BatchPosterAddress,
+					Poster:      r.config.SequencerAddress,
 					BlockNumber: blockNumber,
 					Timestamp:   timestamp,
-					RequestId:   nil,
-					L1BaseFee:   big.NewInt(0),
+					RequestId:   requestId,
+					L1BaseFee:   r.l1BaseFee(),
 				},
 				L2msg: segment,
 			},
 			DelayedMessagesRead: r.delayedMessagesRead,
 		}
 	} else if kind == BatchSegmentKindDelayedMessages {
+		r.observeSegment(segmentNum, kind, segment)
 		if r.delayedMessagesRead >= seqMsg.afterDelayedMessages {
 			if segmentNum < uint64(len(seqMsg.segments)) {
 				log.Warn(
@@ -475,34 +1867,244 @@ func (r *inboxMultiplexer) getNextMsg() (*MessageWithMetadata, error) {
 					"delayedMessagesRead", r.delayedMessagesRead,
 					"batchAfterDelayedMessages", seqMsg.afterDelayedMessages,
 				)
+				if r.config.Strict {
+					return nil, segmentNum, r.strictError("segment %v reads past afterDelayedMessages %v", segmentNum, seqMsg.afterDelayedMessages)
+				}
 			}
 			msg = &MessageWithMetadata{
 				Message:             InvalidL1Message,
-				DelayedMessagesRead: seqMsg.afterDelayedMessages,
+				DelayedMessagesRead: r.delayedMessagesReadAfter(seqMsg),
 			}
 		} else {
-			data, realErr := r.backend.ReadDelayedInbox(r.delayedMessagesRead)
-			if realErr != nil {
-				return nil, realErr
+			seqNum := r.delayedMessagesRead
+			delayed, cached := r.delayedMessageCache.Get(seqNum)
+			if !cached {
+				data, realErr := r.readDelayedInbox(ctx, seqNum)
+				if realErr != nil {
+					return nil, segmentNum, realErr
+				}
+				var parseErr error
+				delayed, parseErr = r.parseDelayed(data)
+				if parseErr != nil {
+					r.delayedMessagesRead += 1
+					log.Warn("error parsing delayed message", "err", parseErr, "delayedMsg", r.delayedMessagesRead)
+					return nil, segmentNum, r.strictError("delayed message %v failed to parse: %v", seqNum, parseErr)
+				}
+				r.delayedMessageCache.Add(seqNum, delayed)
 			}
 			r.delayedMessagesRead += 1
-			delayed, parseErr := arbos.ParseIncomingL1Message(bytes.NewReader(data))
-			if parseErr != nil {
-				log.Warn("error parsing delayed message", "err", parseErr, "delayedMsg", r.delayedMessagesRead)
-				return nil, nil
-			}
 			msg = &MessageWithMetadata{
 				Message:             delayed,
 				DelayedMessagesRead: r.delayedMessagesRead,
 			}
 		}
 	} else {
-		log.Error("bad sequencer message segment kind", "sequence", r.cachedSegmentNum, "segmentNum", segmentNum, "kind", kind)
-		return nil, nil
+		r.observeSegment(segmentNum, kind, segment)
+		var handled *MessageWithMetadata
+		var ok bool
+		if r.config.UnknownSegmentHandler != nil {
+			handled, ok = r.config.UnknownSegmentHandler(kind, segment)
+		}
+		if !ok || handled == nil || handled.Message == nil {
+			log.Error("bad sequencer message segment kind", "sequence", r.cachedSegmentNum, "segmentNum", segmentNum, "kind", kind)
+			return nil, segmentNum, r.strictError("segment %v has unknown kind %v", segmentNum, kind)
+		}
+		msg = &MessageWithMetadata{
+			Message:             handled.Message,
+			DelayedMessagesRead: r.delayedMessagesRead,
+		}
 	}
-	return msg, nil
+	if msg != nil {
+		log.Trace(
+			"read sequencer message segment",
+			"sequencerMessageNum", r.cachedSequencerMessageNum,
+			"segmentNum", segmentNum,
+			"segmentKind", kind,
+			"messageKind", msg.Message.Header.Kind,
+		)
+	}
+	return msg, segmentNum, nil
+}
+
+// In strict mode, returns the error describing why the current sequencer message is invalid, otherwise nil
+func (r *inboxMultiplexer) strictError(format string, args ...interface{}) error {
+	if !r.config.Strict {
+		return nil
+	}
+	return errors.Wrapf(ErrInvalidSequencerMessage, "sequencer message %v: "+format, append([]interface{}{r.cachedSequencerMessageNum}, args...)...)
+}
+
+func (r *inboxMultiplexer) observeSegment(segmentNum uint64, kind uint8, payload []byte) {
+	if r.config.SegmentObserver == nil || segmentNum >= uint64(len(r.cachedSequencerMessage.segments)) {
+		return
+	}
+	r.notifyObserver(func() {
+		r.config.SegmentObserver(int(segmentNum), kind, payload)
+	})
+}
+
+// Calls the observer now, or once PopBatchOfDelayed keeps the message it's looking ahead at
+func (r *inboxMultiplexer) notifyObserver(observer func()) {
+	if r.deferObservers {
+		r.deferredObservers = append(r.deferredObservers, observer)
+		return
+	}
+	observer()
+}
+
+// Records the batch's hash, reporting whether a different recent sequencer message had the same contents
+func (r *inboxMultiplexer) isDuplicateBatch(data []byte, seqMsgNum uint64) bool {
+	if r.config.RecentBatchHashes <= 0 {
+		return false
+	}
+	hash := BatchHash(data)
+	previous, seen := r.recentBatches.Get(hash)
+	r.recentBatches.Add(hash, seqMsgNum)
+	if !seen || previous == seqMsgNum {
+		return false
+	}
+	log.Warn(
+		"sequencer message duplicates a recent one",
+		"sequencerMessageNum", seqMsgNum,
+		"duplicateOf", previous,
+		"hash", hash,
+		"dropping", r.config.DropDuplicateBatches,
+	)
+	batchDuplicateCounter.Inc(1)
+	return true
+}
+
+func (r *inboxMultiplexer) startSpan(name string) func() {
+	if r.config.Tracer == nil {
+		return func() {}
+	}
+	return r.config.Tracer.StartSpan(name)
+}
+
+func (r *inboxMultiplexer) l1BaseFee() *big.Int {
+	if r.config.BaseFeeProvider == nil {
+		return big.NewInt(0)
+	}
+	baseFee := r.config.BaseFeeProvider(r.cachedSequencerMessage.minL1Block)
+	if baseFee == nil {
+		return big.NewInt(0)
+	}
+	// copied so the provider's value can't be modified through the message
+	return new(big.Int).Set(baseFee)
+}
+
+func (r *inboxMultiplexer) reportDroppedSegment(segmentNum uint64, kind uint8, compressedLen int, err error) {
+	if r.config.DroppedSegmentObserver == nil {
+		return
+	}
+	dropped := DroppedSegment{
+		SequencerMessageNum: r.cachedSequencerMessageNum,
+		SegmentNum:          segmentNum,
+		Kind:                kind,
+		CompressedLen:       compressedLen,
+		Reason:              err.Error(),
+	}
+	r.notifyObserver(func() {
+		r.config.DroppedSegmentObserver(dropped)
+	})
+}
+
+// Clamps a segment's accumulated timestamp or block number to the batch's range.
+// An inverted range, with min above max, is treated as the single point min.
+func clampToRange(value uint64, min uint64, max uint64) uint64 {
+	if value < min || min > max {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
 }
 
 func (r *inboxMultiplexer) DelayedMessagesRead() uint64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
 	return r.delayedMessagesRead
 }
+
+func (r *inboxMultiplexer) Stats() MultiplexerStats {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.stats
+}
+
+func (r *inboxMultiplexer) ResetStats() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stats = MultiplexerStats{}
+}
+
+func (r *inboxMultiplexer) CursorState() MultiplexerCursorState {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return MultiplexerCursorState{
+		SequencerMessageNum: r.cachedSequencerMessageNum,
+		SegmentNum:          r.cachedSegmentNum,
+		SubMessageNumber:    r.cachedSubMessageNumber,
+		SegmentTimestamp:    r.cachedSegmentTimestamp,
+		SegmentBlockNumber:  r.cachedSegmentBlockNumber,
+		DelayedMessagesRead: r.delayedMessagesRead,
+	}
+}
+
+// Returns how many more messages the cached batch produces, and false if no batch is cached,
+// as before the first Peek or Pop of a batch.
+// The count is only an estimate when a malformed segment or delayed message stops a Pop in Strict mode.
+func (r *inboxMultiplexer) RemainingInBatch() (int, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.cachedSequencerMessage == nil {
+		return 0, false
+	}
+	l2, delayed := r.countRemainingInBatch()
+	return l2 + delayed, true
+}
+
+// Counts the L2 and delayed messages the cached batch produces from the backend's position within it
+func (r *inboxMultiplexer) countRemainingInBatch() (l2 int, delayed int) {
+	seqMsg := r.cachedSequencerMessage
+	// find the segment of the next message like getNextMsg does, skipping the messages already popped
+	targetSubMessage := r.backend.GetPositionWithinMessage()
+	segmentNum := r.cachedSegmentNum
+	submessageNumber := r.cachedSubMessageNumber
+	for segmentNum < uint64(len(seqMsg.segments)) && submessageNumber < targetSubMessage {
+		segment := seqMsg.segments[segmentNum]
+		if len(segment) != 0 && segment[0] != BatchSegmentKindAdvanceTimestamp && segment[0] != BatchSegmentKindAdvanceL1BlockNumber {
+			submessageNumber++
+		}
+		segmentNum++
+	}
+	maxVirtualDelayed := r.config.MaxVirtualDelayedMessages
+	if maxVirtualDelayed != 0 && segmentNum >= uint64(len(seqMsg.segments)) {
+		if virtualRead := targetSubMessage - submessageNumber; virtualRead < maxVirtualDelayed {
+			maxVirtualDelayed -= virtualRead
+		} else {
+			return 0, 0
+		}
+	}
+	return countMessagesFrom(seqMsg, int(segmentNum), r.delayedMessagesRead, r.cachedLastContentSegment, maxVirtualDelayed)
+}
+
+// Discards the cached sequencer message, prefetched batches and delayed messages and restarts from delayedMessagesRead, as if newly constructed.
+// Parsed batches are kept, as they don't depend on the multiplexer's position.
+// The backend is left untouched, so its positions should be reset alongside this.
+func (r *inboxMultiplexer) Reset(delayedMessagesRead uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.delayedMessagesRead = delayedMessagesRead
+	r.delayedMessageCache.Clear()
+	r.cachedSequencerMessage = nil
+	r.cachedSequencerMessageNum = 0
+	r.cachedLastContentSegment = -1
+	r.prefetchedDelayed = nil
+	r.prefetchedBatches = nil
+	r.cachedSegmentNum = 0
+	r.cachedSegmentTimestamp = 0
+	r.cachedSegmentBlockNumber = 0
+	r.cachedSubMessageNumber = 0
+}
@@ -0,0 +1,121 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// Benchmarks of popping every message of a representative batch, where each message follows an advance timestamp segment.
+// Run with `go test -bench BenchmarkPop -run - ./arbstate` and compare allocs/op before and after a change.
+// As a rough baseline, each takes on the order of 1ms per batch, with on the order of 10 allocations per L2 or delayed message
+// and a few MB allocated per brotli batch, which is dominated by decompression.
+
+func benchmarkPopBatch(b *testing.B, batch []byte, delayedMessages [][]byte) {
+	b.Helper()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		multiplexer := NewInboxMultiplexer(NewMemoryInboxBackend([][]byte{batch}, delayedMessages), 0, nil, KeysetValidate)
+		for {
+			_, info, err := multiplexer.PopWithInfo(context.Background())
+			if err != nil {
+				b.Fatal(err)
+			}
+			if info.CrossedBatchBoundary {
+				break
+			}
+		}
+	}
+}
+
+func buildBenchmarkBatch(b *testing.B, afterDelayedMessages uint64, addMessage func(builder *BatchBuilder) error, count int) []byte {
+	b.Helper()
+	builder := NewBatchBuilder()
+	for i := 0; i < count; i++ {
+		if err := builder.AdvanceTimestamp(1); err != nil {
+			b.Fatal(err)
+		}
+		if err := addMessage(builder); err != nil {
+			b.Fatal(err)
+		}
+	}
+	batch, err := builder.Build(0, uint64(count), 0, 0, afterDelayedMessages)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return batch
+}
+
+func BenchmarkPopL2Messages(b *testing.B) {
+	message := bytes.Repeat([]byte{1}, 200)
+	batch := buildBenchmarkBatch(b, 0, func(builder *BatchBuilder) error {
+		builder.AddL2Message(message)
+		return nil
+	}, 200)
+	benchmarkPopBatch(b, batch, nil)
+}
+
+func BenchmarkPopBrotliMessages(b *testing.B) {
+	benchmarkPopBatch(b, buildBenchmarkBrotliBatch(b), nil)
+}
+
+func BenchmarkPopDelayedMessages(b *testing.B) {
+	const count = 100
+	batch := buildBenchmarkBatch(b, count, func(builder *BatchBuilder) error {
+		builder.AddDelayedMessages(1)
+		return nil
+	}, count)
+	var delayedMessages [][]byte
+	for i := 0; i < count; i++ {
+		delayedMessages = append(delayedMessages, encodeTestDelayedMessage(b, uint64(i)))
+	}
+	benchmarkPopBatch(b, batch, delayedMessages)
+}
+
+// Mostly advance segments, as in a batch that keeps the timestamp of each message up to date
+func BenchmarkPopAdvanceSegments(b *testing.B) {
+	batch := buildBenchmarkBatch(b, 0, func(builder *BatchBuilder) error {
+		if err := builder.AdvanceL1BlockNumber(1); err != nil {
+			return err
+		}
+		builder.AddL2Message([]byte{1})
+		return nil
+	}, 100)
+	benchmarkPopBatch(b, batch, nil)
+}
+
+// CountMessages walks the segments without decompressing L2 messages, so compare it to BenchmarkDecodeBrotliMessages
+// when changing either, and keep it free of decompression.
+func BenchmarkCountBrotliMessages(b *testing.B) {
+	batch := buildBenchmarkBrotliBatch(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := CountMessages(batch, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeBrotliMessages(b *testing.B) {
+	batch := buildBenchmarkBrotliBatch(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeBatch(batch, 0, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func buildBenchmarkBrotliBatch(b *testing.B) []byte {
+	b.Helper()
+	message := bytes.Repeat([]byte("brotli compressed l2 message "), 32)
+	return buildBenchmarkBatch(b, 0, func(builder *BatchBuilder) error {
+		return builder.AddL2MessageBrotli(message)
+	}, 50)
+}
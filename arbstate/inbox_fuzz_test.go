@@ -64,3 +64,64 @@ func FuzzInboxMultiplexer(f *testing.F) {
 		}
 	})
 }
+
+func FuzzParseSequencerMessage(f *testing.F) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte("l2 message"))
+	if err := builder.AddL2MessageBrotli([]byte("compressed l2 message")); err != nil {
+		f.Fatal(err)
+	}
+	builder.AddDelayedMessages(1)
+	if err := builder.AdvanceTimestamp(10); err != nil {
+		f.Fatal(err)
+	}
+	if err := builder.AdvanceL1BlockNumber(10); err != nil {
+		f.Fatal(err)
+	}
+	valid, err := builder.Build(0, 100, 0, 100, 1)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(valid)
+	f.Add(valid[:len(valid)/2])
+	f.Add(valid[:41])
+	f.Add(valid[:40])
+	f.Add(valid[:39])
+	for _, headerByte := range []byte{1, 2, ZeroheavyMessageHeaderFlag, 0xff} {
+		variant := append([]byte{}, valid...)
+		variant[40] = headerByte
+		f.Add(variant)
+	}
+	delayedMessage := make([]byte, 1+32+8+8+32+32)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parsed, err := parseSequencerMessage(context.Background(), 0, data, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+		if len(data) < 40 {
+			if !errors.Is(err, ErrSequencerMessageMissingL1Header) {
+				t.Fatal("unexpected error for short batch", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for _, segment := range parsed.segments {
+			total += len(segment)
+		}
+		if total > maxDecompressedLen {
+			t.Fatal("segments total", total, "bytes, above the decompression limit")
+		}
+
+		backend := NewMemoryInboxBackend([][]byte{data}, [][]byte{delayedMessage})
+		multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+		for i := 0; i <= len(parsed.segments)+1 && backend.GetSequencerInboxPosition() == 0; i++ {
+			if _, err := multiplexer.Pop(context.Background()); err != nil {
+				// the batch referenced a delayed message the backend doesn't have
+				return
+			}
+		}
+		if backend.GetSequencerInboxPosition() == 0 {
+			t.Fatal("multiplexer didn't finish the batch")
+		}
+	})
+}
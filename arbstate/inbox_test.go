@@ -0,0 +1,3118 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/offchainlabs/nitro/arbcompress"
+	"github.com/offchainlabs/nitro/arbos"
+	"github.com/offchainlabs/nitro/arbos/l1pricing"
+)
+
+func encodeTestBatch(t *testing.T, minTimestamp, maxTimestamp, minL1Block, maxL1Block, afterDelayedMessages uint64, segments ...[]byte) []byte {
+	t.Helper()
+	msg := &sequencerMessage{
+		minTimestamp:         minTimestamp,
+		maxTimestamp:         maxTimestamp,
+		minL1Block:           minL1Block,
+		maxL1Block:           maxL1Block,
+		afterDelayedMessages: afterDelayedMessages,
+		segments:             segments,
+	}
+	data, err := msg.encode()
+	Require(t, err)
+	return data
+}
+
+func encodeTestDelayedMessage(t testing.TB, requestId uint64) []byte {
+	t.Helper()
+	id := common.BigToHash(new(big.Int).SetUint64(requestId))
+	msg := arbos.L1IncomingMessage{
+		Header: &arbos.L1IncomingMessageHeader{
+			Kind:      arbos.L1MessageType_EthDeposit,
+			RequestId: &id,
+			L1BaseFee: big.NewInt(0),
+		},
+		L2msg: []byte("deposit"),
+	}
+	data, err := msg.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestTruncatedSequencerMessageHeader(t *testing.T) {
+	for _, length := range []int{0, 8, 39} {
+		data := make([]byte, length)
+		_, err := parseSequencerMessage(context.Background(), 0, data, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+		if !errors.Is(err, ErrSequencerMessageMissingL1Header) {
+			Fail(t, "length", length, "unexpected parse error", err)
+		}
+
+		backend := &multiplexerBackend{
+			batchSeqNum: 0,
+			batch:       data,
+		}
+		multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err, "length", length)
+		if msg.Message.Header.Kind != arbos.L1MessageType_Invalid {
+			Fail(t, "length", length, "expected invalid message, got kind", msg.Message.Header.Kind)
+		}
+		if backend.batchSeqNum != 1 {
+			Fail(t, "length", length, "multiplexer didn't advance past truncated batch")
+		}
+		if multiplexer.DelayedMessagesRead() != 0 {
+			Fail(t, "length", length, "truncated batch changed delayed messages read")
+		}
+	}
+}
+
+type cancellingBackend struct {
+	multiplexerBackend
+	cancel context.CancelFunc
+}
+
+func (b *cancellingBackend) PeekSequencerInboxWithContext(ctx context.Context) ([]byte, error) {
+	return b.PeekSequencerInbox()
+}
+
+func (b *cancellingBackend) ReadDelayedInboxWithContext(ctx context.Context, seqNum uint64) ([]byte, error) {
+	if b.cancel != nil {
+		b.cancel()
+		b.cancel = nil
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return b.ReadDelayedInbox(seqNum)
+}
+
+func TestPopCancellation(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 100, 0, 100, 1, []byte{BatchSegmentKindDelayedMessages})
+	backend := &cancellingBackend{
+		multiplexerBackend: multiplexerBackend{
+			batch:          batch,
+			delayedMessage: encodeTestDelayedMessage(t, 0),
+		},
+	}
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := multiplexer.Pop(cancelled); !errors.Is(err, context.Canceled) {
+		Fail(t, "expected cancellation before backend read, got", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	backend.cancel = cancel
+	if _, err := multiplexer.Pop(ctx); !errors.Is(err, context.Canceled) {
+		Fail(t, "expected cancellation during delayed read, got", err)
+	}
+	if backend.batchSeqNum != 0 || backend.positionWithinMessage != 0 || multiplexer.DelayedMessagesRead() != 0 {
+		Fail(t, "cancelled pop advanced the multiplexer")
+	}
+
+	msg, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_EthDeposit || msg.DelayedMessagesRead != 1 {
+		Fail(t, "unexpected message after retry", msg.Message.Header.Kind, msg.DelayedMessagesRead)
+	}
+	if backend.batchSeqNum != 1 {
+		Fail(t, "multiplexer didn't advance past the batch after retry")
+	}
+}
+
+type slowDelayedBackend struct {
+	multiplexerBackend
+	delay time.Duration
+}
+
+func (b *slowDelayedBackend) ReadDelayedInboxWithContext(ctx context.Context, seqNum uint64) ([]byte, error) {
+	select {
+	case <-time.After(b.delay):
+		return b.ReadDelayedInbox(seqNum)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestDelayedReadTimeout(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 100, 0, 100, 1, []byte{BatchSegmentKindDelayedMessages})
+	backend := &slowDelayedBackend{
+		multiplexerBackend: multiplexerBackend{
+			batch:          batch,
+			delayedMessage: encodeTestDelayedMessage(t, 0),
+		},
+		delay: time.Minute,
+	}
+	config := DefaultInboxMultiplexerConfig
+	config.DelayedReadTimeout = 10 * time.Millisecond
+	multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+
+	_, err := multiplexer.Pop(context.Background())
+	if !errors.Is(err, ErrDelayedReadTimeout) {
+		Fail(t, "expected a delayed read timeout, got", err)
+	}
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) || backendErr.Op != BackendOpReadDelayed || backendErr.Position != 0 {
+		Fail(t, "timeout isn't reported as a delayed read failure", err)
+	}
+	if backend.batchSeqNum != 0 || backend.positionWithinMessage != 0 || multiplexer.DelayedMessagesRead() != 0 {
+		Fail(t, "timed out pop advanced the multiplexer")
+	}
+
+	backend.delay = 0
+	msg, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_EthDeposit || msg.DelayedMessagesRead != 1 {
+		Fail(t, "unexpected message after retry", msg.Message.Header.Kind, msg.DelayedMessagesRead)
+	}
+}
+
+type xorDecompressor struct{}
+
+func (d xorDecompressor) Decompress(rd io.Reader, maxLen int64) (io.Reader, error) {
+	data, err := io.ReadAll(io.LimitReader(rd, maxLen))
+	if err != nil {
+		return nil, err
+	}
+	for i := range data {
+		data[i] ^= 0xff
+	}
+	return bytes.NewReader(data), nil
+}
+
+func TestRegisteredDecompressor(t *testing.T) {
+	const tag byte = 0x01
+	Require(t, RegisterDecompressor(tag, xorDecompressor{}))
+	defer func() {
+		decompressorsMutex.Lock()
+		delete(decompressors, tag)
+		decompressorsMutex.Unlock()
+	}()
+	if RegisterDecompressor(tag, xorDecompressor{}) == nil {
+		Fail(t, "registered the same tag twice")
+	}
+	if RegisterDecompressor(ZeroheavyMessageHeaderFlag, xorDecompressor{}) == nil {
+		Fail(t, "registered a tag conflicting with the zeroheavy flag")
+	}
+
+	segments := [][]byte{
+		append([]byte{BatchSegmentKindL2Message}, []byte("first")...),
+		append([]byte{BatchSegmentKindL2Message}, []byte("second")...),
+	}
+	var stream []byte
+	for _, segment := range segments {
+		encoded, err := rlp.EncodeToBytes(segment)
+		Require(t, err)
+		stream = append(stream, encoded...)
+	}
+	batch := make([]byte, 40, 41+len(stream))
+	batch = append(batch, tag)
+	for _, b := range stream {
+		batch = append(batch, b^0xff)
+	}
+
+	parsed, err := parseSequencerMessage(context.Background(), 0, batch, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if len(parsed.segments) != len(segments) {
+		Fail(t, "expected", len(segments), "segments but got", len(parsed.segments))
+	}
+	for i, segment := range segments {
+		if !bytes.Equal(parsed.segments[i], segment) {
+			Fail(t, "segment", i, "mismatch", parsed.segments[i], segment)
+		}
+	}
+
+	unknown := append(batch[:40:40], 0x02)
+	parsed, err = parseSequencerMessage(context.Background(), 0, unknown, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if len(parsed.segments) != 0 {
+		Fail(t, "unknown tag produced segments")
+	}
+}
+
+type countingDecompressor struct {
+	count *int
+}
+
+func (d countingDecompressor) Decompress(rd io.Reader, maxLen int64) (io.Reader, error) {
+	*d.count++
+	return rd, nil
+}
+
+func TestParsedBatchCache(t *testing.T) {
+	const tag byte = 0x05
+	var parses int
+	Require(t, RegisterDecompressor(tag, countingDecompressor{&parses}))
+	defer func() {
+		decompressorsMutex.Lock()
+		delete(decompressors, tag)
+		decompressorsMutex.Unlock()
+	}()
+	original := batchParseCacheHitCounter
+	batchParseCacheHitCounter = metrics.NewCounterForced()
+	defer func() { batchParseCacheHitCounter = original }()
+
+	encodeWithTag := func(segments ...[]byte) []byte {
+		batch, err := (&sequencerMessage{segments: segments}).encodeUncompressed()
+		Require(t, err)
+		batch[40] = tag
+		return batch
+	}
+	batches := [][]byte{
+		encodeWithTag([]byte{BatchSegmentKindL2Message, 0}, []byte{BatchSegmentKindL2Message, 1}),
+		encodeWithTag([]byte{BatchSegmentKindL2Message, 2}),
+	}
+	backend := NewMemoryInboxBackend(batches, nil)
+	config := DefaultInboxMultiplexerConfig
+	config.ParsedBatchCacheSize = 4
+	multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+	popAll := func() []byte {
+		var popped []byte
+		for {
+			msg, err := multiplexer.Pop(context.Background())
+			if errors.Is(err, ErrNoMoreBatches) {
+				return popped
+			}
+			Require(t, err)
+			popped = append(popped, msg.Message.L2msg...)
+		}
+	}
+	if popped := popAll(); !bytes.Equal(popped, []byte{0, 1, 2}) || parses != 2 {
+		Fail(t, "popped", popped, "parsing", parses, "batches")
+	}
+
+	backend = NewMemoryInboxBackend(batches, nil)
+	multiplexer.(*inboxMultiplexer).backend = backend
+	multiplexer.Reset(0)
+	if popped := popAll(); !bytes.Equal(popped, []byte{0, 1, 2}) || parses != 2 || batchParseCacheHitCounter.Count() != 2 {
+		Fail(t, "reprocessing popped", popped, "parsing", parses, "batches with", batchParseCacheHitCounter.Count(), "cache hits")
+	}
+
+	// a batch with different bytes at a cached number is parsed again
+	changed := encodeWithTag([]byte{BatchSegmentKindL2Message, 3})
+	backend = NewMemoryInboxBackend([][]byte{changed}, nil)
+	multiplexer.(*inboxMultiplexer).backend = backend
+	multiplexer.Reset(0)
+	if popped := popAll(); !bytes.Equal(popped, []byte{3}) || parses != 3 {
+		Fail(t, "popped", popped, "from a changed batch parsing", parses, "batches")
+	}
+}
+
+type gzipFormatHandler struct{}
+
+func (h gzipFormatHandler) ParseSegments(rd io.Reader, maxLen int64) ([][]byte, error) {
+	gzipReader, err := gzip.NewReader(rd)
+	if err != nil {
+		return nil, err
+	}
+	stream := rlp.NewStream(io.LimitReader(gzipReader, maxLen), uint64(maxLen))
+	var segments [][]byte
+	for {
+		var segment []byte
+		err := stream.Decode(&segment)
+		if errors.Is(err, io.EOF) {
+			return segments, nil
+		} else if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+}
+
+func TestSequencerMessageFormatHandler(t *testing.T) {
+	const tag byte = 0x01
+	Require(t, RegisterSequencerMessageFormatHandler(tag, gzipFormatHandler{}))
+	defer func() {
+		decompressorsMutex.Lock()
+		delete(formatHandlers, tag)
+		decompressorsMutex.Unlock()
+	}()
+	if RegisterDecompressor(tag, xorDecompressor{}) == nil {
+		Fail(t, "registered a decompressor on a format handler's tag")
+	}
+	if RegisterSequencerMessageFormatHandler(BrotliMessageHeaderByte, gzipFormatHandler{}) == nil {
+		Fail(t, "registered a format handler on the brotli tag")
+	}
+	// reserved even though the default config doesn't parse them
+	for _, reserved := range []byte{UncompressedMessageHeaderByte, SizePrefixedBrotliMessageHeaderByte, SegmentCompressedMessageHeaderByte} {
+		if RegisterSequencerMessageFormatHandler(reserved, gzipFormatHandler{}) == nil || RegisterDecompressor(reserved, xorDecompressor{}) == nil {
+			Fail(t, "registered a codec on the built-in tag", reserved)
+		}
+	}
+
+	segments := [][]byte{
+		append([]byte{BatchSegmentKindL2Message}, []byte("first")...),
+		append([]byte{BatchSegmentKindL2Message}, []byte("second")...),
+	}
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 40))
+	buf.WriteByte(tag)
+	gzipWriter := gzip.NewWriter(&buf)
+	for _, segment := range segments {
+		Require(t, rlp.Encode(gzipWriter, segment))
+	}
+	Require(t, gzipWriter.Close())
+
+	parsed, err := parseSequencerMessage(context.Background(), 0, buf.Bytes(), nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if len(parsed.segments) != len(segments) {
+		Fail(t, "expected", len(segments), "segments but got", len(parsed.segments))
+	}
+	for i := range segments {
+		if !bytes.Equal(parsed.segments[i], segments[i]) {
+			Fail(t, "segment", i, "mismatch")
+		}
+	}
+
+	corrupt := append(buf.Bytes()[:41], 0xff, 0xff)
+	parsed, err = parseSequencerMessage(context.Background(), 0, corrupt, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if len(parsed.segments) != 0 {
+		Fail(t, "corrupt format produced segments")
+	}
+}
+
+// Ignores attempts to advance it, so the multiplexer never makes progress
+type stuckBackend struct {
+	*MemoryInboxBackend
+}
+
+func (b stuckBackend) AdvanceSequencerInbox() {}
+
+func (b stuckBackend) SetPositionWithinMessage(pos uint64) {}
+
+func TestNoProgress(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 1}, []byte{BatchSegmentKindL2Message, 2})
+	backend := stuckBackend{NewMemoryInboxBackend([][]byte{batch}, nil)}
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	for i := 0; i < 2; i++ {
+		if _, err := multiplexer.Pop(context.Background()); !errors.Is(err, ErrNoProgress) {
+			Fail(t, "expected ErrNoProgress but got", err)
+		}
+	}
+}
+
+func TestBackendPositionRewound(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{0})
+	builder.AddDelayedMessages(1)
+	Require(t, builder.AdvanceTimestamp(5))
+	builder.AddL2Message([]byte{2})
+	builder.AddL2Message([]byte{3})
+	batch, err := builder.Build(0, 100, 0, 100, 1)
+	Require(t, err)
+	backend := NewMemoryInboxBackend([][]byte{batch}, [][]byte{encodeTestDelayedMessage(t, 0)})
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	var expected []*MessageWithMetadata
+	for i := 0; i < 3; i++ {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		expected = append(expected, msg)
+	}
+	for _, position := range []uint64{2, 1, 0} {
+		backend.SetPositionWithinMessage(position)
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if !msg.Equals(expected[position]) {
+			Fail(t, "after rewinding to", position, "popped", msg, "instead of", expected[position])
+		}
+	}
+	for i := 1; i < 3; i++ {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if !msg.Equals(expected[i]) {
+			Fail(t, "after rewinding popped", msg, "instead of", expected[i])
+		}
+	}
+	if multiplexer.DelayedMessagesRead() != 1 {
+		Fail(t, "rewinding left", multiplexer.DelayedMessagesRead(), "delayed messages read")
+	}
+}
+
+func TestCursorState(t *testing.T) {
+	advance := func(kind byte, amount uint64) []byte {
+		encoded, err := rlp.EncodeToBytes(amount)
+		Require(t, err)
+		return append([]byte{kind}, encoded...)
+	}
+	batch := encodeTestBatch(t, 0, 1000, 0, 1000, 1,
+		advance(BatchSegmentKindAdvanceTimestamp, 10),
+		[]byte{BatchSegmentKindL2Message, 1},
+		advance(BatchSegmentKindAdvanceL1BlockNumber, 5),
+		[]byte{BatchSegmentKindL2Message, 2},
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindL2Message, 3},
+	)
+	backend := &multiplexerBackend{
+		batch:          batch,
+		delayedMessage: encodeTestDelayedMessage(t, 0),
+	}
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	internal := multiplexer.(*inboxMultiplexer)
+	expectedSegments := []uint64{1, 3, 4}
+	for i, segmentNum := range expectedSegments {
+		_, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		state := multiplexer.CursorState()
+		expected := MultiplexerCursorState{
+			SequencerMessageNum: internal.cachedSequencerMessageNum,
+			SegmentNum:          internal.cachedSegmentNum,
+			SubMessageNumber:    internal.cachedSubMessageNumber,
+			SegmentTimestamp:    internal.cachedSegmentTimestamp,
+			SegmentBlockNumber:  internal.cachedSegmentBlockNumber,
+			DelayedMessagesRead: internal.delayedMessagesRead,
+		}
+		if state != expected {
+			Fail(t, "pop", i, "cursor state", state, "doesn't match internal state", expected)
+		}
+		if state.SegmentNum != segmentNum || state.SubMessageNumber != uint64(i) {
+			Fail(t, "pop", i, "unexpected cursor position", state)
+		}
+		if state != multiplexer.CursorState() {
+			Fail(t, "reading the cursor state changed it")
+		}
+	}
+	if state := multiplexer.CursorState(); state.SegmentTimestamp != 10 || state.SegmentBlockNumber != 5 || state.DelayedMessagesRead != 1 {
+		Fail(t, "unexpected accumulated cursor state", state)
+	}
+}
+
+func TestSizePrefixedBrotli(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte("first"))
+	builder.AddL2Message(bytes.Repeat([]byte{2}, 1000))
+	uncompressed, err := builder.BuildUncompressed(0, 0, 0, 0, 0)
+	Require(t, err)
+	segmentStream := uncompressed[41:]
+	compressed, err := arbcompress.CompressWell(segmentStream)
+	Require(t, err)
+	prefixed := func(size uint64) []byte {
+		batch := append([]byte{}, uncompressed[:40]...)
+		batch = append(batch, SizePrefixedBrotliMessageHeaderByte)
+		sizeBytes := make([]byte, binary.MaxVarintLen64)
+		batch = append(batch, sizeBytes[:binary.PutUvarint(sizeBytes, size)]...)
+		return append(batch, compressed...)
+	}
+
+	// the default config leaves the format unknown, so the batch has no segments
+	parsed, err := parseSequencerMessage(context.Background(), 0, prefixed(uint64(len(segmentStream))), nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if len(parsed.segments) != 0 {
+		Fail(t, "parsed", len(parsed.segments), "segments of a size-prefixed batch under the default config")
+	}
+	config := DefaultInboxMultiplexerConfig
+	config.SizePrefixedBrotliBatches = true
+	parsed, err = parseSequencerMessage(context.Background(), 0, prefixed(uint64(len(segmentStream))), nil, KeysetValidate, &config)
+	Require(t, err)
+	if !reflect.DeepEqual(parsed.segments, builder.segments) {
+		Fail(t, "unexpected segments", parsed.segments)
+	}
+
+	strictConfig := config
+	strictConfig.Strict = true
+	for _, size := range []uint64{0, uint64(len(segmentStream)) - 1, uint64(len(segmentStream)) + 1, uint64(maxDecompressedLen) + 1} {
+		batch := prefixed(size)
+		parsed, err := parseSequencerMessage(context.Background(), 0, batch, nil, KeysetValidate, &config)
+		Require(t, err)
+		if len(parsed.segments) != 0 {
+			Fail(t, "parsed", len(parsed.segments), "segments from a batch prefixed with size", size)
+		}
+		if _, err := parseSequencerMessage(context.Background(), 0, batch, nil, KeysetValidate, &strictConfig); !errors.Is(err, ErrInvalidSequencerMessage) {
+			Fail(t, "expected a strict error for size", size, "but got", err)
+		}
+	}
+}
+
+func TestSegmentStreamTruncated(t *testing.T) {
+	original := batchTruncatedCounter
+	defer func() { batchTruncatedCounter = original }()
+
+	builder := NewBatchBuilder()
+	for i := 0; i < 3; i++ {
+		builder.AddL2Message(bytes.Repeat([]byte{byte(i)}, 100))
+	}
+	batch, err := builder.BuildUncompressed(0, 0, 0, 0, 0)
+	Require(t, err)
+	streamLen := int64(len(batch) - 41)
+	elementLen := streamLen / 3
+	testCases := []struct {
+		limit     int64
+		segments  int
+		truncated bool
+	}{
+		{streamLen, 3, false},
+		// cut within the last segment
+		{streamLen - 10, 2, true},
+		// cut exactly between segments
+		{2 * elementLen, 2, true},
+	}
+	for _, tc := range testCases {
+		batchTruncatedCounter = metrics.NewCounterForced()
+		config := DefaultInboxMultiplexerConfig
+		config.UncompressedBatches = true
+		config.MaxDecompressedLen = tc.limit
+		parsed, err := parseSequencerMessage(context.Background(), 0, batch, nil, KeysetValidate, &config)
+		Require(t, err)
+		if len(parsed.segments) != tc.segments {
+			Fail(t, "parsed", len(parsed.segments), "segments with limit", tc.limit)
+		}
+		if (batchTruncatedCounter.Count() == 1) != tc.truncated {
+			Fail(t, "truncation counted", batchTruncatedCounter.Count(), "times with limit", tc.limit)
+		}
+		config.Strict = true
+		_, err = parseSequencerMessage(context.Background(), 0, batch, nil, KeysetValidate, &config)
+		if tc.truncated && (!errors.Is(err, ErrSegmentStreamTruncated) || !errors.Is(err, ErrInvalidSequencerMessage)) {
+			Fail(t, "expected a truncation error with limit", tc.limit, "but got", err)
+		}
+		if !tc.truncated {
+			Require(t, err)
+		}
+	}
+}
+
+func TestConfiguredDecompressionLimits(t *testing.T) {
+	l2Message := bytes.Repeat([]byte{0xab}, 2048)
+	compressedL2Message, err := arbcompress.CompressWell(l2Message)
+	Require(t, err)
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 0,
+		append([]byte{BatchSegmentKindL2Message}, l2Message...),
+		append([]byte{BatchSegmentKindL2MessageBrotli}, compressedL2Message...),
+	)
+
+	popAll := func(config *InboxMultiplexerConfig) []*MessageWithMetadata {
+		backend := &multiplexerBackend{batch: batch}
+		multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, config)
+		var msgs []*MessageWithMetadata
+		for backend.batchSeqNum == 0 {
+			msg, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+			msgs = append(msgs, msg)
+		}
+		return msgs
+	}
+	isInvalid := func(msg *MessageWithMetadata) bool {
+		return msg.Message.Header.Kind == arbos.L1MessageType_Invalid
+	}
+
+	msgs := popAll(&InboxMultiplexerConfig{})
+	if len(msgs) != 2 || isInvalid(msgs[0]) || isInvalid(msgs[1]) {
+		Fail(t, "default limits rejected a small batch")
+	}
+	if !bytes.Equal(msgs[1].Message.L2msg, l2Message) {
+		Fail(t, "brotli message decompressed incorrectly")
+	}
+
+	msgs = popAll(&InboxMultiplexerConfig{MaxL2MessageSize: 1024})
+	if len(msgs) != 2 || isInvalid(msgs[0]) || !isInvalid(msgs[1]) {
+		Fail(t, "brotli message over the configured L2 message limit wasn't dropped")
+	}
+
+	msgs = popAll(&InboxMultiplexerConfig{MaxDecompressedLen: 1024})
+	if len(msgs) != 1 || !isInvalid(msgs[0]) {
+		Fail(t, "batch over the configured decompression limit wasn't rejected")
+	}
+}
+
+func TestMaxSegmentsLimit(t *testing.T) {
+	var segments [][]byte
+	for i := 0; i < 10; i++ {
+		segments = append(segments, []byte{BatchSegmentKindL2Message, byte(i)})
+	}
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 0, segments...)
+
+	config := DefaultInboxMultiplexerConfig
+	config.MaxSegments = 4
+	parsed, err := parseSequencerMessage(context.Background(), 0, batch, nil, KeysetValidate, &config)
+	Require(t, err)
+	if len(parsed.segments) != config.MaxSegments {
+		Fail(t, "expected", config.MaxSegments, "segments but parsed", len(parsed.segments))
+	}
+
+	backend := &multiplexerBackend{batch: batch}
+	multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+	var popped int
+	for backend.batchSeqNum == 0 {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if !bytes.Equal(msg.Message.L2msg, []byte{byte(popped)}) {
+			Fail(t, "unexpected message", popped, msg.Message.L2msg)
+		}
+		popped++
+	}
+	if popped != config.MaxSegments {
+		Fail(t, "expected", config.MaxSegments, "messages but popped", popped)
+	}
+}
+
+func BenchmarkPopMaxSegments(b *testing.B) {
+	segments := make([][]byte, MaxSegmentsPerSequencerMessage*2)
+	for i := range segments {
+		segments[i] = []byte{BatchSegmentKindL2Message, byte(i)}
+	}
+	batch, err := (&sequencerMessage{segments: segments}).encode()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, maxSegments := range []int{1024, MaxSegmentsPerSequencerMessage} {
+		b.Run(fmt.Sprint(maxSegments), func(b *testing.B) {
+			config := DefaultInboxMultiplexerConfig
+			config.MaxSegments = maxSegments
+			for i := 0; i < b.N; i++ {
+				backend := &multiplexerBackend{batch: batch}
+				multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+				if _, err := multiplexer.Pop(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxTotalSegmentBytes(t *testing.T) {
+	var segments [][]byte
+	for i := 0; i < 1000; i++ {
+		segments = append(segments, []byte{BatchSegmentKindL2Message, byte(i), byte(i >> 8)})
+	}
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 0, segments...)
+
+	config := DefaultInboxMultiplexerConfig
+	config.MaxTotalSegmentBytes = 100 * 3
+	parsed, err := parseSequencerMessage(context.Background(), 0, batch, nil, KeysetValidate, &config)
+	Require(t, err)
+	if len(parsed.segments) != 100 {
+		Fail(t, "expected 100 segments within the total limit but parsed", len(parsed.segments))
+	}
+	for i, segment := range parsed.segments {
+		if !bytes.Equal(segment, segments[i]) {
+			Fail(t, "segment", i, "mismatch")
+		}
+	}
+
+	parsed, err = parseSequencerMessage(context.Background(), 0, batch, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if len(parsed.segments) != len(segments) {
+		Fail(t, "default limit dropped segments, parsed", len(parsed.segments))
+	}
+}
+
+func TestMalformedSegmentSkipped(t *testing.T) {
+	first := []byte{BatchSegmentKindL2Message, 1}
+	last := []byte{BatchSegmentKindL2Message, 2}
+	encode := func(elements ...[]byte) []byte {
+		batch := append(make([]byte, 40), UncompressedMessageHeaderByte)
+		for _, element := range elements {
+			batch = append(batch, element...)
+		}
+		return batch
+	}
+	encodedFirst, err := rlp.EncodeToBytes(first)
+	Require(t, err)
+	encodedLast, err := rlp.EncodeToBytes(last)
+	Require(t, err)
+
+	list := encode(encodedFirst, []byte{0xc2, 0x01, 0x02}, encodedLast)
+	nonCanonical := encode(encodedFirst, []byte{0x81, 0x01}, encodedLast)
+	testCases := []struct {
+		name     string
+		batch    []byte
+		skip     bool
+		expected [][]byte
+		strict   bool
+	}{
+		// by default a malformed segment ends the batch's segments
+		{"list", list, false, [][]byte{first}, true},
+		{"non-canonical", nonCanonical, false, [][]byte{first}, true},
+		// a list is framed like any other element, so the segment after it can still be found
+		{"skipped list", list, true, [][]byte{first, last}, true},
+		// a single byte string must be encoded as the byte itself
+		{"skipped non-canonical", nonCanonical, true, [][]byte{first, last}, true},
+		// a length past the stream's size limit swallows the rest of it
+		{"oversized", encode(encodedFirst, []byte{0xbf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, encodedLast), true, [][]byte{first}, true},
+		// as does a length past the end of the stream, which is treated like a truncated batch
+		{"truncated", encode(encodedFirst, []byte{0xb9, 0xff, 0xff}, encodedLast), true, [][]byte{first}, false},
+	}
+	for _, tc := range testCases {
+		config := DefaultInboxMultiplexerConfig
+		config.UncompressedBatches = true
+		config.SkipMalformedSegments = tc.skip
+		parsed, err := parseSequencerMessage(context.Background(), 0, tc.batch, nil, KeysetValidate, &config)
+		Require(t, err, tc.name)
+		if !reflect.DeepEqual(parsed.segments, tc.expected) {
+			Fail(t, tc.name, "parsed segments", parsed.segments, "instead of", tc.expected)
+		}
+		if !tc.skip {
+			// the segments the stream decoding loop produced before segments were read raw
+			var decoded [][]byte
+			stream := rlp.NewStream(bytes.NewReader(tc.batch[41:]), uint64(config.MaxDecompressedLen))
+			for {
+				var segment []byte
+				if stream.Decode(&segment) != nil {
+					break
+				}
+				decoded = append(decoded, segment)
+			}
+			if !reflect.DeepEqual(parsed.segments, decoded) {
+				Fail(t, tc.name, "parsed segments", parsed.segments, "but decoding the stream gives", decoded)
+			}
+		}
+
+		config.Strict = true
+		_, err = parseSequencerMessage(context.Background(), 0, tc.batch, nil, KeysetValidate, &config)
+		if errors.Is(err, ErrInvalidSequencerMessage) != tc.strict {
+			Fail(t, tc.name, "unexpected strict mode err", err)
+		}
+	}
+}
+
+// The linear scan IsCachedSegementLast used before its result was precomputed
+func scanIsCachedSegementLast(r *inboxMultiplexer) bool {
+	seqMsg := r.cachedSequencerMessage
+	if r.delayedMessagesRead < seqMsg.afterDelayedMessages {
+		return false
+	}
+	for segmentNum := int(r.cachedSegmentNum) + 1; segmentNum < len(seqMsg.segments); segmentNum++ {
+		segment := seqMsg.segments[segmentNum]
+		if len(segment) == 0 {
+			continue
+		}
+		kind := segment[0]
+		if kind == BatchSegmentKindL2Message || kind == BatchSegmentKindL2MessageBrotli || kind == BatchSegmentKindDelayedMessages {
+			return false
+		}
+	}
+	return true
+}
+
+func cachedTestMultiplexer(t testing.TB, batch []byte) *inboxMultiplexer {
+	multiplexer := NewInboxMultiplexer(&multiplexerBackend{batch: batch}, 0, nil, KeysetValidate).(*inboxMultiplexer)
+	skipped, err := multiplexer.cacheSequencerMessage(context.Background())
+	if err != nil || skipped != nil {
+		t.Fatal("failed to cache test batch", err)
+	}
+	return multiplexer
+}
+
+func TestIsCachedSegementLastMatchesScan(t *testing.T) {
+	kinds := []byte{
+		BatchSegmentKindL2Message,
+		BatchSegmentKindL2MessageBrotli,
+		BatchSegmentKindDelayedMessages,
+		BatchSegmentKindAdvanceTimestamp,
+		BatchSegmentKindAdvanceL1BlockNumber,
+		0xff,
+	}
+	batches := [][]byte{encodeTestBatch(t, 0, 0, 0, 0, 0)}
+	for seed := int64(0); seed < 20; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		segments := make([][]byte, rng.Intn(30))
+		for i := range segments {
+			if rng.Intn(5) == 0 {
+				segments[i] = []byte{}
+			} else {
+				segments[i] = []byte{kinds[rng.Intn(len(kinds))]}
+			}
+		}
+		batches = append(batches, encodeTestBatch(t, 0, 0, 0, 0, 0, segments...))
+	}
+	for _, batch := range batches {
+		multiplexer := cachedTestMultiplexer(t, batch)
+		for segmentNum := uint64(0); segmentNum <= uint64(len(multiplexer.cachedSequencerMessage.segments))+1; segmentNum++ {
+			multiplexer.cachedSegmentNum = segmentNum
+			if multiplexer.IsCachedSegementLast() != scanIsCachedSegementLast(multiplexer) {
+				Fail(t, "IsCachedSegementLast disagrees with the scan at segment", segmentNum, "of", multiplexer.cachedSequencerMessage.segments)
+			}
+		}
+	}
+}
+
+func BenchmarkIsCachedSegementLast(b *testing.B) {
+	segments := make([][]byte, 10000)
+	segments[0] = []byte{BatchSegmentKindL2Message}
+	for i := 1; i < len(segments); i++ {
+		segments[i] = []byte{BatchSegmentKindAdvanceTimestamp}
+	}
+	batch, err := (&sequencerMessage{segments: segments}).encode()
+	if err != nil {
+		b.Fatal(err)
+	}
+	multiplexer := cachedTestMultiplexer(b, batch)
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanIsCachedSegementLast(multiplexer)
+		}
+	})
+	b.Run("precomputed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			multiplexer.IsCachedSegementLast()
+		}
+	})
+}
+
+func TestMessagesInCurrentBatch(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 1,
+		[]byte{BatchSegmentKindL2Message, 1},
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindL2Message, 2},
+	)
+	backend := &multiplexerBackend{
+		batch:          batch,
+		delayedMessage: encodeTestDelayedMessage(t, 0),
+	}
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	first, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	if !bytes.Equal(first.Message.L2msg, []byte{1}) {
+		Fail(t, "unexpected first message", first.Message.L2msg)
+	}
+
+	next, err := multiplexer.MessagesInCurrentBatch(context.Background())
+	Require(t, err)
+	var kinds []uint8
+	for {
+		msg, ok, err := next()
+		Require(t, err)
+		if !ok {
+			break
+		}
+		kinds = append(kinds, msg.Message.Header.Kind)
+	}
+	if len(kinds) != 2 || kinds[0] != arbos.L1MessageType_EthDeposit || kinds[1] != arbos.L1MessageType_L2Message {
+		Fail(t, "unexpected remaining messages", kinds)
+	}
+	if _, ok, err := next(); ok || err != nil {
+		Fail(t, "exhausted iterator yielded again", ok, err)
+	}
+	if backend.batchSeqNum != 1 || backend.positionWithinMessage != 0 || multiplexer.DelayedMessagesRead() != 1 {
+		Fail(t, "iterator didn't leave the multiplexer at the start of the next batch")
+	}
+	// the next batch doesn't exist in this backend, so only now is it read
+	if _, err := multiplexer.Pop(context.Background()); err == nil {
+		Fail(t, "expected an error popping past the only batch")
+	}
+}
+
+func TestPopWithSegment(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 1,
+		[]byte{},
+		[]byte{BatchSegmentKindL2Message, 1},
+	)
+	backend := &multiplexerBackend{
+		batch:          batch,
+		delayedMessage: encodeTestDelayedMessage(t, 0),
+	}
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	msg, segmentNum, err := multiplexer.PopWithSegment(context.Background())
+	Require(t, err)
+	if segmentNum != 1 || msg.Message.Header.Kind != arbos.L1MessageType_L2Message {
+		Fail(t, "unexpected first segment", segmentNum, msg.Message.Header.Kind)
+	}
+	// the batch promises a delayed message it has no segment for, so it's read from a virtual segment
+	msg, segmentNum, err = multiplexer.PopWithSegment(context.Background())
+	Require(t, err)
+	if segmentNum != 2 || msg.Message.Header.Kind != arbos.L1MessageType_EthDeposit {
+		Fail(t, "unexpected virtual segment", segmentNum, msg.Message.Header.Kind)
+	}
+	if backend.batchSeqNum != 1 {
+		Fail(t, "multiplexer didn't finish the batch")
+	}
+}
+
+func TestSequencerRequestIds(t *testing.T) {
+	seen := make(map[common.Hash]bool)
+	for seqMsgNum := uint64(0); seqMsgNum < 4; seqMsgNum++ {
+		for segmentNum := uint64(0); segmentNum < 4; segmentNum++ {
+			id := sequencerRequestId(seqMsgNum, segmentNum)
+			if seen[id] {
+				Fail(t, "duplicate request id for batch", seqMsgNum, "segment", segmentNum)
+			}
+			seen[id] = true
+			if id.Big().IsUint64() {
+				Fail(t, "request id", id, "could collide with a delayed message request id")
+			}
+		}
+	}
+
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 0,
+		[]byte{BatchSegmentKindL2Message, 1},
+		[]byte{BatchSegmentKindL2Message, 2},
+	)
+	for _, enabled := range []bool{false, true} {
+		backend := &multiplexerBackend{batch: batch}
+		config := DefaultInboxMultiplexerConfig
+		config.SequencerRequestIds = enabled
+		multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+		for segmentNum := uint64(0); segmentNum < 2; segmentNum++ {
+			msg, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+			requestId := msg.Message.Header.RequestId
+			if !enabled {
+				if requestId != nil {
+					Fail(t, "request id set while disabled")
+				}
+			} else if requestId == nil || *requestId != sequencerRequestId(0, segmentNum) {
+				Fail(t, "unexpected request id for segment", segmentNum, requestId)
+			}
+		}
+	}
+}
+
+func TestMemoryInboxBackend(t *testing.T) {
+	batches := [][]byte{
+		encodeTestBatch(t, 0, 0, 0, 0, 1,
+			[]byte{BatchSegmentKindL2Message, 1},
+			[]byte{BatchSegmentKindDelayedMessages},
+		),
+		encodeTestBatch(t, 0, 0, 0, 0, 2,
+			[]byte{BatchSegmentKindDelayedMessages},
+			[]byte{BatchSegmentKindL2Message, 2},
+		),
+	}
+	delayed := [][]byte{encodeTestDelayedMessage(t, 0), encodeTestDelayedMessage(t, 1)}
+	backend := NewMemoryInboxBackend(batches, delayed)
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+
+	expected := []struct {
+		kind                uint8
+		delayedMessagesRead uint64
+	}{
+		{arbos.L1MessageType_L2Message, 0},
+		{arbos.L1MessageType_EthDeposit, 1},
+		{arbos.L1MessageType_EthDeposit, 2},
+		{arbos.L1MessageType_L2Message, 2},
+	}
+	for i, want := range expected {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if msg.Message.Header.Kind != want.kind || msg.DelayedMessagesRead != want.delayedMessagesRead {
+			Fail(t, "message", i, "had kind", msg.Message.Header.Kind, "and delayed count", msg.DelayedMessagesRead)
+		}
+	}
+	if backend.GetSequencerInboxPosition() != 2 {
+		Fail(t, "backend ended at batch", backend.GetSequencerInboxPosition())
+	}
+	if _, err := multiplexer.Pop(context.Background()); err == nil {
+		Fail(t, "expected an error popping past the last batch")
+	}
+	if _, err := backend.ReadDelayedInbox(2); err == nil {
+		Fail(t, "expected an error reading past the last delayed message")
+	}
+}
+
+func TestBrotliDroppedCounter(t *testing.T) {
+	original := segmentBrotliDroppedCounter
+	segmentBrotliDroppedCounter = metrics.NewCounterForced()
+	defer func() { segmentBrotliDroppedCounter = original }()
+
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 0,
+		[]byte{BatchSegmentKindL2MessageBrotli, 0xde, 0xad, 0xbe, 0xef},
+	)
+	multiplexer := NewInboxMultiplexer(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate)
+	msg, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_Invalid {
+		Fail(t, "corrupt brotli message wasn't dropped")
+	}
+	if segmentBrotliDroppedCounter.Count() != 1 {
+		Fail(t, "dropped brotli counter is", segmentBrotliDroppedCounter.Count())
+	}
+}
+
+func TestDuplicateBatches(t *testing.T) {
+	original := batchDuplicateCounter
+	defer func() { batchDuplicateCounter = original }()
+
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 1})
+	other := encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 2})
+	for _, drop := range []bool{false, true} {
+		batchDuplicateCounter = metrics.NewCounterForced()
+		config := DefaultInboxMultiplexerConfig
+		config.RecentBatchHashes = 4
+		config.DropDuplicateBatches = drop
+		backend := NewMemoryInboxBackend([][]byte{batch, other, batch}, nil)
+		multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+		var msgs []*MessageWithMetadata
+		for i := 0; i < 3; i++ {
+			// peeking caches the batch, which must not count it twice
+			_, err := multiplexer.Peek(context.Background())
+			Require(t, err)
+			msg, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+			msgs = append(msgs, msg)
+		}
+		if batchDuplicateCounter.Count() != 1 {
+			Fail(t, "duplicate counter is", batchDuplicateCounter.Count(), "with drop", drop)
+		}
+		if msgs[0].Equals(msgs[1]) {
+			Fail(t, "unexpected messages", msgs)
+		}
+		if drop != (msgs[2].Message.Header.Kind == arbos.L1MessageType_Invalid) {
+			Fail(t, "duplicate batch produced", msgs[2].Message, "with drop", drop)
+		}
+		if !drop && !msgs[2].Equals(msgs[0]) {
+			Fail(t, "duplicate batch wasn't processed like the original")
+		}
+	}
+	if BatchHash(batch) != BatchHash(append([]byte{}, batch...)) || BatchHash(batch) == BatchHash(other) {
+		Fail(t, "batch hash doesn't follow the batch contents")
+	}
+}
+
+func TestDelayedMessagesRegression(t *testing.T) {
+	original := batchDelayedRegressionCounter
+	batchDelayedRegressionCounter = metrics.NewCounterForced()
+	defer func() { batchDelayedRegressionCounter = original }()
+
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 1, []byte{BatchSegmentKindL2Message, 1})
+	for _, strict := range []bool{false, true} {
+		config := DefaultInboxMultiplexerConfig
+		config.Strict = strict
+		backend := NewMemoryInboxBackend([][]byte{batch}, nil)
+		multiplexer := NewInboxMultiplexerWithConfig(backend, 2, nil, KeysetValidate, &config)
+		msg, err := multiplexer.Pop(context.Background())
+		if strict {
+			if !errors.Is(err, ErrInvalidSequencerMessage) {
+				Fail(t, "expected strict mode to reject the batch, got", err)
+			}
+			if backend.GetSequencerInboxPosition() != 0 {
+				Fail(t, "strict mode advanced past the rejected batch")
+			}
+			// retrying rejects the batch again, without counting it in the stats
+			if _, err := multiplexer.Pop(context.Background()); !errors.Is(err, ErrInvalidSequencerMessage) {
+				Fail(t, "expected strict mode to reject the batch again, got", err)
+			}
+			if multiplexer.Stats().BatchDecompressedBytes != 0 {
+				Fail(t, "counted", multiplexer.Stats().BatchDecompressedBytes, "decompressed bytes of a rejected batch")
+			}
+		} else {
+			Require(t, err)
+			if msg.Message.Header.Kind != arbos.L1MessageType_L2Message {
+				Fail(t, "lenient mode didn't keep processing the batch")
+			}
+		}
+	}
+	// once in lenient mode, and for each attempt in strict mode
+	if batchDelayedRegressionCounter.Count() != 3 {
+		Fail(t, "regression counter is", batchDelayedRegressionCounter.Count())
+	}
+}
+
+func TestPeek(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{1})
+	builder.AddDelayedMessages(1)
+	Require(t, builder.AdvanceTimestamp(5))
+	builder.AddL2Message([]byte{2})
+	batch, err := builder.Build(0, 10, 0, 10, 1)
+	Require(t, err)
+	backend := NewMemoryInboxBackend([][]byte{batch, make([]byte, 8)}, [][]byte{encodeTestDelayedMessage(t, 0)})
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+
+	for i := 0; i < 4; i++ {
+		cursor := multiplexer.CursorState()
+		position := backend.GetPositionWithinMessage()
+		batchPosition := backend.GetSequencerInboxPosition()
+		first, err := multiplexer.Peek(context.Background())
+		Require(t, err)
+		second, err := multiplexer.Peek(context.Background())
+		Require(t, err)
+		if multiplexer.CursorState() != cursor || backend.GetPositionWithinMessage() != position || backend.GetSequencerInboxPosition() != batchPosition {
+			Fail(t, "message", i, "peek advanced the multiplexer")
+		}
+		popped, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		for _, peeked := range []*MessageWithMetadata{first, second} {
+			peekedHeader, poppedHeader := peeked.Message.Header, popped.Message.Header
+			if peeked.DelayedMessagesRead != popped.DelayedMessagesRead ||
+				peekedHeader.Kind != poppedHeader.Kind ||
+				peekedHeader.Timestamp != poppedHeader.Timestamp ||
+				peekedHeader.BlockNumber != poppedHeader.BlockNumber ||
+				!bytes.Equal(peeked.Message.L2msg, popped.Message.L2msg) {
+				Fail(t, "message", i, "peeked", peeked, "but popped", popped)
+			}
+		}
+	}
+	if backend.GetSequencerInboxPosition() != 2 {
+		Fail(t, "multiplexer didn't skip the truncated batch")
+	}
+}
+
+func TestParseSequencerMessageReader(t *testing.T) {
+	builder := NewBatchBuilder()
+	for i := 0; i < 20; i++ {
+		builder.AddL2Message(bytes.Repeat([]byte{byte(i)}, i*10))
+		Require(t, builder.AdvanceTimestamp(uint64(i)))
+	}
+	builder.AddDelayedMessages(3)
+	batch, err := builder.Build(1, 2, 3, 4, 3)
+	Require(t, err)
+
+	expected, err := parseSequencerMessage(context.Background(), 0, batch, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	parsed, err := parseSequencerMessageReader(context.Background(), 0, iotest.OneByteReader(bytes.NewReader(batch)), nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if parsed.minTimestamp != 1 || parsed.maxTimestamp != 2 || parsed.minL1Block != 3 || parsed.maxL1Block != 4 || parsed.afterDelayedMessages != 3 {
+		Fail(t, "header mismatch", parsed)
+	}
+	if len(parsed.segments) != len(expected.segments) || len(parsed.segments) != len(builder.segments) {
+		Fail(t, "got", len(parsed.segments), "segments, expected", len(expected.segments))
+	}
+	for i := range parsed.segments {
+		if !bytes.Equal(parsed.segments[i], expected.segments[i]) {
+			Fail(t, "segment", i, "mismatch")
+		}
+	}
+
+	_, err = parseSequencerMessageReader(context.Background(), 0, iotest.OneByteReader(bytes.NewReader(batch[:39])), nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	if !errors.Is(err, ErrSequencerMessageMissingL1Header) {
+		Fail(t, "unexpected error for truncated header", err)
+	}
+}
+
+func TestTimestampAndBlockClamping(t *testing.T) {
+	testCases := []struct {
+		name                 string
+		minimum, maximum     uint64
+		advance              uint64
+		expectedValue        uint64
+		expectedAfterAdvance uint64
+	}{
+		{"normal", 10, 20, 15, 10, 15},
+		{"normal above max", 10, 20, 25, 10, 20},
+		{"min equals max", 10, 10, 5, 10, 10},
+		{"inverted", 20, 10, 25, 20, 20},
+	}
+	for _, tc := range testCases {
+		builder := NewBatchBuilder()
+		builder.AddL2Message([]byte{1})
+		Require(t, builder.AdvanceTimestamp(tc.advance))
+		Require(t, builder.AdvanceL1BlockNumber(tc.advance))
+		builder.AddL2Message([]byte{2})
+		batch, err := builder.Build(tc.minimum, tc.maximum, tc.minimum, tc.maximum, 0)
+		Require(t, err)
+		multiplexer := NewInboxMultiplexer(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate)
+		for _, expected := range []uint64{tc.expectedValue, tc.expectedAfterAdvance} {
+			msg, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+			header := msg.Message.Header
+			if header.Timestamp != expected || header.BlockNumber != expected {
+				Fail(t, tc.name, "expected", expected, "but got timestamp", header.Timestamp, "and block", header.BlockNumber)
+			}
+		}
+	}
+}
+
+func TestTrailingEmptySegments(t *testing.T) {
+	batches := [][]byte{
+		encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 1}, []byte{}, []byte{}),
+		encodeTestBatch(t, 0, 0, 0, 0, 1, []byte{BatchSegmentKindL2Message, 2}, []byte{}, []byte{}),
+	}
+	backend := NewMemoryInboxBackend(batches, [][]byte{encodeTestDelayedMessage(t, 0)})
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	expectedKinds := []uint8{arbos.L1MessageType_L2Message, arbos.L1MessageType_L2Message, arbos.L1MessageType_EthDeposit}
+	expectedBatches := []uint64{1, 1, 2}
+	for i, kind := range expectedKinds {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if msg.Message.Header.Kind != kind {
+			Fail(t, "message", i, "had kind", msg.Message.Header.Kind)
+		}
+		if backend.GetSequencerInboxPosition() != expectedBatches[i] {
+			Fail(t, "message", i, "left the backend at batch", backend.GetSequencerInboxPosition())
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	batches := [][]byte{
+		encodeTestBatch(t, 0, 0, 0, 0, 1,
+			[]byte{BatchSegmentKindL2Message, 1},
+			[]byte{BatchSegmentKindDelayedMessages},
+		),
+		encodeTestBatch(t, 0, 0, 0, 0, 2,
+			[]byte{BatchSegmentKindDelayedMessages},
+			[]byte{BatchSegmentKindL2Message, 2},
+		),
+	}
+	delayed := [][]byte{encodeTestDelayedMessage(t, 0), encodeTestDelayedMessage(t, 1)}
+	popAll := func(multiplexer InboxMultiplexer) []*MessageWithMetadata {
+		var msgs []*MessageWithMetadata
+		for i := 0; i < 2; i++ {
+			msg, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+			msgs = append(msgs, msg)
+		}
+		return msgs
+	}
+
+	freshBackend := NewMemoryInboxBackend(batches, delayed)
+	freshBackend.AdvanceSequencerInbox()
+	expected := popAll(NewInboxMultiplexer(freshBackend, 1, nil, KeysetValidate))
+
+	backend := NewMemoryInboxBackend(batches, delayed)
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	_, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	backend.batchPosition = 1
+	backend.SetPositionWithinMessage(0)
+	multiplexer.Reset(1)
+	if multiplexer.CursorState() != (MultiplexerCursorState{DelayedMessagesRead: 1}) {
+		Fail(t, "unexpected cursor after reset", multiplexer.CursorState())
+	}
+	msgs := popAll(multiplexer)
+	for i := range expected {
+		if msgs[i].DelayedMessagesRead != expected[i].DelayedMessagesRead ||
+			msgs[i].Message.Header.Kind != expected[i].Message.Header.Kind ||
+			!bytes.Equal(msgs[i].Message.L2msg, expected[i].Message.L2msg) {
+			Fail(t, "message", i, "after reset differs from a fresh multiplexer")
+		}
+	}
+	if backend.GetSequencerInboxPosition() != freshBackend.GetSequencerInboxPosition() {
+		Fail(t, "reset multiplexer ended at batch", backend.GetSequencerInboxPosition())
+	}
+}
+
+func TestPopWithInfo(t *testing.T) {
+	batches := [][]byte{
+		encodeTestBatch(t, 0, 0, 0, 0, 1,
+			[]byte{BatchSegmentKindL2Message, 1},
+			[]byte{BatchSegmentKindDelayedMessages},
+		),
+		encodeTestBatch(t, 0, 0, 0, 0, 1,
+			[]byte{BatchSegmentKindL2Message, 2},
+			[]byte{BatchSegmentKindAdvanceTimestamp},
+			[]byte{BatchSegmentKindL2Message, 3},
+			[]byte{BatchSegmentKindAdvanceL1BlockNumber},
+		),
+	}
+	backend := NewMemoryInboxBackend(batches, [][]byte{encodeTestDelayedMessage(t, 0)})
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	expected := []PopInfo{
+		{CrossedBatchBoundary: false, SequencerMessageNum: 0, L2MessageKind: 1, HasL2MessageKind: true},
+		{CrossedBatchBoundary: true, SequencerMessageNum: 0},
+		{CrossedBatchBoundary: false, SequencerMessageNum: 1, L2MessageKind: 2, HasL2MessageKind: true},
+		{CrossedBatchBoundary: true, SequencerMessageNum: 1, L2MessageKind: 3, HasL2MessageKind: true},
+	}
+	for i, want := range expected {
+		_, info, err := multiplexer.PopWithInfo(context.Background())
+		Require(t, err)
+		if info != want {
+			Fail(t, "message", i, "had info", info, "expected", want)
+		}
+	}
+}
+
+func TestAdvanceSegmentValidation(t *testing.T) {
+	encodedAdvance, err := rlp.EncodeToBytes(uint64(5))
+	Require(t, err)
+	oversized, err := rlp.EncodeToBytes(new(big.Int).Lsh(big.NewInt(1), 64))
+	Require(t, err)
+	testCases := []struct {
+		name              string
+		advance           []byte
+		rejectTrailing    bool
+		expectedTimestamp uint64
+	}{
+		{"clean", encodedAdvance, true, 5},
+		// the default config applies the advance as it always has
+		{"trailing byte", append(append([]byte{}, encodedAdvance...), 0), false, 5},
+		{"trailing byte rejected", append(append([]byte{}, encodedAdvance...), 0), true, 0},
+		{"oversized integer", oversized, false, 0},
+	}
+	for _, tc := range testCases {
+		batch := encodeTestBatch(t, 0, 100, 0, 100, 0,
+			append([]byte{BatchSegmentKindAdvanceTimestamp}, tc.advance...),
+			[]byte{BatchSegmentKindL2Message, 1},
+		)
+		config := DefaultInboxMultiplexerConfig
+		config.RejectAdvanceTrailingBytes = tc.rejectTrailing
+		multiplexer := NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate, &config)
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if msg.Message.Header.Timestamp != tc.expectedTimestamp {
+			Fail(t, tc.name, "expected timestamp", tc.expectedTimestamp, "but got", msg.Message.Header.Timestamp)
+		}
+		if msg.Message.Header.Kind != arbos.L1MessageType_L2Message {
+			Fail(t, tc.name, "advance segment affected the following message")
+		}
+	}
+}
+
+// The reader and stream advance segments are parsed with are reused, so a malformed segment mustn't affect later ones
+func TestAdvanceSegmentsAfterMalformed(t *testing.T) {
+	encode := func(value interface{}) []byte {
+		encoded, err := rlp.EncodeToBytes(value)
+		Require(t, err)
+		return encoded
+	}
+	segments := [][]byte{
+		append([]byte{BatchSegmentKindAdvanceTimestamp}, encode(uint64(3))...),
+		append([]byte{BatchSegmentKindAdvanceTimestamp}, encode(new(big.Int).Lsh(big.NewInt(1), 64))...),
+		append([]byte{BatchSegmentKindAdvanceL1BlockNumber}, append(encode(uint64(4)), 0)...),
+		{BatchSegmentKindAdvanceTimestamp, 0xb8},
+		append([]byte{BatchSegmentKindAdvanceTimestamp}, encode(uint64(5))...),
+		append([]byte{BatchSegmentKindAdvanceL1BlockNumber}, encode(uint64(6))...),
+		{BatchSegmentKindL2Message, 1},
+		append([]byte{BatchSegmentKindAdvanceTimestamp}, encode([]uint64{1})...),
+		append([]byte{BatchSegmentKindAdvanceTimestamp}, encode(uint64(7))...),
+		{BatchSegmentKindL2Message, 2},
+	}
+	batch := encodeTestBatch(t, 0, 100, 0, 100, 0, segments...)
+	config := DefaultInboxMultiplexerConfig
+	config.RejectAdvanceTrailingBytes = true
+	multiplexer := NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate, &config)
+	for _, expected := range []struct{ timestamp, blockNumber uint64 }{{8, 6}, {15, 6}} {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		header := msg.Message.Header
+		if header.Timestamp != expected.timestamp || header.BlockNumber != expected.blockNumber {
+			Fail(t, "expected timestamp", expected.timestamp, "and block", expected.blockNumber, "but got", header.Timestamp, header.BlockNumber)
+		}
+	}
+}
+
+func TestZeroAdvanceSegments(t *testing.T) {
+	zeroAdvance, err := rlp.EncodeToBytes(uint64(0))
+	Require(t, err)
+	if !bytes.Equal(zeroAdvance, []byte{zeroAdvanceEncoding}) {
+		Fail(t, "zero advance encodes as", zeroAdvance)
+	}
+	delayed := [][]byte{encodeTestDelayedMessage(t, 0)}
+	without := encodeTestBatch(t, 0, 100, 0, 100, 1,
+		[]byte{BatchSegmentKindAdvanceTimestamp, 5},
+		[]byte{BatchSegmentKindL2Message, 1},
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindL2Message, 2},
+	)
+	with := encodeTestBatch(t, 0, 100, 0, 100, 1,
+		[]byte{BatchSegmentKindAdvanceTimestamp, zeroAdvanceEncoding},
+		[]byte{BatchSegmentKindAdvanceTimestamp, 5},
+		[]byte{BatchSegmentKindAdvanceL1BlockNumber, zeroAdvanceEncoding},
+		[]byte{BatchSegmentKindL2Message, 1},
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindAdvanceTimestamp, zeroAdvanceEncoding},
+		[]byte{BatchSegmentKindL2Message, 2},
+		[]byte{BatchSegmentKindAdvanceL1BlockNumber, zeroAdvanceEncoding},
+	)
+	readDelayed := func(seqNum uint64) ([]byte, error) { return delayed[seqNum], nil }
+	expected, err := DecodeBatch(without, 0, readDelayed)
+	Require(t, err)
+	msgs, err := DecodeBatch(with, 0, readDelayed)
+	Require(t, err)
+	if len(msgs) != len(expected) {
+		Fail(t, "zero advances changed the message count from", len(expected), "to", len(msgs))
+	}
+	for i := range msgs {
+		if !msgs[i].Equals(&expected[i]) {
+			Fail(t, "zero advances changed message", i)
+		}
+	}
+	if expected[0].Message.Header.Timestamp != 5 {
+		Fail(t, "unexpected timestamp", expected[0].Message.Header.Timestamp)
+	}
+}
+
+func TestAdvanceOverflow(t *testing.T) {
+	builder := NewBatchBuilder()
+	Require(t, builder.AdvanceTimestamp(10))
+	Require(t, builder.AdvanceL1BlockNumber(10))
+	builder.AddL2Message([]byte{1})
+	Require(t, builder.AdvanceTimestamp(math.MaxUint64))
+	Require(t, builder.AdvanceL1BlockNumber(math.MaxUint64))
+	builder.AddL2Message([]byte{2})
+	batch, err := builder.Build(100, 1000, 100, 1000, 0)
+	Require(t, err)
+	testCases := []struct {
+		saturating bool
+		expected   []uint64
+	}{
+		// by default the second advance wraps around to 9, which clamps to the batch's minimum
+		{false, []uint64{100, 100}},
+		{true, []uint64{100, 1000}},
+	}
+	for _, tc := range testCases {
+		config := DefaultInboxMultiplexerConfig
+		config.SaturatingAdvances = tc.saturating
+		multiplexer := NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate, &config)
+		for _, expected := range tc.expected {
+			msg, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+			header := msg.Message.Header
+			if header.Timestamp != expected || header.BlockNumber != expected {
+				Fail(t, "saturating", tc.saturating, "expected", expected, "but got timestamp", header.Timestamp, "and block", header.BlockNumber)
+			}
+		}
+	}
+}
+
+type recordingDelayedReader struct {
+	messages [][]byte
+	reads    []uint64
+}
+
+func (r *recordingDelayedReader) ReadDelayedInbox(seqNum uint64) ([]byte, error) {
+	r.reads = append(r.reads, seqNum)
+	if seqNum >= uint64(len(r.messages)) {
+		return nil, ErrDelayedMessageNotFound
+	}
+	return r.messages[seqNum], nil
+}
+
+func TestRetryMissingDelayed(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 2,
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindDelayedMessages},
+	)
+	for _, retry := range []bool{false, true} {
+		delayedReader := &recordingDelayedReader{messages: [][]byte{encodeTestDelayedMessage(t, 0)}}
+		config := DefaultInboxMultiplexerConfig
+		config.DelayedReader = delayedReader
+		config.RetryMissingDelayed = retry
+		backend := NewMemoryInboxBackend([][]byte{batch}, nil)
+		multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+		_, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		_, err = multiplexer.Pop(context.Background())
+		var backendErr *BackendError
+		if !errors.As(err, &backendErr) || backendErr.Op != BackendOpReadDelayed || backendErr.Position != 1 {
+			Fail(t, "expected a delayed read BackendError but got", err)
+		}
+		if !errors.Is(err, ErrDelayedMessageNotFound) {
+			Fail(t, "expected a not found error but got", err)
+		}
+		if !retry {
+			continue
+		}
+		if backend.GetSequencerInboxPosition() != 0 || multiplexer.DelayedMessagesRead() != 1 {
+			Fail(t, "multiplexer advanced past the missing delayed message")
+		}
+		delayedReader.messages = append(delayedReader.messages, encodeTestDelayedMessage(t, 1))
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if msg.Message.Header.Kind != arbos.L1MessageType_EthDeposit || msg.DelayedMessagesRead != 2 {
+			Fail(t, "unexpected message after retry", msg.Message.Header.Kind, msg.DelayedMessagesRead)
+		}
+		if backend.GetSequencerInboxPosition() != 1 {
+			Fail(t, "multiplexer didn't advance past the batch after retry")
+		}
+	}
+}
+
+func TestSeparateDelayedReader(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 2,
+		[]byte{BatchSegmentKindL2Message, 1},
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindDelayedMessages},
+	)
+	// the backend has no delayed messages, so any delayed read that reaches it fails
+	backend := NewMemoryInboxBackend([][]byte{batch}, nil)
+	delayedReader := &recordingDelayedReader{
+		messages: [][]byte{encodeTestDelayedMessage(t, 0), encodeTestDelayedMessage(t, 1)},
+	}
+	config := DefaultInboxMultiplexerConfig
+	config.DelayedReader = delayedReader
+	multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+	expectedKinds := []uint8{arbos.L1MessageType_L2Message, arbos.L1MessageType_EthDeposit, arbos.L1MessageType_EthDeposit}
+	for i, kind := range expectedKinds {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if msg.Message.Header.Kind != kind {
+			Fail(t, "message", i, "had kind", msg.Message.Header.Kind)
+		}
+	}
+	if len(delayedReader.reads) != 2 || delayedReader.reads[0] != 0 || delayedReader.reads[1] != 1 {
+		Fail(t, "unexpected delayed reads", delayedReader.reads)
+	}
+	if backend.GetSequencerInboxPosition() != 1 {
+		Fail(t, "backend ended at batch", backend.GetSequencerInboxPosition())
+	}
+}
+
+func TestDelayedMessageCache(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 2,
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindDelayedMessages},
+	)
+	for _, cacheSize := range []int{0, 16} {
+		delayedReader := &recordingDelayedReader{
+			messages: [][]byte{encodeTestDelayedMessage(t, 0), encodeTestDelayedMessage(t, 1)},
+		}
+		config := DefaultInboxMultiplexerConfig
+		config.DelayedReader = delayedReader
+		config.DelayedMessageCacheSize = cacheSize
+		multiplexer := NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate, &config)
+		for i := 0; i < 2; i++ {
+			peeked, err := multiplexer.Peek(context.Background())
+			Require(t, err)
+			popped, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+			if peeked.Message.Header.RequestId == nil || *peeked.Message.Header.RequestId != *popped.Message.Header.RequestId {
+				Fail(t, "peeked and popped different delayed messages")
+			}
+		}
+		expectedReads := []uint64{0, 0, 1, 1}
+		if cacheSize > 0 {
+			expectedReads = []uint64{0, 1}
+		}
+		if len(delayedReader.reads) != len(expectedReads) {
+			Fail(t, "cache size", cacheSize, "had delayed reads", delayedReader.reads)
+		}
+		for i, seqNum := range expectedReads {
+			if delayedReader.reads[i] != seqNum {
+				Fail(t, "cache size", cacheSize, "had delayed reads", delayedReader.reads)
+			}
+		}
+	}
+}
+
+func TestConcurrentGetters(t *testing.T) {
+	var batches [][]byte
+	var delayed [][]byte
+	for i := uint64(0); i < 20; i++ {
+		batches = append(batches, encodeTestBatch(t, 0, 0, 0, 0, i+1,
+			[]byte{BatchSegmentKindL2Message, byte(i)},
+			[]byte{BatchSegmentKindDelayedMessages},
+		))
+		delayed = append(delayed, encodeTestDelayedMessage(t, i))
+	}
+	multiplexer := NewInboxMultiplexer(NewMemoryInboxBackend(batches, delayed), 0, nil, KeysetValidate)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		var last uint64
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			read := multiplexer.DelayedMessagesRead()
+			if read < last {
+				t.Error("delayed messages read went backwards from", last, "to", read)
+				return
+			}
+			last = read
+			_ = multiplexer.CursorState()
+		}
+	}()
+	for i := 0; i < len(batches)*2; i++ {
+		_, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+	}
+	close(done)
+	<-finished
+	if multiplexer.DelayedMessagesRead() != uint64(len(delayed)) {
+		Fail(t, "read", multiplexer.DelayedMessagesRead(), "delayed messages")
+	}
+}
+
+func TestIterateBatches(t *testing.T) {
+	batches := [][]byte{
+		encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 0}),
+		encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 1}),
+		encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 2}),
+	}
+	for _, startPos := range []uint64{0, 1, 3} {
+		backend := NewMemoryInboxBackend(batches, nil)
+		var positions []uint64
+		err := IterateBatches(backend, startPos, func(pos uint64, raw []byte) error {
+			if !bytes.Equal(raw, batches[pos]) {
+				Fail(t, "batch", pos, "had the wrong bytes")
+			}
+			positions = append(positions, pos)
+			return nil
+		})
+		Require(t, err)
+		if uint64(len(positions)) != 3-startPos || backend.GetSequencerInboxPosition() != 3 {
+			Fail(t, "iterated over", positions, "from", startPos)
+		}
+		for i, pos := range positions {
+			if pos != startPos+uint64(i) {
+				Fail(t, "iterated over", positions, "from", startPos)
+			}
+		}
+	}
+
+	backend := NewMemoryInboxBackend(batches, nil)
+	stop := errors.New("stop")
+	err := IterateBatches(backend, 0, func(pos uint64, raw []byte) error {
+		if pos == 1 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || backend.GetSequencerInboxPosition() != 1 {
+		Fail(t, "iteration stopped with", err, "at", backend.GetSequencerInboxPosition())
+	}
+	if IterateBatches(backend, 0, func(uint64, []byte) error { return nil }) == nil {
+		Fail(t, "iterated from behind the backend")
+	}
+}
+
+type batchPeekingBackend struct {
+	*MemoryInboxBackend
+	batches      [][]byte
+	maxPerPeek   int
+	batchPeeks   int
+	singlePeeks  int
+	requestedMax []int
+}
+
+func (b *batchPeekingBackend) PeekSequencerInbox() ([]byte, error) {
+	b.singlePeeks++
+	return b.MemoryInboxBackend.PeekSequencerInbox()
+}
+
+func (b *batchPeekingBackend) PeekSequencerInboxBatch(n int) ([][]byte, error) {
+	b.batchPeeks++
+	b.requestedMax = append(b.requestedMax, n)
+	start := b.GetSequencerInboxPosition()
+	if start >= uint64(len(b.batches)) {
+		return nil, ErrNoMoreBatches
+	}
+	if n > b.maxPerPeek {
+		n = b.maxPerPeek
+	}
+	end := int(start) + n
+	if end > len(b.batches) {
+		end = len(b.batches)
+	}
+	return b.batches[start:end], nil
+}
+
+func TestPeekSequencerInboxBatch(t *testing.T) {
+	var batches [][]byte
+	for i := 0; i < 5; i++ {
+		batches = append(batches, encodeTestBatch(t, 0, 0, 0, 0, uint64(i+1),
+			[]byte{BatchSegmentKindL2Message, byte(i)},
+			[]byte{BatchSegmentKindDelayedMessages},
+		))
+	}
+	var delayed [][]byte
+	for i := 0; i < len(batches); i++ {
+		delayed = append(delayed, encodeTestDelayedMessage(t, uint64(i)))
+	}
+	single := NewMemoryInboxBackend(batches, delayed)
+	prefetching := &batchPeekingBackend{MemoryInboxBackend: NewMemoryInboxBackend(batches, delayed), batches: batches, maxPerPeek: 2}
+	singleMultiplexer := NewInboxMultiplexer(single, 0, nil, KeysetValidate)
+	prefetchingMultiplexer := NewInboxMultiplexer(prefetching, 0, nil, KeysetValidate)
+	for i := 0; ; i++ {
+		expected, expectedErr := singleMultiplexer.Pop(context.Background())
+		msg, err := prefetchingMultiplexer.Pop(context.Background())
+		if errors.Is(expectedErr, ErrNoMoreBatches) {
+			if !errors.Is(err, ErrNoMoreBatches) {
+				Fail(t, "prefetching multiplexer didn't reach the end of the inbox, got", err)
+			}
+			break
+		}
+		Require(t, expectedErr)
+		Require(t, err)
+		if !msg.Equals(expected) {
+			Fail(t, "message", i, "differs when prefetching batches")
+		}
+		if prefetching.GetSequencerInboxPosition() != single.GetSequencerInboxPosition() ||
+			prefetching.GetPositionWithinMessage() != single.GetPositionWithinMessage() {
+			Fail(t, "backend positions differ after message", i)
+		}
+	}
+	// three peeks of at most two batches, and one finding no more
+	if prefetching.batchPeeks != 4 || prefetching.singlePeeks != 0 {
+		Fail(t, "prefetching backend was peeked", prefetching.batchPeeks, "times in batches and", prefetching.singlePeeks, "times singly")
+	}
+	if prefetching.requestedMax[0] != maxBatchPrefetch {
+		Fail(t, "requested", prefetching.requestedMax[0], "batches per peek")
+	}
+}
+
+func TestPeekSequencerInboxBatchReorg(t *testing.T) {
+	var batches [][]byte
+	for i := 0; i < 4; i++ {
+		batches = append(batches, encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, byte(i)}))
+	}
+	backend := &batchPeekingBackend{MemoryInboxBackend: NewMemoryInboxBackend(batches, nil), batches: batches, maxPerPeek: 4}
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	for i := 0; i < 2; i++ {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if !bytes.Equal(msg.Message.L2msg, []byte{byte(i)}) {
+			Fail(t, "unexpected message", i, msg.Message.L2msg)
+		}
+	}
+	if backend.batchPeeks != 1 {
+		Fail(t, "backend was peeked", backend.batchPeeks, "times for one prefetch")
+	}
+
+	// the backend reorgs back to batch 1, replacing it and the prefetched batch after it
+	batches[1] = encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 11})
+	batches[2] = encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 12})
+	backend.batchPosition = 1
+	for _, expected := range []byte{11, 12, 3} {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if !bytes.Equal(msg.Message.L2msg, []byte{expected}) {
+			Fail(t, "expected message", expected, "after the reorg but got", msg.Message.L2msg)
+		}
+	}
+	if backend.batchPeeks != 2 {
+		Fail(t, "backend was peeked", backend.batchPeeks, "times instead of again after the reorg")
+	}
+}
+
+type cancellingBatchPeekingBackend struct {
+	*batchPeekingBackend
+	cancel context.CancelFunc
+}
+
+func (b *cancellingBatchPeekingBackend) PeekSequencerInboxBatchWithContext(ctx context.Context, n int) ([][]byte, error) {
+	if b.cancel != nil {
+		b.cancel()
+		b.cancel = nil
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return b.PeekSequencerInboxBatch(n)
+}
+
+func TestPeekSequencerInboxBatchCancellation(t *testing.T) {
+	batches := [][]byte{encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 1})}
+	backend := &cancellingBatchPeekingBackend{
+		batchPeekingBackend: &batchPeekingBackend{MemoryInboxBackend: NewMemoryInboxBackend(batches, nil), batches: batches, maxPerPeek: 2},
+	}
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	ctx, cancel := context.WithCancel(context.Background())
+	backend.cancel = cancel
+	if _, err := multiplexer.Pop(ctx); !errors.Is(err, context.Canceled) {
+		Fail(t, "expected the batch peek to be cancelled, got", err)
+	}
+	if backend.batchPeeks != 0 || backend.GetSequencerInboxPosition() != 0 {
+		Fail(t, "cancelled peek fell back to the plain peek or advanced")
+	}
+	msg, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	if !bytes.Equal(msg.Message.L2msg, []byte{1}) || backend.batchPeeks != 1 {
+		Fail(t, "unexpected message after retrying", msg.Message.L2msg)
+	}
+}
+
+func TestBackendError(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 4, []byte{BatchSegmentKindDelayedMessages})
+	backend := NewMemoryInboxBackend([][]byte{batch}, nil)
+	multiplexer := NewInboxMultiplexer(backend, 3, nil, KeysetValidate)
+	_, err := multiplexer.Pop(context.Background())
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) {
+		Fail(t, "expected a BackendError but got", err)
+	}
+	if backendErr.Op != BackendOpReadDelayed || backendErr.Position != 3 {
+		Fail(t, "unexpected backend error", backendErr.Op, backendErr.Position)
+	}
+
+	multiplexer = NewInboxMultiplexer(&multiplexerBackend{batchSeqNum: 1}, 0, nil, KeysetValidate)
+	_, err = multiplexer.Pop(context.Background())
+	if !errors.As(err, &backendErr) || backendErr.Op != BackendOpPeek || backendErr.Position != 1 {
+		Fail(t, "expected a peek BackendError but got", err)
+	}
+}
+
+func TestErrNoMoreBatches(t *testing.T) {
+	batches := [][]byte{
+		encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 0}, []byte{BatchSegmentKindL2Message, 1}),
+		encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 2}),
+	}
+	backend := NewMemoryInboxBackend(batches, nil)
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	var popped []byte
+	for {
+		msg, err := multiplexer.Pop(context.Background())
+		if errors.Is(err, ErrNoMoreBatches) {
+			break
+		}
+		Require(t, err)
+		popped = append(popped, msg.Message.L2msg...)
+	}
+	if !bytes.Equal(popped, []byte{0, 1, 2}) || backend.GetSequencerInboxPosition() != 2 {
+		Fail(t, "drained", popped, "ending at batch", backend.GetSequencerInboxPosition())
+	}
+	_, err := multiplexer.Pop(context.Background())
+	var backendErr *BackendError
+	if !errors.Is(err, ErrNoMoreBatches) || errors.As(err, &backendErr) {
+		Fail(t, "popping again at the end of the inbox returned", err)
+	}
+}
+
+type rangeDelayedReader struct {
+	recordingDelayedReader
+	rangeReads [][2]uint64
+}
+
+func (r *rangeDelayedReader) ReadDelayedInboxRange(start uint64, count uint64) ([][]byte, error) {
+	r.rangeReads = append(r.rangeReads, [2]uint64{start, count})
+	if start+count > uint64(len(r.messages)) {
+		return nil, errors.New("delayed message range not found")
+	}
+	return r.messages[start : start+count], nil
+}
+
+func TestDelayedInboxRangeReads(t *testing.T) {
+	batches := [][]byte{
+		encodeTestBatch(t, 0, 0, 0, 0, 3,
+			[]byte{BatchSegmentKindDelayedMessages},
+			[]byte{BatchSegmentKindL2Message, 1},
+			[]byte{BatchSegmentKindDelayedMessages},
+			[]byte{BatchSegmentKindDelayedMessages},
+		),
+		encodeTestBatch(t, 0, 0, 0, 0, 4, []byte{BatchSegmentKindDelayedMessages}),
+	}
+	var delayed [][]byte
+	for i := uint64(0); i < 4; i++ {
+		delayed = append(delayed, encodeTestDelayedMessage(t, i))
+	}
+	popAll := func(reader DelayedInboxReader) []*MessageWithMetadata {
+		config := DefaultInboxMultiplexerConfig
+		config.DelayedReader = reader
+		backend := NewMemoryInboxBackend(batches, nil)
+		multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+		var msgs []*MessageWithMetadata
+		for backend.GetSequencerInboxPosition() < uint64(len(batches)) {
+			msg, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+			msgs = append(msgs, msg)
+		}
+		return msgs
+	}
+
+	singleReader := &recordingDelayedReader{messages: delayed}
+	expected := popAll(singleReader)
+	rangeReader := &rangeDelayedReader{recordingDelayedReader: recordingDelayedReader{messages: delayed}}
+	msgs := popAll(rangeReader)
+
+	if len(rangeReader.reads) != 0 {
+		Fail(t, "range reader was read one message at a time", rangeReader.reads)
+	}
+	expectedRanges := [][2]uint64{{0, 3}, {3, 1}}
+	if !reflect.DeepEqual(rangeReader.rangeReads, expectedRanges) {
+		Fail(t, "unexpected range reads", rangeReader.rangeReads)
+	}
+	if len(msgs) != len(expected) {
+		Fail(t, "range reads produced", len(msgs), "messages instead of", len(expected))
+	}
+	for i := range expected {
+		if msgs[i].DelayedMessagesRead != expected[i].DelayedMessagesRead ||
+			msgs[i].Message.Header.Kind != expected[i].Message.Header.Kind ||
+			!reflect.DeepEqual(msgs[i].Message.Header.RequestId, expected[i].Message.Header.RequestId) {
+			Fail(t, "message", i, "differs between range and single reads")
+		}
+	}
+}
+
+func TestEmptyBatch(t *testing.T) {
+	batch := make([]byte, 40)
+	binary.BigEndian.PutUint64(batch[32:40], 3)
+	if !IsEmptyBatch(batch) || IsEmptyBatch(batch[:39]) || IsEmptyBatch(append(batch, BrotliMessageHeaderByte)) {
+		Fail(t, "IsEmptyBatch misclassified a batch")
+	}
+	parsed, err := parseSequencerMessage(context.Background(), 0, batch, nil, KeysetValidate, &DefaultInboxMultiplexerConfig)
+	Require(t, err)
+	if len(parsed.segments) != 0 || parsed.afterDelayedMessages != 3 {
+		Fail(t, "unexpected parse of empty batch", parsed.segments, parsed.afterDelayedMessages)
+	}
+
+	var delayed [][]byte
+	for i := uint64(0); i < 3; i++ {
+		delayed = append(delayed, encodeTestDelayedMessage(t, i))
+	}
+	backend := NewMemoryInboxBackend([][]byte{batch}, delayed)
+	multiplexer := NewInboxMultiplexer(backend, 1, nil, KeysetValidate)
+	for expected := uint64(2); expected <= 3; expected++ {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if msg.Message.Header.Kind != arbos.L1MessageType_EthDeposit || msg.DelayedMessagesRead != expected {
+			Fail(t, "unexpected message", msg.Message.Header.Kind, msg.DelayedMessagesRead)
+		}
+	}
+	if backend.GetSequencerInboxPosition() != 1 {
+		Fail(t, "empty batch produced more messages than its delayed messages")
+	}
+}
+
+func TestPopBatchOfDelayed(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 3,
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindL2Message, 1},
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindDelayedMessages},
+	)
+	var delayed [][]byte
+	for i := uint64(0); i < 4; i++ {
+		delayed = append(delayed, encodeTestDelayedMessage(t, i))
+	}
+	backend := NewMemoryInboxBackend([][]byte{batch}, delayed)
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	expectDelayed := func(max int, expected ...uint64) {
+		msgs, err := multiplexer.PopBatchOfDelayed(context.Background(), max)
+		Require(t, err)
+		if len(msgs) != len(expected) {
+			Fail(t, "popped", len(msgs), "delayed messages but expected", len(expected))
+		}
+		for i, msg := range msgs {
+			if msg.Message.Header.Kind != arbos.L1MessageType_EthDeposit || msg.DelayedMessagesRead != expected[i] {
+				Fail(t, "unexpected delayed message", msg.Message.Header.Kind, msg.DelayedMessagesRead)
+			}
+		}
+	}
+
+	expectDelayed(10, 1, 2)
+	expectDelayed(10)
+	msg, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_L2Message {
+		Fail(t, "expected the L2 message to remain after popping delayed messages")
+	}
+	expectDelayed(10, 3)
+	// the last segment is past afterDelayedMessages, so it isn't a delayed read
+	expectDelayed(10)
+	msg, err = multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_Invalid || backend.GetSequencerInboxPosition() != 1 {
+		Fail(t, "expected the batch to end with an invalid message")
+	}
+
+	config := DefaultInboxMultiplexerConfig
+	config.MaxDelayedPerPop = 1
+	multiplexer = NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, delayed), 0, nil, KeysetValidate, &config)
+	expectDelayed(10, 1)
+	expectDelayed(10, 2)
+}
+
+func TestL2MessageBrotliLayout(t *testing.T) {
+	l2Message := []byte("brotli layout")
+	compressed, err := arbcompress.CompressWell(l2Message)
+	Require(t, err)
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 0,
+		append([]byte{BatchSegmentKindL2MessageBrotli}, compressed...),
+		append([]byte{BatchSegmentKindL2MessageBrotli, 0xff}, compressed...),
+	)
+	multiplexer := NewInboxMultiplexer(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate)
+	msg, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_L2Message || !bytes.Equal(msg.Message.L2msg, l2Message) {
+		Fail(t, "brotli stream right after the kind byte wasn't decoded")
+	}
+	msg, err = multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_Invalid {
+		Fail(t, "brotli stream behind an extra byte wasn't dropped")
+	}
+}
+
+func TestBrotliMessageSizeLimit(t *testing.T) {
+	var segments [][]byte
+	for _, size := range []int{arbos.MaxL2MessageSize, arbos.MaxL2MessageSize + 1} {
+		compressed, err := arbcompress.CompressWell(make([]byte, size))
+		Require(t, err)
+		segments = append(segments, append([]byte{BatchSegmentKindL2MessageBrotli}, compressed...))
+	}
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 0, segments...)
+	multiplexer := NewInboxMultiplexer(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate)
+	msg, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_L2Message || len(msg.Message.L2msg) != arbos.MaxL2MessageSize {
+		Fail(t, "brotli message at the size limit wasn't decoded in full")
+	}
+	msg, err = multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_Invalid {
+		Fail(t, "brotli message just over the size limit was accepted with", len(msg.Message.L2msg), "bytes")
+	}
+}
+
+func TestDroppedSegmentObserver(t *testing.T) {
+	corrupt := []byte{0xde, 0xad, 0xbe, 0xef, 0x01}
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{1})
+	builder.segments = append(builder.segments, append([]byte{BatchSegmentKindL2MessageBrotli}, corrupt...))
+	batch, err := builder.Build(0, 0, 0, 0, 0)
+	Require(t, err)
+
+	var dropped []DroppedSegment
+	config := DefaultInboxMultiplexerConfig
+	config.DroppedSegmentObserver = func(segment DroppedSegment) {
+		dropped = append(dropped, segment)
+	}
+	// start past a few batches so the sequencer message number is distinguishable from the segment number
+	backend := NewMemoryInboxBackend([][]byte{nil, nil, nil, batch}, nil)
+	backend.batchPosition = 3
+	multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+	for i := 0; i < 2; i++ {
+		_, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+	}
+	if len(dropped) != 1 {
+		Fail(t, "expected one dropped segment but got", dropped)
+	}
+	if dropped[0].SequencerMessageNum != 3 || dropped[0].SegmentNum != 1 || dropped[0].Kind != BatchSegmentKindL2MessageBrotli ||
+		dropped[0].CompressedLen != len(corrupt) || dropped[0].Reason == "" {
+		Fail(t, "unexpected dropped segment", dropped[0])
+	}
+}
+
+func TestMessageWithMetadataEquals(t *testing.T) {
+	newMessage := func() *MessageWithMetadata {
+		requestId := common.BigToHash(big.NewInt(5))
+		return &MessageWithMetadata{
+			Message: &arbos.L1IncomingMessage{
+				Header: &arbos.L1IncomingMessageHeader{
+					Kind:        arbos.L1MessageType_L2Message,
+					Poster:      common.BigToAddress(big.NewInt(1)),
+					BlockNumber: 2,
+					Timestamp:   3,
+					RequestId:   &requestId,
+					L1BaseFee:   big.NewInt(4),
+				},
+				L2msg: []byte{1, 2, 3},
+			},
+			DelayedMessagesRead: 6,
+		}
+	}
+	if !newMessage().Equals(newMessage()) {
+		Fail(t, "separately allocated identical messages aren't equal")
+	}
+	var nilMessage *MessageWithMetadata
+	if !nilMessage.Equals(nil) || nilMessage.Equals(newMessage()) || newMessage().Equals(nil) {
+		Fail(t, "nil messages should only equal nil")
+	}
+
+	modifications := map[string]func(msg *MessageWithMetadata){
+		"delayed messages read": func(msg *MessageWithMetadata) { msg.DelayedMessagesRead++ },
+		"kind":                  func(msg *MessageWithMetadata) { msg.Message.Header.Kind = arbos.L1MessageType_Invalid },
+		"poster":                func(msg *MessageWithMetadata) { msg.Message.Header.Poster = common.Address{} },
+		"block number":          func(msg *MessageWithMetadata) { msg.Message.Header.BlockNumber++ },
+		"timestamp":             func(msg *MessageWithMetadata) { msg.Message.Header.Timestamp++ },
+		"request id":            func(msg *MessageWithMetadata) { msg.Message.Header.RequestId[0] = 1 },
+		"nil request id":        func(msg *MessageWithMetadata) { msg.Message.Header.RequestId = nil },
+		"base fee":              func(msg *MessageWithMetadata) { msg.Message.Header.L1BaseFee.SetUint64(7) },
+		"nil base fee":          func(msg *MessageWithMetadata) { msg.Message.Header.L1BaseFee = nil },
+		"payload":               func(msg *MessageWithMetadata) { msg.Message.L2msg[0] = 0 },
+		"empty payload":         func(msg *MessageWithMetadata) { msg.Message.L2msg = nil },
+		"nil header":            func(msg *MessageWithMetadata) { msg.Message.Header = nil },
+	}
+	for name, modify := range modifications {
+		modified := newMessage()
+		modify(modified)
+		if modified.Equals(newMessage()) || newMessage().Equals(modified) {
+			Fail(t, "messages differing in", name, "are equal")
+		}
+	}
+}
+
+func TestSequencerAddress(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2Message, 1})
+	poster := common.BigToAddress(big.NewInt(0x5e9))
+	config := DefaultInboxMultiplexerConfig
+	config.SequencerAddress = poster
+	for _, tc := range []struct {
+		config   *InboxMultiplexerConfig
+		expected common.Address
+	}{
+		{&DefaultInboxMultiplexerConfig, l1pricing.BatchPosterAddress},
+		{&config, poster},
+		{&InboxMultiplexerConfig{}, l1pricing.BatchPosterAddress},
+	} {
+		multiplexer := NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate, tc.config)
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if msg.Message.Header.Poster != tc.expected {
+			Fail(t, "message has poster", msg.Message.Header.Poster, "instead of", tc.expected)
+		}
+	}
+}
+
+func TestBaseFeeProvider(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 7, 9, 0, []byte{BatchSegmentKindL2Message, 1})
+	baseFee := big.NewInt(1234)
+	var requestedBlocks []uint64
+	config := DefaultInboxMultiplexerConfig
+	config.BaseFeeProvider = func(l1Block uint64) *big.Int {
+		requestedBlocks = append(requestedBlocks, l1Block)
+		return baseFee
+	}
+	multiplexer := NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate, &config)
+	msg, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.L1BaseFee.Cmp(baseFee) != 0 {
+		Fail(t, "message has base fee", msg.Message.Header.L1BaseFee, "instead of", baseFee)
+	}
+	if !reflect.DeepEqual(requestedBlocks, []uint64{7}) {
+		Fail(t, "base fee requested for L1 blocks", requestedBlocks, "instead of the batch's minL1Block")
+	}
+
+	multiplexer = NewInboxMultiplexer(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate)
+	msg, err = multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.L1BaseFee.Sign() != 0 {
+		Fail(t, "message without a provider has base fee", msg.Message.Header.L1BaseFee)
+	}
+}
+
+func TestRetainedPayloadStable(t *testing.T) {
+	builder := NewBatchBuilder()
+	for i := 0; i < 100; i++ {
+		builder.AddL2Message(bytes.Repeat([]byte{byte(i)}, 32))
+		Require(t, builder.AddL2MessageBrotli(bytes.Repeat([]byte{byte(i)}, 32)))
+		Require(t, builder.AdvanceTimestamp(1))
+	}
+	batch, err := builder.Build(0, 1000, 0, 0, 0)
+	Require(t, err)
+
+	multiplexer := NewInboxMultiplexer(NewMemoryInboxBackend([][]byte{batch, batch}, nil), 0, nil, KeysetValidate)
+	retained, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	expected := append([]byte{}, retained.Message.L2msg...)
+	// pop through the rest of this batch and all of the next one
+	for i := 0; i < 399; i++ {
+		_, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if !bytes.Equal(retained.Message.L2msg, expected) {
+			Fail(t, "retained payload changed after", i+1, "more pops")
+		}
+	}
+
+	config := DefaultInboxMultiplexerConfig
+	config.CopyPayload = true
+	multiplexer = NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate, &config)
+	peeked, err := multiplexer.Peek(context.Background())
+	Require(t, err)
+	peeked.Message.L2msg[0] = 0xff
+	popped, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	if popped.Message.L2msg[0] != 0 {
+		Fail(t, "modifying a peeked payload with CopyPayload changed the popped one to", popped.Message.L2msg)
+	}
+}
+
+func TestDelayedParser(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 2,
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindDelayedMessages},
+	)
+	delayedMessages := [][]byte{encodeTestDelayedMessage(t, 0), encodeTestDelayedMessage(t, 1)}
+	var parsed int
+	config := DefaultInboxMultiplexerConfig
+	config.DelayedParser = func(rd io.Reader) (*arbos.L1IncomingMessage, error) {
+		parsed++
+		if parsed == 1 {
+			return nil, errors.New("injected delayed message parse failure")
+		}
+		return arbos.ParseIncomingL1Message(rd)
+	}
+	multiplexer := NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, delayedMessages), 0, nil, KeysetValidate, &config)
+	msg, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_Invalid || msg.DelayedMessagesRead != 1 {
+		Fail(t, "delayed message failing to parse wasn't dropped, got", msg.Message.Header.Kind, "with", msg.DelayedMessagesRead, "read")
+	}
+	msg, err = multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_EthDeposit || msg.DelayedMessagesRead != 2 {
+		Fail(t, "unexpected delayed message", msg.Message.Header.Kind, "with", msg.DelayedMessagesRead, "read")
+	}
+	if parsed != 2 {
+		Fail(t, "parser called", parsed, "times")
+	}
+}
+
+func TestDelayedDecompressor(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 2,
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindDelayedMessages},
+	)
+	compressed, err := arbcompress.CompressWell(encodeTestDelayedMessage(t, 0))
+	Require(t, err)
+	// the second delayed message isn't compressed, so fails to decompress
+	delayedMessages := [][]byte{compressed, encodeTestDelayedMessage(t, 1)}
+	config := DefaultInboxMultiplexerConfig
+	config.DelayedDecompressor = brotliDecompressor{}
+	multiplexer := NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, delayedMessages), 0, nil, KeysetValidate, &config)
+	msg, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	expected, err := arbos.ParseIncomingL1Message(bytes.NewReader(encodeTestDelayedMessage(t, 0)))
+	Require(t, err)
+	if !msg.Equals(&MessageWithMetadata{Message: expected, DelayedMessagesRead: 1}) {
+		Fail(t, "unexpected decompressed delayed message", msg.Message.Header.Kind, "with", msg.DelayedMessagesRead, "read")
+	}
+	msg, err = multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_Invalid || msg.DelayedMessagesRead != 2 {
+		Fail(t, "delayed message failing to decompress wasn't dropped, got", msg.Message.Header.Kind, "with", msg.DelayedMessagesRead, "read")
+	}
+
+	config.MaxDecompressedLen = 8
+	multiplexer = NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, delayedMessages), 0, nil, KeysetValidate, &config)
+	msg, err = multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_Invalid {
+		Fail(t, "delayed message decompressing past MaxDecompressedLen wasn't dropped, got", msg.Message.Header.Kind)
+	}
+}
+
+func TestRemainingInBatch(t *testing.T) {
+	batch := encodeTestBatch(t, 0, 10, 0, 10, 3,
+		[]byte{BatchSegmentKindAdvanceTimestamp, 1},
+		[]byte{BatchSegmentKindL2Message, 1},
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{},
+		[]byte{0x7f},
+		[]byte{BatchSegmentKindL2Message, 2},
+		[]byte{BatchSegmentKindAdvanceL1BlockNumber, 1},
+	)
+	delayedMessages := [][]byte{encodeTestDelayedMessage(t, 0), encodeTestDelayedMessage(t, 1), encodeTestDelayedMessage(t, 2)}
+	multiplexer := NewInboxMultiplexer(NewMemoryInboxBackend([][]byte{batch, batch}, delayedMessages), 0, nil, KeysetValidate)
+	if _, cached := multiplexer.RemainingInBatch(); cached {
+		Fail(t, "a batch was cached before the first pop")
+	}
+	_, err := multiplexer.Peek(context.Background())
+	Require(t, err)
+	// four segment messages then two virtual delayed messages
+	expected := 6
+	for {
+		remaining, cached := multiplexer.RemainingInBatch()
+		if !cached || remaining != expected {
+			Fail(t, "expected", expected, "remaining but got", remaining, cached)
+		}
+		_, info, err := multiplexer.PopWithInfo(context.Background())
+		Require(t, err)
+		expected--
+		if info.CrossedBatchBoundary {
+			break
+		}
+	}
+	if expected != 0 {
+		Fail(t, "batch ended with", expected, "messages expected to remain")
+	}
+	if _, cached := multiplexer.RemainingInBatch(); cached {
+		Fail(t, "a batch was cached after crossing the batch boundary")
+	}
+}
+
+func TestReportUnclamped(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{1})
+	for i := 0; i < 10; i++ {
+		Require(t, builder.AdvanceTimestamp(10))
+		Require(t, builder.AdvanceL1BlockNumber(3))
+	}
+	builder.AddL2Message([]byte{2})
+	batch, err := builder.Build(20, 50, 5, 25, 0)
+	Require(t, err)
+
+	config := DefaultInboxMultiplexerConfig
+	config.ReportUnclamped = true
+	multiplexer := NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate, &config)
+	expected := []struct {
+		timestamp, blockNumber, unclampedTimestamp, unclampedBlockNumber uint64
+	}{
+		// below the minimums
+		{20, 5, 0, 0},
+		// above the maximums
+		{50, 25, 100, 30},
+	}
+	for i, values := range expected {
+		msg, info, err := multiplexer.PopWithInfo(context.Background())
+		Require(t, err)
+		header := msg.Message.Header
+		if header.Timestamp != values.timestamp || header.BlockNumber != values.blockNumber {
+			Fail(t, "message", i, "has clamped values", header.Timestamp, header.BlockNumber)
+		}
+		if info.UnclampedTimestamp != values.unclampedTimestamp || info.UnclampedBlockNumber != values.unclampedBlockNumber {
+			Fail(t, "message", i, "reported unclamped values", info.UnclampedTimestamp, info.UnclampedBlockNumber)
+		}
+	}
+}
+
+type recordingTracer struct {
+	started []string
+	ended   []string
+}
+
+func (t *recordingTracer) StartSpan(name string) func() {
+	t.started = append(t.started, name)
+	return func() { t.ended = append(t.ended, name) }
+}
+
+func TestTracer(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddDelayedMessages(1)
+	Require(t, builder.AddL2MessageBrotli([]byte("compressed")))
+	batch, err := builder.Build(0, 0, 0, 0, 1)
+	Require(t, err)
+	tracer := &recordingTracer{}
+	config := DefaultInboxMultiplexerConfig
+	config.Tracer = tracer
+	backend := NewMemoryInboxBackend([][]byte{batch}, [][]byte{encodeTestDelayedMessage(t, 0)})
+	multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+	for i := 0; i < 2; i++ {
+		_, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+	}
+	expected := []string{SpanPeekSequencerInbox, SpanReadDelayedInbox, SpanDecompressBrotli}
+	if !reflect.DeepEqual(tracer.started, expected) || !reflect.DeepEqual(tracer.ended, expected) {
+		Fail(t, "started spans", tracer.started, "and ended", tracer.ended, "instead of", expected)
+	}
+}
+
+func TestZstdSegments(t *testing.T) {
+	message := bytes.Repeat([]byte("zstd compressed message "), 64)
+	builder := NewBatchBuilder()
+	Require(t, builder.AddL2MessageZstd(message))
+	Require(t, builder.AddL2MessageZstd(make([]byte, arbos.MaxL2MessageSize+1)))
+	builder.AddL2Message([]byte{1})
+	batch, err := builder.Build(0, 0, 0, 0, 0)
+	Require(t, err)
+
+	popMessages := func(config *InboxMultiplexerConfig) []*MessageWithMetadata {
+		multiplexer := NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate, config)
+		var msgs []*MessageWithMetadata
+		for i := 0; i < 3; i++ {
+			msg, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+			msgs = append(msgs, msg)
+		}
+		return msgs
+	}
+
+	config := DefaultInboxMultiplexerConfig
+	config.ZstdSegments = true
+	msgs := popMessages(&config)
+	if msgs[0].Message.Header.Kind != arbos.L1MessageType_L2Message || !bytes.Equal(msgs[0].Message.L2msg, message) {
+		Fail(t, "zstd message wasn't decoded")
+	}
+	if msgs[1].Message.Header.Kind != arbos.L1MessageType_Invalid {
+		Fail(t, "zstd message over the size limit was accepted")
+	}
+	if msgs[2].Message.Header.Kind != arbos.L1MessageType_L2Message {
+		Fail(t, "message after the zstd segments wasn't decoded")
+	}
+
+	// without ZstdSegments the kind is unknown
+	msgs = popMessages(&DefaultInboxMultiplexerConfig)
+	for i := 0; i < 2; i++ {
+		if msgs[i].Message.Header.Kind != arbos.L1MessageType_Invalid {
+			Fail(t, "zstd segment", i, "was decoded without ZstdSegments enabled")
+		}
+	}
+}
+
+func TestZstdBrotliSizeComparison(t *testing.T) {
+	message := []byte(strings.Repeat("{\"to\":\"0x0000000000000000000000000000000000000001\",\"value\":1}", 100))
+	brotliCompressed, err := arbcompress.CompressWell(message)
+	Require(t, err)
+	zstdCompressed, err := compressZstd(message)
+	Require(t, err)
+	t.Log("message size", len(message), "brotli", len(brotliCompressed), "zstd", len(zstdCompressed))
+
+	brotliDecompressed, err := arbcompress.Decompress(brotliCompressed, len(message))
+	Require(t, err)
+	zstdDecompressed, err := decompressZstd(zstdCompressed, int64(len(message)))
+	Require(t, err)
+	if !bytes.Equal(brotliDecompressed, message) || !bytes.Equal(zstdDecompressed, message) {
+		Fail(t, "compressed message didn't round trip")
+	}
+}
+
+func TestSegmentObserver(t *testing.T) {
+	brotliMessage := []byte("compressed message")
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{1})
+	Require(t, builder.AdvanceTimestamp(1))
+	Require(t, builder.AddL2MessageBrotli(brotliMessage))
+	builder.AddDelayedMessages(1)
+	Require(t, builder.AdvanceL1BlockNumber(1))
+	builder.AddL2Message([]byte{2})
+	batch, err := builder.Build(0, 10, 0, 10, 1)
+	Require(t, err)
+
+	type observed struct {
+		index   int
+		kind    uint8
+		payload []byte
+	}
+	var segments []observed
+	config := DefaultInboxMultiplexerConfig
+	config.SegmentObserver = func(index int, kind uint8, payload []byte) {
+		segments = append(segments, observed{index, kind, payload})
+	}
+	backend := NewMemoryInboxBackend([][]byte{batch}, [][]byte{encodeTestDelayedMessage(t, 0)})
+	multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+	for backend.GetSequencerInboxPosition() == 0 {
+		_, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+	}
+
+	expected := []observed{
+		{0, BatchSegmentKindL2Message, []byte{1}},
+		{2, BatchSegmentKindL2MessageBrotli, brotliMessage},
+		{3, BatchSegmentKindDelayedMessages, []byte{}},
+		{5, BatchSegmentKindL2Message, []byte{2}},
+	}
+	if len(segments) != len(expected) {
+		Fail(t, "observed", len(segments), "segments but expected", len(expected))
+	}
+	for i, want := range expected {
+		got := segments[i]
+		if got.index != want.index || got.kind != want.kind || !bytes.Equal(got.payload, want.payload) {
+			Fail(t, "observed segment", i, "was", got, "expected", want)
+		}
+		if builder.segments[got.index][0] != got.kind {
+			Fail(t, "observed segment", i, "has a different kind than the builder's")
+		}
+	}
+}
+
+func TestSegmentObserverPopBatchOfDelayed(t *testing.T) {
+	corrupt := []byte{0xde, 0xad, 0xbe, 0xef, 0x01}
+	builder := NewBatchBuilder()
+	builder.AddDelayedMessages(1)
+	builder.segments = append(builder.segments, append([]byte{BatchSegmentKindL2MessageBrotli}, corrupt...))
+	builder.AddL2Message([]byte{1})
+	batch, err := builder.Build(0, 10, 0, 10, 1)
+	Require(t, err)
+
+	var observed []int
+	var dropped []uint64
+	config := DefaultInboxMultiplexerConfig
+	config.SegmentObserver = func(index int, kind uint8, payload []byte) {
+		observed = append(observed, index)
+	}
+	config.DroppedSegmentObserver = func(segment DroppedSegment) {
+		dropped = append(dropped, segment.SegmentNum)
+	}
+	backend := NewMemoryInboxBackend([][]byte{batch}, [][]byte{encodeTestDelayedMessage(t, 0)})
+	multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+	msgs, err := multiplexer.PopBatchOfDelayed(context.Background(), 10)
+	Require(t, err)
+	if len(msgs) != 1 {
+		Fail(t, "expected one delayed message but got", len(msgs))
+	}
+	// the look-ahead at the corrupt segment is rolled back, so it's only reported by the Pop that drops it
+	if len(observed) != 1 || observed[0] != 0 || len(dropped) != 0 {
+		Fail(t, "unexpected segments observed by PopBatchOfDelayed", observed, dropped)
+	}
+	for backend.GetSequencerInboxPosition() == 0 {
+		_, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+	}
+	if len(observed) != 2 || observed[1] != 2 || len(dropped) != 1 || dropped[0] != 1 {
+		Fail(t, "unexpected segments observed", observed, dropped)
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	withHeader := func(payload ...byte) []byte {
+		return append(make([]byte, 40), payload...)
+	}
+	testCases := []struct {
+		name    string
+		batch   []byte
+		delayed []byte
+	}{
+		{"bad segment kind", encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{0x7f}), nil},
+		{"delayed overrun", encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindDelayedMessages}), nil},
+		{"brotli failure", encodeTestBatch(t, 0, 0, 0, 0, 0, []byte{BatchSegmentKindL2MessageBrotli, 0xde, 0xad}), nil},
+		{"bad delayed message", encodeTestBatch(t, 0, 0, 0, 0, 1, []byte{BatchSegmentKindDelayedMessages}), []byte{0xff}},
+		{"missing header", make([]byte, 10), nil},
+		{"unknown format", withHeader(0x0f, 1, 2, 3), nil},
+		{"decompression failure", withHeader(BrotliMessageHeaderByte, 0xde, 0xad), nil},
+	}
+	for _, tc := range testCases {
+		for _, strict := range []bool{false, true} {
+			config := DefaultInboxMultiplexerConfig
+			config.Strict = strict
+			backend := NewMemoryInboxBackend([][]byte{tc.batch}, [][]byte{tc.delayed})
+			multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+			msg, err := multiplexer.Pop(context.Background())
+			if strict {
+				if !errors.Is(err, ErrInvalidSequencerMessage) {
+					Fail(t, tc.name, "expected strict mode to return an invalid sequencer message error, got", err)
+				}
+				if backend.GetSequencerInboxPosition() != 0 || backend.GetPositionWithinMessage() != 0 || multiplexer.DelayedMessagesRead() != 0 {
+					Fail(t, tc.name, "strict mode advanced past the invalid message")
+				}
+			} else {
+				Require(t, err)
+				if msg.Message.Header.Kind != arbos.L1MessageType_Invalid {
+					Fail(t, tc.name, "expected an invalid message, got kind", msg.Message.Header.Kind)
+				}
+			}
+		}
+	}
+}
+
+func TestAdvanceToBatch(t *testing.T) {
+	afterDelayed := []uint64{1, 2, 5, 6}
+	var batches [][]byte
+	for i, after := range afterDelayed {
+		batches = append(batches, encodeTestBatch(t, 0, 0, 0, 0, after,
+			[]byte{BatchSegmentKindL2Message, byte(i)},
+			[]byte{BatchSegmentKindDelayedMessages},
+		))
+	}
+	for _, poppedFirst := range []bool{false, true} {
+		backend := NewMemoryInboxBackend(batches, nil)
+		multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+		if poppedFirst {
+			msg, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+			if !bytes.Equal(msg.Message.L2msg, []byte{0}) {
+				Fail(t, "unexpected first message")
+			}
+		}
+		Require(t, multiplexer.AdvanceToBatch(context.Background(), 3))
+		if backend.GetSequencerInboxPosition() != 3 || backend.GetPositionWithinMessage() != 0 {
+			Fail(t, "backend ended at batch", backend.GetSequencerInboxPosition())
+		}
+		if multiplexer.DelayedMessagesRead() != afterDelayed[2] {
+			Fail(t, "delayed messages read is", multiplexer.DelayedMessagesRead(), "instead of", afterDelayed[2])
+		}
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if !bytes.Equal(msg.Message.L2msg, []byte{3}) || msg.DelayedMessagesRead != afterDelayed[2] {
+			Fail(t, "unexpected message after advancing", msg.Message.L2msg, msg.DelayedMessagesRead)
+		}
+		if multiplexer.AdvanceToBatch(context.Background(), 2) == nil {
+			Fail(t, "advanced backwards")
+		}
+	}
+}
+
+func TestAdvanceToBatchStrictDelayedRegression(t *testing.T) {
+	batches := [][]byte{
+		encodeTestBatch(t, 0, 0, 0, 0, 2, []byte{BatchSegmentKindL2Message, 0}),
+		encodeTestBatch(t, 0, 0, 0, 0, 1, []byte{BatchSegmentKindL2Message, 1}),
+		encodeTestBatch(t, 0, 0, 0, 0, 2, []byte{BatchSegmentKindL2Message, 2}),
+	}
+	config := DefaultInboxMultiplexerConfig
+	config.Strict = true
+	backend := NewMemoryInboxBackend(batches, nil)
+	multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+	if err := multiplexer.AdvanceToBatch(context.Background(), 3); !errors.Is(err, ErrInvalidSequencerMessage) {
+		Fail(t, "expected advancing past a regressed batch to fail, got", err)
+	}
+	if backend.GetSequencerInboxPosition() != 1 || multiplexer.DelayedMessagesRead() != 2 {
+		Fail(t, "advanced to batch", backend.GetSequencerInboxPosition(), "with", multiplexer.DelayedMessagesRead(), "delayed messages read")
+	}
+	// popping the regressed batch fails the same way
+	if _, err := multiplexer.Pop(context.Background()); !errors.Is(err, ErrInvalidSequencerMessage) {
+		Fail(t, "expected popping the regressed batch to fail, got", err)
+	}
+
+	config.Strict = false
+	backend = NewMemoryInboxBackend(batches, nil)
+	multiplexer = NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+	Require(t, multiplexer.AdvanceToBatch(context.Background(), 2))
+	if multiplexer.DelayedMessagesRead() != 1 {
+		Fail(t, "advanced with", multiplexer.DelayedMessagesRead(), "delayed messages read")
+	}
+}
+
+func TestAdvanceToBatchMaxVirtualDelayed(t *testing.T) {
+	batches := [][]byte{
+		encodeTestBatch(t, 0, 0, 0, 0, 5, []byte{BatchSegmentKindL2Message, 0}),
+		encodeTestBatch(t, 0, 0, 0, 0, 6, []byte{BatchSegmentKindDelayedMessages}, []byte{BatchSegmentKindL2Message, 1}),
+		encodeTestBatch(t, 0, 0, 0, 0, 9, []byte{BatchSegmentKindL2Message, 2}),
+		encodeTestBatch(t, 0, 0, 0, 0, 9, []byte{BatchSegmentKindL2Message, 3}),
+	}
+	var delayed [][]byte
+	for i := uint64(0); i < 9; i++ {
+		delayed = append(delayed, encodeTestDelayedMessage(t, i))
+	}
+	config := DefaultInboxMultiplexerConfig
+	config.MaxVirtualDelayedMessages = 2
+	for _, poppedFirst := range []bool{false, true} {
+		// the delayed messages read at the start of batch 3, reached by popping
+		poppingBackend := NewMemoryInboxBackend(batches, delayed)
+		popping := NewInboxMultiplexerWithConfig(poppingBackend, 0, nil, KeysetValidate, &config)
+		for poppingBackend.GetSequencerInboxPosition() < 3 {
+			_, err := popping.Pop(context.Background())
+			Require(t, err)
+		}
+		expected := popping.DelayedMessagesRead()
+		// the limit leaves batch 0 at 2 delayed messages read, batch 1 at 5 and batch 2 at 7
+		if expected != 7 {
+			Fail(t, "popping read", expected, "delayed messages")
+		}
+
+		backend := NewMemoryInboxBackend(batches, delayed)
+		multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+		if poppedFirst {
+			_, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+		}
+		Require(t, multiplexer.AdvanceToBatch(context.Background(), 3))
+		if multiplexer.DelayedMessagesRead() != expected {
+			Fail(t, "poppedFirst", poppedFirst, "advanced to", multiplexer.DelayedMessagesRead(), "delayed messages read instead of", expected)
+		}
+	}
+}
+
+func TestBatchAdvanceObserver(t *testing.T) {
+	type advance struct {
+		oldNum, newNum, delayedAfter uint64
+	}
+	batches := [][]byte{
+		encodeTestBatch(t, 0, 0, 0, 0, 1,
+			[]byte{BatchSegmentKindL2Message, 0},
+			[]byte{BatchSegmentKindDelayedMessages},
+		),
+		encodeTestBatch(t, 0, 0, 0, 0, 2, []byte{BatchSegmentKindDelayedMessages}),
+		encodeTestBatch(t, 0, 0, 0, 0, 2, []byte{BatchSegmentKindL2Message, 1}),
+	}
+	delayed := [][]byte{encodeTestDelayedMessage(t, 0), encodeTestDelayedMessage(t, 1)}
+	var advances []advance
+	config := &InboxMultiplexerConfig{
+		BatchAdvanceObserver: func(oldNum uint64, newNum uint64, delayedAfter uint64) {
+			advances = append(advances, advance{oldNum, newNum, delayedAfter})
+		},
+	}
+	multiplexer := NewInboxMultiplexerWithConfig(NewMemoryInboxBackend(batches, delayed), 0, nil, KeysetValidate, config)
+	for i := 0; i < 4; i++ {
+		_, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+	}
+	expected := []advance{{0, 1, 1}, {1, 2, 2}, {2, 3, 2}}
+	if !reflect.DeepEqual(advances, expected) {
+		Fail(t, "observed advances", advances, "instead of", expected)
+	}
+}
+
+func TestDelayedOverrunStrategy(t *testing.T) {
+	delayed := [][]byte{encodeTestDelayedMessage(t, 0), encodeTestDelayedMessage(t, 1)}
+	trailingVirtual := encodeTestBatch(t, 0, 0, 0, 0, 2, []byte{BatchSegmentKindDelayedMessages})
+	overSpecified := encodeTestBatch(t, 0, 0, 0, 0, 1,
+		[]byte{BatchSegmentKindDelayedMessages},
+		[]byte{BatchSegmentKindDelayedMessages},
+	)
+	regressed := encodeTestBatch(t, 0, 0, 0, 0, 1, []byte{BatchSegmentKindDelayedMessages})
+	testCases := []struct {
+		name          string
+		batch         []byte
+		startDelayed  uint64
+		strategy      DelayedOverrunStrategy
+		expectedKinds []uint8
+		expectedReads []uint64
+	}{
+		{"trailing virtual rewind", trailingVirtual, 0, DelayedOverrunRewind,
+			[]uint8{arbos.L1MessageType_EthDeposit, arbos.L1MessageType_EthDeposit}, []uint64{1, 2}},
+		{"trailing virtual clamp", trailingVirtual, 0, DelayedOverrunClamp,
+			[]uint8{arbos.L1MessageType_EthDeposit, arbos.L1MessageType_EthDeposit}, []uint64{1, 2}},
+		{"over-specified rewind", overSpecified, 0, DelayedOverrunRewind,
+			[]uint8{arbos.L1MessageType_EthDeposit, arbos.L1MessageType_Invalid}, []uint64{1, 1}},
+		{"over-specified clamp", overSpecified, 0, DelayedOverrunClamp,
+			[]uint8{arbos.L1MessageType_EthDeposit, arbos.L1MessageType_Invalid}, []uint64{1, 1}},
+		{"regressed rewind", regressed, 2, DelayedOverrunRewind,
+			[]uint8{arbos.L1MessageType_Invalid}, []uint64{1}},
+		{"regressed clamp", regressed, 2, DelayedOverrunClamp,
+			[]uint8{arbos.L1MessageType_Invalid}, []uint64{2}},
+	}
+	for _, tc := range testCases {
+		config := DefaultInboxMultiplexerConfig
+		config.DelayedOverrun = tc.strategy
+		backend := NewMemoryInboxBackend([][]byte{tc.batch}, delayed)
+		multiplexer := NewInboxMultiplexerWithConfig(backend, tc.startDelayed, nil, KeysetValidate, &config)
+		for i, kind := range tc.expectedKinds {
+			msg, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+			if msg.Message.Header.Kind != kind || msg.DelayedMessagesRead != tc.expectedReads[i] {
+				Fail(t, tc.name, "message", i, "had kind", msg.Message.Header.Kind, "and delayed count", msg.DelayedMessagesRead)
+			}
+		}
+		if backend.GetSequencerInboxPosition() != 1 {
+			Fail(t, tc.name, "batch produced more messages than expected")
+		}
+		if multiplexer.DelayedMessagesRead() != tc.expectedReads[len(tc.expectedReads)-1] {
+			Fail(t, tc.name, "ended with", multiplexer.DelayedMessagesRead(), "delayed messages read")
+		}
+	}
+}
+
+func TestPopInfoL2MessageKind(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{arbos.L2MessageKind_SignedTx, 1, 2})
+	Require(t, builder.AddL2MessageBrotli([]byte{arbos.L2MessageKind_Batch, 3}))
+	builder.AddL2Message([]byte{arbos.L2MessageKind_UnsignedUserTx})
+	builder.AddL2Message(nil)
+	builder.AddDelayedMessages(1)
+	batch, err := builder.Build(0, 0, 0, 0, 1)
+	Require(t, err)
+	backend := NewMemoryInboxBackend([][]byte{batch}, [][]byte{encodeTestDelayedMessage(t, 0)})
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	expected := []struct {
+		kind    uint8
+		hasKind bool
+	}{
+		{arbos.L2MessageKind_SignedTx, true},
+		{arbos.L2MessageKind_Batch, true},
+		{arbos.L2MessageKind_UnsignedUserTx, true},
+		// an empty L2 message has no kind
+		{0, false},
+		// nor does a deposit
+		{0, false},
+	}
+	for i, want := range expected {
+		_, info, err := multiplexer.PopWithInfo(context.Background())
+		Require(t, err)
+		if info.L2MessageKind != want.kind || info.HasL2MessageKind != want.hasKind {
+			Fail(t, "message", i, "reported kind", info.L2MessageKind, info.HasL2MessageKind)
+		}
+	}
+}
+
+func TestMaxVirtualDelayedMessages(t *testing.T) {
+	batches := [][]byte{
+		encodeTestBatch(t, 0, 0, 0, 0, 1000, []byte{BatchSegmentKindL2Message, 1}),
+		encodeTestBatch(t, 0, 0, 0, 0, 5, []byte{BatchSegmentKindL2Message, 2}),
+	}
+	var delayed [][]byte
+	for i := uint64(0); i < 5; i++ {
+		delayed = append(delayed, encodeTestDelayedMessage(t, i))
+	}
+	config := DefaultInboxMultiplexerConfig
+	config.MaxVirtualDelayedMessages = 3
+	backend := NewMemoryInboxBackend(batches, delayed)
+	multiplexer := NewInboxMultiplexerWithConfig(backend, 0, nil, KeysetValidate, &config)
+	_, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	if remaining, _ := multiplexer.RemainingInBatch(); remaining != 3 {
+		Fail(t, "expected 3 remaining messages but got", remaining)
+	}
+	for i := uint64(0); i < 3; i++ {
+		msg, info, err := multiplexer.PopWithInfo(context.Background())
+		Require(t, err)
+		if msg.Message.Header.Kind != arbos.L1MessageType_EthDeposit || msg.DelayedMessagesRead != i+1 {
+			Fail(t, "unexpected virtual delayed message", i, msg.Message.Header.Kind, msg.DelayedMessagesRead)
+		}
+		if info.CrossedBatchBoundary != (i == 2) {
+			Fail(t, "virtual delayed message", i, "had CrossedBatchBoundary", info.CrossedBatchBoundary)
+		}
+	}
+	if multiplexer.DelayedMessagesRead() != 3 {
+		Fail(t, "the capped batch left", multiplexer.DelayedMessagesRead(), "delayed messages read")
+	}
+	// the following batch reads the rest
+	expectedKinds := []uint8{arbos.L1MessageType_L2Message, arbos.L1MessageType_EthDeposit, arbos.L1MessageType_EthDeposit}
+	for i, kind := range expectedKinds {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if msg.Message.Header.Kind != kind {
+			Fail(t, "message", i, "of the following batch had kind", msg.Message.Header.Kind)
+		}
+	}
+	if multiplexer.DelayedMessagesRead() != 5 || backend.GetSequencerInboxPosition() != 2 {
+		Fail(t, "ended at", multiplexer.DelayedMessagesRead(), "delayed messages read in batch", backend.GetSequencerInboxPosition())
+	}
+}
+
+func TestParseDebugLog(t *testing.T) {
+	var records []*log.Record
+	previousHandler := log.Root().GetHandler()
+	log.Root().SetHandler(log.LvlFilterHandler(log.LvlDebug, log.FuncHandler(func(record *log.Record) error {
+		records = append(records, record)
+		return nil
+	})))
+	defer log.Root().SetHandler(previousHandler)
+
+	batch := encodeTestBatch(t, 0, 10, 0, 10, 0,
+		[]byte{BatchSegmentKindL2Message, 1},
+		[]byte{BatchSegmentKindL2Message, 2},
+		[]byte{BatchSegmentKindL2Message, 3},
+	)
+	multiplexer := NewInboxMultiplexer(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate)
+	_, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	for _, record := range records {
+		if record.Msg != "parsed sequencer message" {
+			continue
+		}
+		for i := 0; i+1 < len(record.Ctx); i += 2 {
+			if record.Ctx[i] == "segments" && record.Ctx[i+1] == 3 {
+				return
+			}
+		}
+		Fail(t, "parse debug log didn't report 3 segments", record.Ctx)
+	}
+	Fail(t, "parsing didn't log at debug level")
+}
+
+func TestUnknownSegmentHandler(t *testing.T) {
+	const customKind uint8 = 0x42
+	batch := encodeTestBatch(t, 0, 0, 0, 0, 0,
+		[]byte{customKind, 1, 2},
+		[]byte{customKind + 1, 3},
+		[]byte{BatchSegmentKindL2Message, 4},
+	)
+	config := DefaultInboxMultiplexerConfig
+	config.UnknownSegmentHandler = func(kind uint8, payload []byte) (*MessageWithMetadata, bool) {
+		if kind != customKind {
+			return nil, false
+		}
+		return &MessageWithMetadata{
+			Message: &arbos.L1IncomingMessage{
+				Header: &arbos.L1IncomingMessageHeader{Kind: arbos.L1MessageType_L2Message},
+				L2msg:  append([]byte{}, payload...),
+			},
+			DelayedMessagesRead: 100,
+		}, true
+	}
+	multiplexer := NewInboxMultiplexerWithConfig(NewMemoryInboxBackend([][]byte{batch}, nil), 0, nil, KeysetValidate, &config)
+	expected := []struct {
+		kind  uint8
+		l2msg []byte
+	}{
+		{arbos.L1MessageType_L2Message, []byte{1, 2}},
+		// the handler declined this kind
+		{arbos.L1MessageType_Invalid, []byte{}},
+		{arbos.L1MessageType_L2Message, []byte{4}},
+	}
+	for i, want := range expected {
+		msg, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+		if msg.Message.Header.Kind != want.kind || !bytes.Equal(msg.Message.L2msg, want.l2msg) {
+			Fail(t, "message", i, "was", msg.Message.Header.Kind, msg.Message.L2msg)
+		}
+		if msg.DelayedMessagesRead != 0 {
+			Fail(t, "message", i, "had DelayedMessagesRead", msg.DelayedMessagesRead)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	batches := [][]byte{
+		encodeTestBatch(t, 0, 0, 0, 0, 2,
+			[]byte{BatchSegmentKindL2Message, 1, 2, 3},
+			[]byte{BatchSegmentKindDelayedMessages},
+			[]byte{0x7f},
+			[]byte{BatchSegmentKindL2Message, 4},
+		),
+		// too short for the L1 header
+		{1, 2, 3},
+		encodeTestBatch(t, 0, 0, 0, 0, 2, []byte{BatchSegmentKindL2Message, 5, 6}),
+	}
+	backend := NewMemoryInboxBackend(batches, [][]byte{encodeTestDelayedMessage(t, 0), encodeTestDelayedMessage(t, 1)})
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	var expected MultiplexerStats
+	for backend.GetSequencerInboxPosition() < uint64(len(batches)) {
+		before := multiplexer.DelayedMessagesRead()
+		msg, info, err := multiplexer.PopWithInfo(context.Background())
+		Require(t, err)
+		switch {
+		case msg.Message.Header.Kind == arbos.L1MessageType_Invalid:
+			expected.InvalidMessages++
+		case msg.DelayedMessagesRead > before:
+			expected.DelayedMessages++
+		default:
+			expected.L2Messages++
+			expected.L2PayloadBytes += uint64(len(msg.Message.L2msg))
+		}
+		if info.CrossedBatchBoundary {
+			expected.BatchesCrossed++
+		}
+	}
+	stats := multiplexer.Stats()
+	// see TestDecompressedBytesStats
+	stats.BatchDecompressedBytes, stats.SegmentDecompressedBytes = 0, 0
+	if stats != expected {
+		Fail(t, "stats", stats, "don't match the messages counted", expected)
+	}
+	if stats.L2Messages != 3 || stats.DelayedMessages != 2 || stats.InvalidMessages != 2 || stats.L2PayloadBytes != 6 || stats.BatchesCrossed != 3 {
+		Fail(t, "unexpected stats", stats)
+	}
+	multiplexer.ResetStats()
+	if multiplexer.Stats() != (MultiplexerStats{}) {
+		Fail(t, "stats weren't reset", multiplexer.Stats())
+	}
+}
+
+func TestStatsPopPaths(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddDelayedMessages(1)
+	Require(t, builder.AddL2MessageBrotli(bytes.Repeat([]byte{1}, 100)))
+	// followed by two virtual delayed messages
+	first, err := builder.Build(0, 0, 0, 0, 3)
+	Require(t, err)
+	batches := [][]byte{
+		first,
+		// too short for the L1 header
+		{1, 2, 3},
+		encodeTestBatch(t, 0, 0, 0, 0, 3, []byte{BatchSegmentKindL2Message, 2}),
+	}
+	var delayed [][]byte
+	for i := uint64(0); i < 3; i++ {
+		delayed = append(delayed, encodeTestDelayedMessage(t, i))
+	}
+
+	popBackend := NewMemoryInboxBackend(batches, delayed)
+	popping := NewInboxMultiplexer(popBackend, 0, nil, KeysetValidate)
+	for popBackend.GetSequencerInboxPosition() < uint64(len(batches)) {
+		_, err := popping.Pop(context.Background())
+		Require(t, err)
+	}
+
+	// pops delayed messages in batches, and the rest with the batch iterator
+	backend := NewMemoryInboxBackend(batches, delayed)
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+	for backend.GetSequencerInboxPosition() < uint64(len(batches)) {
+		msgs, err := multiplexer.PopBatchOfDelayed(context.Background(), 10)
+		Require(t, err)
+		if len(msgs) != 0 {
+			continue
+		}
+		next, err := multiplexer.MessagesInCurrentBatch(context.Background())
+		Require(t, err)
+		_, ok, err := next()
+		Require(t, err)
+		if !ok {
+			Fail(t, "batch iterator returned no message at batch", backend.GetSequencerInboxPosition())
+		}
+	}
+	if multiplexer.Stats() != popping.Stats() {
+		Fail(t, "stats", multiplexer.Stats(), "don't match those from popping", popping.Stats())
+	}
+	if popping.Stats().DelayedMessages != 3 || popping.Stats().InvalidMessages != 1 || popping.Stats().SegmentDecompressedBytes != 100 {
+		Fail(t, "unexpected stats", popping.Stats())
+	}
+}
+
+func TestDecompressedBytesStats(t *testing.T) {
+	compressible := bytes.Repeat([]byte{7}, 1000)
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte("plain"))
+	Require(t, builder.AddL2MessageBrotli(compressible))
+	batch, err := builder.Build(0, 0, 0, 0, 0)
+	Require(t, err)
+	uncompressed, err := builder.BuildUncompressed(0, 0, 0, 0, 0)
+	Require(t, err)
+	batches := [][]byte{batch, uncompressed}
+	config := DefaultInboxMultiplexerConfig
+	config.UncompressedBatches = true
+	multiplexer := NewInboxMultiplexerWithConfig(NewMemoryInboxBackend(batches, nil), 0, nil, KeysetValidate, &config)
+
+	// peeking decompresses the batch, but not the message popped
+	_, err = multiplexer.Peek(context.Background())
+	Require(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := multiplexer.Pop(context.Background())
+		Require(t, err)
+	}
+	stats := multiplexer.Stats()
+	// only the first batch's segment stream is compressed
+	if stats.BatchDecompressedBytes != uint64(len(uncompressed)-41) {
+		Fail(t, "counted", stats.BatchDecompressedBytes, "batch bytes decompressed instead of", len(uncompressed)-41)
+	}
+	if stats.SegmentDecompressedBytes != 2*uint64(len(compressible)) {
+		Fail(t, "counted", stats.SegmentDecompressedBytes, "segment bytes decompressed instead of", 2*len(compressible))
+	}
+	if stats.DecompressedBytes() != stats.BatchDecompressedBytes+stats.SegmentDecompressedBytes {
+		Fail(t, "unexpected total", stats.DecompressedBytes())
+	}
+}
+
+func TestSeekSubMessage(t *testing.T) {
+	builder := NewBatchBuilder()
+	builder.AddL2Message([]byte{0})
+	builder.AddDelayedMessages(1)
+	Require(t, builder.AdvanceTimestamp(5))
+	builder.AddL2Message([]byte{2})
+	builder.AddL2Message([]byte{3})
+	batch, err := builder.Build(0, 100, 0, 100, 1)
+	Require(t, err)
+	backend := NewMemoryInboxBackend([][]byte{batch}, [][]byte{encodeTestDelayedMessage(t, 0)})
+	multiplexer := NewInboxMultiplexer(backend, 0, nil, KeysetValidate)
+
+	Require(t, multiplexer.SeekSubMessage(context.Background(), 2))
+	msg, err := multiplexer.Pop(context.Background())
+	Require(t, err)
+	if !bytes.Equal(msg.Message.L2msg, []byte{2}) || msg.Message.Header.Timestamp != 5 || msg.DelayedMessagesRead != 1 {
+		Fail(t, "unexpected message after seeking forward", msg.Message.L2msg, msg.Message.Header.Timestamp, msg.DelayedMessagesRead)
+	}
+
+	Require(t, multiplexer.SeekSubMessage(context.Background(), 1))
+	msg, err = multiplexer.Pop(context.Background())
+	Require(t, err)
+	if msg.Message.Header.Kind != arbos.L1MessageType_EthDeposit || msg.DelayedMessagesRead != 1 {
+		Fail(t, "unexpected message after seeking back", msg.Message.Header.Kind, msg.DelayedMessagesRead)
+	}
+
+	// the batch ends after its fourth message, having read its delayed message
+	for _, pos := range []uint64{4, 5} {
+		if err := multiplexer.SeekSubMessage(context.Background(), pos); err == nil {
+			Fail(t, "seeked past the batch's messages to", pos)
+		}
+	}
+	msg, err = multiplexer.Pop(context.Background())
+	Require(t, err)
+	if !bytes.Equal(msg.Message.L2msg, []byte{2}) {
+		Fail(t, "a failed seek moved the multiplexer to", msg.Message.L2msg)
+	}
+}
+
+func TestSeekSubMessageTrailingSegments(t *testing.T) {
+	segments := [][]byte{
+		{BatchSegmentKindL2Message, 0},
+		{BatchSegmentKindL2Message, 1},
+		{0x7f},
+	}
+	delayed := [][]byte{encodeTestDelayedMessage(t, 0)}
+	for _, afterDelayed := range []uint64{0, 1} {
+		batch := encodeTestBatch(t, 0, 0, 0, 0, afterDelayed, segments...)
+		// the positions popping reaches, where the trailing unknown segment is only reached while a delayed message remains
+		var popped []*MessageWithMetadata
+		popBackend := NewMemoryInboxBackend([][]byte{batch}, delayed)
+		popping := NewInboxMultiplexer(popBackend, 0, nil, KeysetValidate)
+		for popBackend.GetSequencerInboxPosition() == 0 {
+			msg, err := popping.Pop(context.Background())
+			Require(t, err)
+			popped = append(popped, msg)
+		}
+		for pos := uint64(0); pos <= 3; pos++ {
+			multiplexer := NewInboxMultiplexer(NewMemoryInboxBackend([][]byte{batch}, delayed), 0, nil, KeysetValidate)
+			err := multiplexer.SeekSubMessage(context.Background(), pos)
+			// seeking also stops after the last message segment, where the virtual delayed messages could start
+			if pos >= uint64(len(popped)) || pos > 2 {
+				if err == nil {
+					Fail(t, "afterDelayed", afterDelayed, "seeked to unreachable message", pos)
+				}
+				continue
+			}
+			Require(t, err)
+			msg, err := multiplexer.Pop(context.Background())
+			Require(t, err)
+			if !msg.Equals(popped[pos]) {
+				Fail(t, "afterDelayed", afterDelayed, "seeking to", pos, "popped", msg, "instead of", popped[pos])
+			}
+		}
+	}
+}
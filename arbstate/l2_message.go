@@ -0,0 +1,42 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/offchainlabs/nitro/arbos"
+)
+
+// Splits the L2msg of an L2 message into the binary encodings of the transactions it contains, in order,
+// parsing it with arbos so nested L2 message batches, heartbeats and unsigned transactions are handled as arbos does.
+// chainId is the chain the message was sequenced for. arbos needs it to build unsigned and contract transactions,
+// which L2msg doesn't carry a chain id for, and they're returned in their Arbitrum transaction encoding.
+// Messages of any L1 kind other than L1MessageType_L2Message, or that arbos fails to parse, return an error.
+func ExtractL2Transactions(msg *MessageWithMetadata, chainId *big.Int) ([][]byte, error) {
+	if msg == nil || msg.Message == nil || msg.Message.Header == nil {
+		return nil, errors.New("message has no L1 header")
+	}
+	if chainId == nil {
+		return nil, errors.New("no chain id to parse the message for")
+	}
+	if msg.Message.Header.Kind != arbos.L1MessageType_L2Message {
+		return nil, fmt.Errorf("message of kind %v isn't an L2 message", msg.Message.Header.Kind)
+	}
+	txs, err := msg.Message.ParseL2Transactions(chainId, nil)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([][]byte, 0, len(txs))
+	for _, tx := range txs {
+		data, err := tx.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, data)
+	}
+	return encoded, nil
+}
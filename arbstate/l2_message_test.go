@@ -0,0 +1,103 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"bytes"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/offchainlabs/nitro/arbos"
+	"github.com/offchainlabs/nitro/arbos/util"
+)
+
+func encodeTestL2Batch(t *testing.T, msgs ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(arbos.L2MessageKind_Batch)
+	for _, msg := range msgs {
+		Require(t, util.BytestringToWriter(msg, &buf))
+	}
+	return buf.Bytes()
+}
+
+func TestExtractL2Transactions(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	Require(t, err)
+	chainId := big.NewInt(412346)
+	signer := types.NewLondonSigner(chainId)
+	var signedTxs [][]byte
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		tx, err := types.SignNewTx(key, signer, &types.DynamicFeeTx{
+			ChainID:   chainId,
+			Nonce:     nonce,
+			GasTipCap: big.NewInt(0),
+			GasFeeCap: big.NewInt(1e9),
+			Gas:       21000,
+			To:        &common.Address{1},
+			Value:     big.NewInt(1),
+		})
+		Require(t, err)
+		encoded, err := tx.MarshalBinary()
+		Require(t, err)
+		signedTxs = append(signedTxs, encoded)
+	}
+	signed := func(tx []byte) []byte {
+		return append([]byte{arbos.L2MessageKind_SignedTx}, tx...)
+	}
+	l2msg := encodeTestL2Batch(t,
+		signed(signedTxs[0]),
+		[]byte{arbos.L2MessageKind_Heartbeat},
+		encodeTestL2Batch(t, signed(signedTxs[1]), signed(signedTxs[2])),
+	)
+	msg := &MessageWithMetadata{
+		Message: &arbos.L1IncomingMessage{
+			Header: &arbos.L1IncomingMessageHeader{Kind: arbos.L1MessageType_L2Message},
+			L2msg:  l2msg,
+		},
+	}
+	txs, err := ExtractL2Transactions(msg, chainId)
+	Require(t, err)
+	if !reflect.DeepEqual(txs, signedTxs) {
+		Fail(t, "extracted", len(txs), "transactions instead of", len(signedTxs))
+	}
+	for i, encoded := range txs {
+		var tx types.Transaction
+		Require(t, tx.UnmarshalBinary(encoded))
+		if tx.Nonce() != uint64(i) {
+			Fail(t, "transaction", i, "has nonce", tx.Nonce())
+		}
+	}
+
+	msg.Message.L2msg = signed(signedTxs[0])
+	txs, err = ExtractL2Transactions(msg, chainId)
+	Require(t, err)
+	if len(txs) != 1 || !bytes.Equal(txs[0], signedTxs[0]) {
+		Fail(t, "unexpected transactions from a single signed transaction", txs)
+	}
+
+	// arbos doesn't implement this kind, so the whole message fails to parse
+	msg.Message.L2msg = encodeTestL2Batch(t, signed(signedTxs[0]), []byte{arbos.L2MessageKind_NonmutatingCall})
+	if _, err := ExtractL2Transactions(msg, chainId); err == nil {
+		Fail(t, "extracted transactions from a batch with a nonmutating call")
+	}
+	msg.Message.L2msg = signed(signedTxs[0])
+	msg.Message.Header.Kind = arbos.L1MessageType_EthDeposit
+	if _, err := ExtractL2Transactions(msg, chainId); err == nil {
+		Fail(t, "extracted transactions from a deposit")
+	}
+	msg.Message.Header.Kind = arbos.L1MessageType_L2Message
+	if _, err := ExtractL2Transactions(msg, nil); err == nil {
+		Fail(t, "extracted transactions without a chain id")
+	}
+	for _, invalid := range []*MessageWithMetadata{nil, {}, {Message: &arbos.L1IncomingMessage{L2msg: msg.Message.L2msg}}} {
+		if _, err := ExtractL2Transactions(invalid, chainId); err == nil {
+			Fail(t, "extracted transactions from a message without a header", invalid)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"fmt"
+)
+
+// An InboxBackend holding its sequencer batches and delayed messages in memory, for tests and tooling
+type MemoryInboxBackend struct {
+	batches               [][]byte
+	delayedMessages       [][]byte
+	batchPosition         uint64
+	positionWithinMessage uint64
+}
+
+func NewMemoryInboxBackend(batches [][]byte, delayedMessages [][]byte) *MemoryInboxBackend {
+	return &MemoryInboxBackend{
+		batches:         batches,
+		delayedMessages: delayedMessages,
+	}
+}
+
+func (b *MemoryInboxBackend) PeekSequencerInbox() ([]byte, error) {
+	if b.batchPosition >= uint64(len(b.batches)) {
+		return nil, ErrNoMoreBatches
+	}
+	return b.batches[b.batchPosition], nil
+}
+
+func (b *MemoryInboxBackend) GetSequencerInboxPosition() uint64 {
+	return b.batchPosition
+}
+
+func (b *MemoryInboxBackend) AdvanceSequencerInbox() {
+	b.batchPosition++
+}
+
+func (b *MemoryInboxBackend) GetPositionWithinMessage() uint64 {
+	return b.positionWithinMessage
+}
+
+func (b *MemoryInboxBackend) SetPositionWithinMessage(pos uint64) {
+	b.positionWithinMessage = pos
+}
+
+func (b *MemoryInboxBackend) ReadDelayedInbox(seqNum uint64) ([]byte, error) {
+	if seqNum >= uint64(len(b.delayedMessages)) {
+		return nil, fmt.Errorf("%w: %v (have %v)", ErrDelayedMessageNotFound, seqNum, len(b.delayedMessages))
+	}
+	return b.delayedMessages[seqNum], nil
+}
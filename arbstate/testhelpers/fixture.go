@@ -0,0 +1,52 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package testhelpers
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+
+	"github.com/offchainlabs/nitro/arbos"
+	"github.com/offchainlabs/nitro/arbstate"
+)
+
+// A brotli batch with a segment of every kind, reading two delayed messages.
+// In order: advance timestamp by 5, advance L1 block by 2, an L2 message, a brotli L2 message, a delayed message,
+// an empty segment, a zstd L2 message, an unknown kind 0x7f, and a final L2 message.
+// Its timestamps and L1 blocks range from 1 to 100.
+var GoldenBatch = hexutil.MustDecode(
+	"0x00000000000000010000000000000064000000000000000100000000000000640000000000000002001b6e000064fa7bf7267ddda36c" +
+		"79e79d8763da983426456be10f3c4b13ed3c90366cc0095918d8b20c66c3c6d8742c31a8a6984e095a836b51ae9995b8a94f27a8b0e0" +
+		"75ab56d24fde41c9d939884ee6292673c7681cd0f025f227e0045abbed4e89795c13a7e9086e77c9b73b1e",
+)
+
+const goldenDelayedMessages = 2
+
+// Returns a backend at the start of GoldenBatch, with the delayed messages it reads
+func NewGoldenBackend() (*arbstate.MemoryInboxBackend, error) {
+	return newGoldenBackendWithBatch(GoldenBatch)
+}
+
+func newGoldenBackendWithBatch(batch []byte) (*arbstate.MemoryInboxBackend, error) {
+	var delayedMessages [][]byte
+	for i := 0; i < goldenDelayedMessages; i++ {
+		requestId := common.BigToHash(big.NewInt(int64(i)))
+		msg := arbos.L1IncomingMessage{
+			Header: &arbos.L1IncomingMessageHeader{
+				Kind:      arbos.L1MessageType_EthDeposit,
+				RequestId: &requestId,
+				L1BaseFee: big.NewInt(0),
+			},
+			L2msg: []byte("golden deposit"),
+		}
+		data, err := msg.Serialize()
+		if err != nil {
+			return nil, err
+		}
+		delayedMessages = append(delayedMessages, data)
+	}
+	return arbstate.NewMemoryInboxBackend([][]byte{batch}, delayedMessages), nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package testhelpers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/offchainlabs/nitro/arbstate"
+)
+
+// Pops from a new multiplexer over each backend, starting with no delayed messages read, until both finish a batch.
+// Returns an error describing the first message they disagree on, or the first error popping.
+func MultiplexersAgree(ctx context.Context, backendA arbstate.InboxBackend, backendB arbstate.InboxBackend) error {
+	multiplexerA := arbstate.NewInboxMultiplexer(backendA, 0, nil, arbstate.KeysetValidate)
+	multiplexerB := arbstate.NewInboxMultiplexer(backendB, 0, nil, arbstate.KeysetValidate)
+	for i := 0; ; i++ {
+		msgA, infoA, err := multiplexerA.PopWithInfo(ctx)
+		if err != nil {
+			return fmt.Errorf("first multiplexer failed popping message %v: %w", i, err)
+		}
+		msgB, infoB, err := multiplexerB.PopWithInfo(ctx)
+		if err != nil {
+			return fmt.Errorf("second multiplexer failed popping message %v: %w", i, err)
+		}
+		if !msgA.Equals(msgB) {
+			return fmt.Errorf("message %v differs: %+v vs %+v", i, msgA.Message, msgB.Message)
+		}
+		if infoA != infoB {
+			return fmt.Errorf("message %v pop info differs: %+v vs %+v", i, infoA, infoB)
+		}
+		if infoA.CrossedBatchBoundary {
+			return nil
+		}
+	}
+}
+
+// Fails the test unless MultiplexersAgree on the backends
+func AssertMultiplexersAgree(t *testing.T, backendA arbstate.InboxBackend, backendB arbstate.InboxBackend) {
+	t.Helper()
+	if err := MultiplexersAgree(context.Background(), backendA, backendB); err != nil {
+		t.Fatal(err)
+	}
+}
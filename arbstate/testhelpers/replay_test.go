@@ -0,0 +1,56 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package testhelpers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/offchainlabs/nitro/arbstate"
+	"github.com/offchainlabs/nitro/util/testhelpers"
+)
+
+func newGoldenBackend(t *testing.T) *arbstate.MemoryInboxBackend {
+	t.Helper()
+	backend, err := NewGoldenBackend()
+	testhelpers.RequireImpl(t, err)
+	return backend
+}
+
+func TestGoldenBatch(t *testing.T) {
+	counts, err := arbstate.CountSegmentKinds(GoldenBatch)
+	testhelpers.RequireImpl(t, err)
+	for _, kind := range []uint8{
+		arbstate.BatchSegmentKindL2Message,
+		arbstate.BatchSegmentKindL2MessageBrotli,
+		arbstate.BatchSegmentKindL2MessageZstd,
+		arbstate.BatchSegmentKindDelayedMessages,
+		arbstate.BatchSegmentKindAdvanceTimestamp,
+		arbstate.BatchSegmentKindAdvanceL1BlockNumber,
+	} {
+		if counts.Kinds[kind] == 0 {
+			testhelpers.FailImpl(t, "golden batch has no segment of kind", kind)
+		}
+	}
+	if counts.Empty == 0 || counts.Unknown == 0 {
+		testhelpers.FailImpl(t, "golden batch is missing an empty or unknown segment", counts)
+	}
+}
+
+func TestMultiplexersAgree(t *testing.T) {
+	AssertMultiplexersAgree(t, newGoldenBackend(t), newGoldenBackend(t))
+}
+
+func TestMultiplexersDisagree(t *testing.T) {
+	diverging := append([]byte{}, GoldenBatch...)
+	// raise the batch's minimum timestamp from 1 to 10, past the 5 its messages would otherwise have
+	diverging[7] = 10
+	backend, err := newGoldenBackendWithBatch(diverging)
+	testhelpers.RequireImpl(t, err)
+	err = MultiplexersAgree(context.Background(), newGoldenBackend(t), backend)
+	if err == nil || !strings.Contains(err.Error(), "message 0 differs") {
+		testhelpers.FailImpl(t, "multiplexers over different batches didn't disagree on the first message, err", err)
+	}
+}
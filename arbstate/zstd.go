@@ -0,0 +1,37 @@
+// Copyright 2022, Offchain Labs, Inc.
+// For license information, see https://github.com/nitro/blob/master/LICENSE
+
+package arbstate
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func decompressZstd(input []byte, maxSize int64) ([]byte, error) {
+	decoder, err := zstd.NewReader(bytes.NewReader(input), zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	output, err := io.ReadAll(io.LimitReader(decoder, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed zstd decompression: %w", err)
+	}
+	if int64(len(output)) > maxSize {
+		return nil, fmt.Errorf("zstd result too large: over %v bytes", maxSize)
+	}
+	return output, nil
+}
+
+func compressZstd(input []byte) ([]byte, error) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(input, nil), nil
+}